@@ -2,15 +2,13 @@ package main
 
 import (
 	"fmt"
+	"html/template"
 	"net/http"
-	"os"
-	"path/filepath"
-	"text/template"
 
 	"github.com/julienschmidt/httprouter"
 )
 
-var adminQueueTemplate = template.Must(template.New("adminQueue").Parse(`
+var adminQueueTemplate = template.Must(template.New("adminQueue").Funcs(templateFuncs).Parse(`
 <!DOCTYPE html>
 <html>
 	<head>
@@ -21,6 +19,18 @@ var adminQueueTemplate = template.Must(template.New("adminQueue").Parse(`
 	<body>
 		<header>
 			<a href="/images">Dispel</a>
+			|
+			<a href="/admin/tags">Tags</a>
+			|
+			<a href="/admin/aliases">Aliases</a>
+			|
+			<a href="/admin/implications">Implications</a>
+			|
+			<a href="/admin/audit">Audit</a>
+			|
+			<a href="/admin/trash">Trash</a>
+			|
+			<a href="/admin/backup?gzip=true">Backup</a>
 		</header>
 		<div class="flex">
 		</div>
@@ -31,7 +41,7 @@ var adminQueueTemplate = template.Must(template.New("adminQueue").Parse(`
 						{{ if eq $entry.Action "upload" }}
 						<img class="preview" src="/admin/queue/{{ $entry.Hash }}_thumb.jpg" />
 						{{ else }}
-						<img class="preview" src="/static/thumbnails/{{ $entry.Hash }}.jpg" />
+						<img class="preview" src="{{ thumbURL $entry.Hash }}" />
 						{{ end }}
 					</span>
 				</a>
@@ -51,7 +61,7 @@ type queueDeleteArgs struct {
 	Index int
 }
 
-var adminQueueDeleteTemplate = template.Must(template.New("adminQueueDelete").Parse(`
+var adminQueueDeleteTemplate = template.Must(template.New("adminQueueDelete").Funcs(templateFuncs).Parse(`
 <!DOCTYPE html>
 <html>
 	<head>
@@ -67,7 +77,7 @@ var adminQueueDeleteTemplate = template.Must(template.New("adminQueueDelete").Pa
 		</header>
 		<div class="content">
 			<div class="content-img">
-				<img style="max-width: 100%;" src="/static/images/{{ .Hash }}{{ .Ext }}" />
+				<img style="max-width: 100%;" src="{{ imageURL .Hash .Ext }}" />
 			</div>
 			<div class="judge">
 				<h5>Delete this image?</h5>
@@ -88,9 +98,10 @@ type queueSetTagsArgs struct {
 	queueItem
 	Index          int
 	Added, Removed []string
+	OldParent      string
 }
 
-var adminQueueSetTagsTemplate = template.Must(template.New("adminQueueSetTags").Parse(`
+var adminQueueSetTagsTemplate = template.Must(template.New("adminQueueSetTags").Funcs(templateFuncs).Parse(`
 <!DOCTYPE html>
 <html>
 	<head>
@@ -106,11 +117,15 @@ var adminQueueSetTagsTemplate = template.Must(template.New("adminQueueSetTags").
 		</header>
 		<div class="content">
 			<div class="content-img">
-				<img style="max-width: 100%;" src="/static/images/{{ .Hash }}{{ .Ext }}" />
+				<img style="max-width: 100%;" src="{{ imageURL .Hash .Ext }}" />
 			</div>
 			<textarea name="tags">{{ range $tag, $_ := .Tags }}{{ $tag }} {{ end }}</textarea>
 			<h6>Added: <span style="color: green">{{ range .Added }}{{ . }} {{ end }}</span></h6>
 			<h6>Removed: <span style="color: red">{{ range .Removed }}{{ . }} {{ end }}</span></h6>
+			{{ if .Submitter }}<h6>Submitted by {{ .Submitter }}</h6>{{ end }}
+			{{ if ne .Parent .OldParent }}
+			<h6>Parent: <span style="color: red">{{ or .OldParent "none" }}</span> &rarr; <span style="color: green">{{ or .Parent "none" }}</span></h6>
+			{{ end }}
 			<div class="judge">
 				<h5>Modify this image's tags?</h5>
 				<form action="" method="post">
@@ -126,6 +141,64 @@ var adminQueueSetTagsTemplate = template.Must(template.New("adminQueueSetTags").
 </html>
 `))
 
+type queueSetPoolArgs struct {
+	queueItem
+	Index   int
+	OldPool *poolEntry
+}
+
+var adminQueueSetPoolTemplate = template.Must(template.New("adminQueueSetPool").Funcs(templateFuncs).Parse(`
+<!DOCTYPE html>
+<html>
+	<head>
+		<title>Dispel - Admin Queue</title>
+		<link rel="stylesheet" href="/static/css/milligram.min.css">
+		<link rel="stylesheet" href="/static/css/images.css">
+	</head>
+	<body>
+		<header>
+			<a href="/images">Dispel</a>
+			|
+			<a href="/admin/queue">Queue</a>
+		</header>
+		<div class="content">
+			{{ with .Pool }}
+			<h5>{{ .Name }}</h5>
+			<p>{{ .Description }}</p>
+			<div class="imagelist">
+				{{ range $i, $page := .Pages }}
+					<span class="thumb" title="{{ inc $i }}. {{ $page.Caption }}">
+						<img class="preview" src="{{ thumbURL $page.Hash }}" />
+					</span>
+				{{ end }}
+			</div>
+			{{ end }}
+			{{ with .OldPool }}
+			<h6>Currently:</h6>
+			<p style="color: red">{{ .Description }}</p>
+			<div class="imagelist">
+				{{ range $i, $page := .Pages }}
+					<span class="thumb" title="{{ inc $i }}. {{ $page.Caption }}">
+						<img class="preview" src="{{ thumbURL $page.Hash }}" />
+					</span>
+				{{ end }}
+			</div>
+			{{ end }}
+			<div class="judge">
+				<h5>{{ if .OldPool }}Modify{{ else }}Create{{ end }} this pool?</h5>
+				<form action="" method="post">
+					<button type="submit" formaction="/admin/queue?item={{ .Index }}&approve=true">Approve</button>
+					<button type="submit" formaction="/admin/queue?item={{ .Index }}&approve=false">Deny</button>
+				</form>
+			</div>
+		</div>
+		<footer></footer>
+	</body>
+	<script>
+	</script>
+</html>
+`))
+
 type queueUploadArgs struct {
 	queueItem
 	Index int
@@ -170,84 +243,140 @@ func (db *imageDB) adminHandler(w http.ResponseWriter, req *http.Request, _ http
 }
 
 func (db *imageDB) adminQueueImg(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	http.ServeFile(w, req, filepath.Join("queue", ps.ByName("path")))
+	name := ps.ByName("path")
+	for _, v := range []blobVariant{variantQueued, variantQueuedThumb} {
+		if hash, ext, ok := v.parse(name); ok {
+			serveBlob(w, req, db.blobs, v, hash, ext)
+			return
+		}
+	}
+	http.NotFound(w, req)
 }
 
 func (db *imageDB) adminQueueHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
+	queue, err := db.store.QueueItems()
+	if err != nil {
+		http.Error(w, "failed to load queue: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 	if req.FormValue("item") == "" {
-		adminQueueTemplate.Execute(w, db.Queue)
+		adminQueueTemplate.Execute(w, queue)
 		return
 	}
 
 	var index int
-	_, err := fmt.Sscan(req.FormValue("item"), &index)
-	if err != nil || index < 0 || index >= len(db.Queue) {
+	_, err = fmt.Sscan(req.FormValue("item"), &index)
+	if err != nil || index < 0 || index >= len(queue) {
 		http.Error(w, "invalid queue index", http.StatusBadRequest)
 		return
 	}
-	switch item := db.Queue[index]; item.Action {
+	switch item := queue[index]; item.Action {
 	case actionDelete:
 		adminQueueDeleteTemplate.Execute(w, queueDeleteArgs{item, index})
 	case actionSetTags:
-		added, removed := db.Images[item.Hash].Tags.diff(item.Tags)
-		adminQueueSetTagsTemplate.Execute(w, queueSetTagsArgs{item, index, added, removed})
+		cur, _, err := db.findImage(item.Hash)
+		if err != nil {
+			http.Error(w, "failed to load image: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		added, removed := cur.Tags.diff(item.Tags)
+		adminQueueSetTagsTemplate.Execute(w, queueSetTagsArgs{item, index, added, removed, cur.Parent})
 	case actionUpload:
 		adminQueueUploadTemplate.Execute(w, queueUploadArgs{item, index})
+	case actionSetPool:
+		old, ok, err := db.store.Pool(item.Pool.Name)
+		if err != nil {
+			http.Error(w, "failed to load pool: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		args := queueSetPoolArgs{queueItem: item, Index: index}
+		if ok {
+			args.OldPool = &old
+		}
+		adminQueueSetPoolTemplate.Execute(w, args)
 	default:
 		http.Error(w, "unknown action: "+item.Action, http.StatusInternalServerError)
 	}
 }
 
+// runDelete and runSetTags look the image up again, since it may have been
+// rekeyed by SHA-256 since the item was queued.
+
 func (db *imageDB) runDelete(item queueItem) error {
-	err := db.removeImage(item.Hash)
+	entry, ok, err := db.findImage(item.Hash)
 	if err != nil {
 		return err
+	} else if !ok {
+		return errImageNotExists
 	}
-	// delete image + thumbnail from disk
-	os.Remove(filepath.Join("static", "images", item.Hash+item.Ext))
-	os.Remove(filepath.Join("static", "thumbnails", item.Hash+".jpg"))
-	return nil
+	return db.trashImage(entry)
 }
 
 func (db *imageDB) runSetTags(item queueItem) error {
-	_, ok := db.Images[item.Hash]
-	if !ok {
+	entry, ok, err := db.findImage(item.Hash)
+	if err != nil {
+		return err
+	} else if !ok {
 		return errImageNotExists
 	}
-	err := db.removeImage(item.Hash)
+	// the parent may have changed since the item was queued
+	parent, err := db.resolveParent(entry.Hash, item.Parent)
 	if err != nil {
 		return err
 	}
-	return db.addImage(item.imageEntry)
+	err = db.removeImage(entry.Hash)
+	if err != nil {
+		return err
+	}
+	old := entry.Tags
+	entry.Tags = item.Tags
+	entry.Parent = parent
+	if err := db.addImage(entry); err != nil {
+		return err
+	}
+	if err := db.recordRevision(entry.Hash, old, item.Submitter); err != nil {
+		return err
+	}
+	return db.applyTagCategories(item.Categories)
+}
+
+// runSetPool resolves the pool's pages again, since they may have been
+// rekeyed or deleted since the item was queued.
+func (db *imageDB) runSetPool(item queueItem) error {
+	pool, err := db.resolvePool(*item.Pool)
+	if err != nil {
+		return err
+	}
+	return db.store.SetPool(pool)
 }
 
 func (db *imageDB) runUpload(item queueItem) error {
 	// move image+thumbnail to static dir
-	err := os.Rename(
-		filepath.Join("queue", item.Hash+item.Ext),
-		filepath.Join("static", "images", item.Hash+item.Ext),
-	)
+	err := moveBlob(db.blobs, variantQueued, variantImage, item.Hash, item.Ext)
 	if err != nil {
 		return err
 	}
-	err = os.Rename(
-		filepath.Join("queue", item.Hash+"_thumb.jpg"),
-		filepath.Join("static", "thumbnails", item.Hash+".jpg"),
-	)
+	err = moveBlob(db.blobs, variantQueuedThumb, variantThumb, item.Hash, thumbExt)
 	if err != nil {
 		return err
 	}
 
 	// add image to database
 	err = db.addImage(item.imageEntry)
-	if err != nil && err != errImageExists {
-		os.Remove(filepath.Join("static", "images", item.Hash+item.Ext))
-		os.Remove(filepath.Join("static", "thumbnails", item.Hash+".jpg"))
+	if err == errImageExists {
+		return db.applyTagCategories(item.Categories)
+	} else if err != nil {
+		db.blobs.Delete(variantImage, item.Hash, item.Ext)
+		db.blobs.Delete(variantThumb, item.Hash, thumbExt)
 		return err
 	}
-	return nil
+	// the initial tags are the first revision
+	if err := db.recordRevision(item.Hash, nil, item.Submitter); err != nil {
+		return err
+	}
+	return db.applyTagCategories(item.Categories)
 }
 
 // adminQueueHandlerPOST approves or denies an item in the queue.
@@ -262,18 +391,28 @@ func (db *imageDB) adminQueueHandlerPOST(w http.ResponseWriter, req *http.Reques
 		http.Error(w, "invalid approve value", http.StatusBadRequest)
 		return
 	}
+	queue, err := db.store.QueueItems()
+	if err != nil {
+		http.Error(w, "failed to load queue: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 	_, err = fmt.Sscan(req.FormValue("item"), &index)
-	if err != nil || index < 0 || index > len(db.Queue) {
+	if err != nil || index < 0 || index >= len(queue) {
 		http.Error(w, "invalid queue index", http.StatusBadRequest)
 		return
 	}
-	item := db.Queue[index]
+	item := queue[index]
+	audit, err := db.newAuditEntry(item, approve, remoteHost(req))
+	if err != nil {
+		http.Error(w, "failed to load item: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	if !approve {
 		// need to delete temp file
 		if item.Action == actionUpload {
-			os.Remove(filepath.Join("queue", item.Hash+"_thumb.jpg"))
-			os.Remove(filepath.Join("queue", item.Hash+item.Ext))
+			db.blobs.Delete(variantQueuedThumb, item.Hash, thumbExt)
+			db.blobs.Delete(variantQueued, item.Hash, item.Ext)
 		}
 		goto done
 	}
@@ -297,14 +436,28 @@ func (db *imageDB) adminQueueHandlerPOST(w http.ResponseWriter, req *http.Reques
 			http.Error(w, "failed to upload image: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+	case actionSetPool:
+		err = db.runSetPool(item)
+		if err != nil {
+			http.Error(w, "failed to set pool: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 	default:
 		panic("bad action type: " + item.Action)
 	}
 
 done:
 	// remove from queue
-	db.Queue = append(db.Queue[:index], db.Queue[index+1:]...)
-	db.save()
+	err = db.store.PopQueue(index)
+	if err != nil {
+		http.Error(w, "failed to update queue: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = db.store.AddAudit(audit)
+	if err != nil {
+		http.Error(w, "failed to record decision: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	http.Redirect(w, req, "/admin/queue", http.StatusSeeOther)
 }
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var (
+	errAliasSelf      = errors.New("a tag cannot be an alias of itself")
+	errAliasExists    = errors.New("alias already exists")
+	errAliasNotExists = errors.New("alias does not exist")
+	errBadTagName     = errors.New("tags must be non-empty, contain no spaces, and not begin with a -")
+)
+
+// validTagName reports whether tag can be stored as a tag name.
+func validTagName(tag string) bool {
+	return tag != "" && !strings.HasPrefix(tag, "-") && len(strings.Fields(tag)) == 1
+}
+
+// addAlias makes alias an alias of tag. Images already tagged with alias are
+// retagged with tag, and alias's category, description and implications are
+// carried over to tag where they fit. Aliases of alias are pointed at tag, so
+// that aliases never chain. It returns the number of images retagged.
+func (db *imageDB) addAlias(alias, tag string) (int, error) {
+	if !validTagName(alias) || !validTagName(tag) {
+		return 0, errBadTagName
+	}
+	if _, ok, err := db.store.Alias(alias); err != nil {
+		return 0, err
+	} else if ok {
+		return 0, errAliasExists
+	}
+	tag, err := db.resolveAlias(tag)
+	if err != nil {
+		return 0, err
+	} else if tag == alias {
+		return 0, errAliasSelf
+	}
+
+	if err := db.repointAliases(alias, tag); err != nil {
+		return 0, err
+	}
+	if err := db.store.SetAlias(alias, tag); err != nil {
+		return 0, err
+	}
+	if err := db.moveImplications(alias, tag); err != nil {
+		return 0, err
+	}
+
+	old, ok, err := db.store.Tag(alias)
+	if err != nil || !ok {
+		return 0, err
+	}
+	if old.info() != (tagInfo{}) {
+		cur, _, err := db.store.TagInfo(tag)
+		if err != nil {
+			return 0, err
+		}
+		info := mergeTagInfo(cur.info(), old.info())
+		if err := db.store.SetTagInfo(tag, info); err != nil {
+			return 0, err
+		}
+		if err := db.store.SetTagInfo(alias, tagInfo{}); err != nil {
+			return 0, err
+		}
+	}
+	// addImage expands the alias. Collect the hashes first, since old.Images
+	// may be the store's own set.
+	hashes := fromStringSet(old.Images)
+	for _, hash := range hashes {
+		entry, ok, err := db.store.Image(hash)
+		if err != nil {
+			return 0, err
+		} else if !ok {
+			continue
+		}
+		if err := db.removeImage(hash); err != nil {
+			return 0, err
+		}
+		if err := db.addImage(entry); err != nil {
+			return 0, err
+		}
+	}
+	return len(hashes), nil
+}
+
+// aliasesOf returns the aliases that refer to tag.
+func (db *imageDB) aliasesOf(tag string) ([]string, error) {
+	var aliases []string
+	err := db.store.ForEachAlias(func(alias, t string) error {
+		if t == tag {
+			aliases = append(aliases, alias)
+		}
+		return nil
+	})
+	return aliases, err
+}
+
+// repointAliases makes every alias of from an alias of to instead.
+func (db *imageDB) repointAliases(from, to string) error {
+	aliases, err := db.aliasesOf(from)
+	if err != nil {
+		return err
+	}
+	for _, alias := range aliases {
+		if err := db.store.SetAlias(alias, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// planImplicationMove returns the implications of and on from, and those
+// that replace them once rewritten to refer to to. Any that would then be a
+// cycle are dropped. The store is not modified.
+func (db *imageDB) planImplicationMove(from, to string) (remove, add []implicationEntry, err error) {
+	implies := make(map[string]stringSet)
+	err = db.store.ForEachImplication(func(t, implied string) error {
+		if t == from || implied == from {
+			remove = append(remove, implicationEntry{t, implied})
+			return nil
+		}
+		if implies[t] == nil {
+			implies[t] = make(stringSet)
+		}
+		implies[t][implied] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	// implies reflects the store once remove is applied; check each
+	// rewritten implication against it, as addImplication would
+	cycle := func(imp implicationEntry) bool {
+		seen := make(stringSet)
+		queue := []string{imp.Implied}
+		for len(queue) > 0 {
+			t := queue[0]
+			queue = queue[1:]
+			if t == imp.Tag {
+				return true
+			} else if _, ok := seen[t]; ok {
+				continue
+			}
+			seen[t] = struct{}{}
+			queue = append(queue, fromStringSet(implies[t])...)
+		}
+		return false
+	}
+	for _, imp := range remove {
+		if imp.Tag == from {
+			imp.Tag = to
+		}
+		if imp.Implied == from {
+			imp.Implied = to
+		}
+		if cycle(imp) {
+			continue
+		}
+		if implies[imp.Tag] == nil {
+			implies[imp.Tag] = make(stringSet)
+		}
+		implies[imp.Tag][imp.Implied] = struct{}{}
+		add = append(add, imp)
+	}
+	return remove, add, nil
+}
+
+// moveImplications rewrites the implications of and on from to refer to to
+// instead. Any that would then be a cycle are dropped.
+func (db *imageDB) moveImplications(from, to string) error {
+	remove, add, err := db.planImplicationMove(from, to)
+	if err != nil {
+		return err
+	}
+	for _, imp := range remove {
+		if err := db.store.RemoveImplication(imp.Tag, imp.Implied); err != nil {
+			return err
+		}
+	}
+	for _, imp := range add {
+		if err := db.store.AddImplication(imp.Tag, imp.Implied); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeAlias deletes an alias. Images retagged when it was added keep their
+// new tag.
+func (db *imageDB) removeAlias(alias string) error {
+	if _, ok, err := db.store.Alias(alias); err != nil {
+		return err
+	} else if !ok {
+		return errAliasNotExists
+	}
+	return db.store.RemoveAlias(alias)
+}
+
+// An aliasEntry is an alias and the tag it stands for.
+type aliasEntry struct {
+	Alias, Tag string
+}
+
+var adminAliasesTemplate = template.Must(template.New("adminAliases").Parse(`
+<!DOCTYPE html>
+<html>
+	<head>
+		<title>Dispel - Admin Aliases</title>
+		<link rel="stylesheet" href="/static/css/milligram.min.css">
+		<link rel="stylesheet" href="/static/css/images.css">
+	</head>
+	<body>
+		<header>
+			<a href="/images">Dispel</a>
+			|
+			<a href="/admin/queue">Queue</a>
+			|
+			<a href="/admin/tags">Tags</a>
+			|
+			<a href="/admin/implications">Implications</a>
+			|
+			<a href="/admin/audit">Audit</a>
+		</header>
+		<div class="content">
+			<form class="tag-edit" action="/admin/aliases" method="post">
+				<input type="text" name="alias" placeholder="Alias" />
+				<input type="text" name="tag" placeholder="Tag" />
+				<input type="submit" value="Add alias" />
+			</form>
+			{{ range . }}
+				<form class="tag-edit" action="/admin/aliases/{{ .Alias }}/delete" method="post">
+					<span class="tag">{{ .Alias }}</span>
+					<span class="tag"><a href="/images?t={{ .Tag }}">{{ .Tag }}</a></span>
+					<input type="submit" value="Delete" />
+				</form>
+			{{ else }}
+				<span>No aliases!</span><br/><br/>
+			{{ end }}
+		</div>
+		<footer></footer>
+	</body>
+</html>
+`))
+
+// adminAliasesHandler lists every alias, with forms to add and delete them.
+func (db *imageDB) adminAliasesHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var aliases []aliasEntry
+	db.mu.RLock()
+	err := db.store.ForEachAlias(func(alias, tag string) error {
+		aliases = append(aliases, aliasEntry{alias, tag})
+		return nil
+	})
+	db.mu.RUnlock()
+	if err != nil {
+		http.Error(w, "failed to load aliases: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(aliases, func(i, j int) bool { return aliases[i].Alias < aliases[j].Alias })
+	adminAliasesTemplate.Execute(w, aliases)
+}
+
+// adminAliasesHandlerPOST adds an alias, retagging any images tagged with it.
+func (db *imageDB) adminAliasesHandlerPOST(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	alias := strings.ToLower(strings.TrimSpace(req.FormValue("alias")))
+	tag := strings.ToLower(strings.TrimSpace(req.FormValue("tag")))
+	db.mu.Lock()
+	_, err := db.addAlias(alias, tag)
+	db.mu.Unlock()
+	if err == errBadTagName || err == errAliasSelf || err == errAliasExists {
+		http.Error(w, "failed to add alias: "+err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "failed to add alias: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/admin/aliases", http.StatusSeeOther)
+}
+
+// adminAliasDeleteHandlerPOST deletes an alias.
+func (db *imageDB) adminAliasDeleteHandlerPOST(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	db.mu.Lock()
+	err := db.removeAlias(ps.ByName("alias"))
+	db.mu.Unlock()
+	if err == errAliasNotExists {
+		http.Error(w, "failed to delete alias: "+err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "failed to delete alias: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/admin/aliases", http.StatusSeeOther)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// writeJSON writes v to w as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write JSON response: %v", err)
+	}
+}
+
+// apiSearchHandler returns the images matching the query t, which has the
+// same syntax and parameters as on /images, as a JSON array. Results are
+// only paged if page or size is given; the X-Total-Count header holds the
+// number of results on every page.
+func (db *imageDB) apiSearchHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	q, err := parseSearchRequest(req)
+	if err != nil {
+		http.Error(w, "invalid search: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := parsePage(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	db.mu.RLock()
+	imgs, err := db.search(q)
+	db.mu.RUnlock()
+	if err != nil {
+		http.Error(w, "lookup failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Total-Count", fmt.Sprint(len(imgs)))
+	if req.FormValue("page") != "" || req.FormValue("size") != "" {
+		imgs = page.slice(imgs)
+	}
+	if imgs == nil {
+		imgs = []imageEntry{}
+	}
+	writeJSON(w, imgs)
+}
+
+// apiImageHandler returns a single image, including its metadata, as JSON.
+// Images may be requested by their MD5 hash.
+func (db *imageDB) apiImageHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	db.mu.RLock()
+	entry, ok, err := db.findImage(ps.ByName("img"))
+	db.mu.RUnlock()
+	if err != nil {
+		http.Error(w, "lookup failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	writeJSON(w, entry)
+}
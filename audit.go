@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// queueActions are the actions a queue item may have, in the order they are
+// offered when filtering the audit log.
+var queueActions = []string{actionUpload, actionSetTags, actionDelete, actionSetPool}
+
+// queueDiff returns what approving item would change: the tags added and
+// removed, or for pools, the pages, numbered so that reordering shows up.
+func (db *imageDB) queueDiff(item queueItem) (added, removed []string, err error) {
+	switch item.Action {
+	case actionUpload:
+		added = fromStringSet(item.Tags)
+	case actionSetTags:
+		cur, _, err := db.findImage(item.Hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		added, removed = cur.Tags.diff(item.Tags)
+	case actionDelete:
+		cur, _, err := db.findImage(item.Hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		removed = fromStringSet(cur.Tags)
+	case actionSetPool:
+		old, _, err := db.store.Pool(item.Pool.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		added, removed = poolPageSet(old).diff(poolPageSet(*item.Pool))
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed, nil
+}
+
+// poolPageSet returns the pages of pool as a set of "number:hash" strings.
+func poolPageSet(pool poolEntry) stringSet {
+	set := make(stringSet, len(pool.Pages))
+	for i, page := range pool.Pages {
+		set[fmt.Sprintf("%d:%s", i+1, page.Hash)] = struct{}{}
+	}
+	return set
+}
+
+// newAuditEntry returns the audit log entry for a decision on item, made
+// from admin. It must be called before the decision is carried out, while
+// the diff can still be computed.
+func (db *imageDB) newAuditEntry(item queueItem, approved bool, admin string) (auditEntry, error) {
+	added, removed, err := db.queueDiff(item)
+	if err != nil {
+		return auditEntry{}, err
+	}
+	e := auditEntry{
+		Date:      time.Now(),
+		Action:    item.Action,
+		Hash:      item.Hash,
+		Approved:  approved,
+		Admin:     admin,
+		Submitter: item.Submitter,
+		Added:     added,
+		Removed:   removed,
+	}
+	if item.Pool != nil {
+		e.Pool = item.Pool.Name
+	}
+	return e, nil
+}
+
+// An auditFilter selects entries from the audit log.
+type auditFilter struct {
+	Action   string
+	From, To string // as accepted by parseDateRange
+	dates    dateRange
+}
+
+// parseAuditFilter parses the action, from and to parameters of req. from
+// and to are inclusive, and may name a year, month or day.
+func parseAuditFilter(req *http.Request) (auditFilter, error) {
+	f := auditFilter{
+		Action: req.FormValue("action"),
+		From:   req.FormValue("from"),
+		To:     req.FormValue("to"),
+	}
+	if f.Action != "" {
+		var ok bool
+		for _, a := range queueActions {
+			ok = ok || a == f.Action
+		}
+		if !ok {
+			return auditFilter{}, fmt.Errorf("unknown action %q", f.Action)
+		}
+	}
+	if f.From != "" {
+		r, err := parseDateRange(">=" + f.From)
+		if err != nil {
+			return auditFilter{}, err
+		}
+		f.dates.from = r.from
+	}
+	if f.To != "" {
+		r, err := parseDateRange("<=" + f.To)
+		if err != nil {
+			return auditFilter{}, err
+		}
+		f.dates.to = r.to
+	}
+	return f, nil
+}
+
+// match reports whether e is selected by f.
+func (f auditFilter) match(e auditEntry) bool {
+	return (f.Action == "" || e.Action == f.Action) && f.dates.contains(e.Date)
+}
+
+// auditLog returns the entries of the audit log selected by f, oldest first.
+func (db *imageDB) auditLog(f auditFilter) ([]auditEntry, error) {
+	var entries []auditEntry
+	err := db.store.ForEachAudit(func(e auditEntry) error {
+		if f.match(e) {
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+var adminAuditTemplate = template.Must(template.New("adminAudit").Parse(`
+<!DOCTYPE html>
+<html>
+	<head>
+		<title>Dispel - Admin Audit Log</title>
+		<link rel="stylesheet" href="/static/css/milligram.min.css">
+		<link rel="stylesheet" href="/static/css/images.css">
+	</head>
+	<body>
+		<header>
+			<a href="/images">Dispel</a>
+			|
+			<a href="/admin/queue">Queue</a>
+			|
+			<a href="/admin/tags">Tags</a>
+			|
+			<a href="/admin/aliases">Aliases</a>
+			|
+			<a href="/admin/implications">Implications</a>
+			|
+			<a href="/admin/trash">Trash</a>
+		</header>
+		<div class="content">
+			<form class="tag-edit" action="/admin/audit" method="get">
+				<select name="action">
+					<option value="">all actions</option>
+					{{ range .Actions }}<option{{ if eq . $.Filter.Action }} selected{{ end }}>{{ . }}</option>{{ end }}
+				</select>
+				<input type="text" name="from" placeholder="From (YYYY-MM-DD)" value="{{ .Filter.From }}" />
+				<input type="text" name="to" placeholder="To (YYYY-MM-DD)" value="{{ .Filter.To }}" />
+				<input type="submit" value="Filter" />
+				<input type="submit" value="Export JSONL" formaction="/admin/audit.jsonl" />
+			</form>
+			<table>
+				<thead>
+					<tr><th>Date</th><th>Action</th><th>Item</th><th>Decision</th><th>Admin</th><th>Submitter</th><th>Changes</th></tr>
+				</thead>
+				<tbody>
+				{{ range .Entries }}
+					<tr>
+						<td>{{ .Date.Local.Format "Jan 2, 2006 15:04 MST" }}</td>
+						<td>{{ .Action }}</td>
+						<td>{{ if .Pool }}<a href="/pools/{{ .Pool }}">{{ .Pool }}</a>{{ else }}<a href="/images/show/{{ .Hash }}">{{ printf "%.12s" .Hash }}</a>{{ end }}</td>
+						<td>{{ if .Approved }}approved{{ else }}denied{{ end }}</td>
+						<td>{{ .Admin }}</td>
+						<td>{{ .Submitter }}</td>
+						<td>
+							<span style="color: green">{{ range .Added }}+{{ . }} {{ end }}</span>
+							<span style="color: red">{{ range .Removed }}-{{ . }} {{ end }}</span>
+						</td>
+					</tr>
+				{{ else }}
+					<tr><td colspan="7">No decisions!</td></tr>
+				{{ end }}
+				</tbody>
+			</table>
+		</div>
+		<footer></footer>
+	</body>
+</html>
+`))
+
+// adminAuditHandler lists moderation decisions, newest first, optionally
+// filtered by action and date.
+func (db *imageDB) adminAuditHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	f, err := parseAuditFilter(req)
+	if err != nil {
+		http.Error(w, "invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	db.mu.RLock()
+	entries, err := db.auditLog(f)
+	db.mu.RUnlock()
+	if err != nil {
+		http.Error(w, "failed to load audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	adminAuditTemplate.Execute(w, struct {
+		Entries []auditEntry
+		Filter  auditFilter
+		Actions []string
+	}{entries, f, queueActions})
+}
+
+// adminAuditExportHandler writes the audit log, filtered as on the audit
+// page, as JSON Lines, oldest first.
+func (db *imageDB) adminAuditExportHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	f, err := parseAuditFilter(req)
+	if err != nil {
+		http.Error(w, "invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	db.mu.RLock()
+	entries, err := db.auditLog(f)
+	db.mu.RUnlock()
+	if err != nil {
+		http.Error(w, "failed to load audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// archiveDBName is the name of the database snapshot within an archive.
+const archiveDBName = "imagedb.json"
+
+var (
+	errDirNotEmpty    = errors.New("restore target is not empty")
+	errBadArchivePath = errors.New("archive contains an invalid path")
+)
+
+// exportSnapshot encodes the contents of st in the jsonStore snapshot format,
+// regardless of which backend st is.
+func exportSnapshot(st Store) ([]byte, error) {
+	js := &jsonStore{
+		Tags:       make(map[string]tagEntry),
+		TagMeta:    make(map[string]tagInfo),
+		Images:     make(map[string]imageEntry),
+		Aliases:    make(map[string]string),
+		Implies:    make(map[string]stringSet),
+		Pools:      make(map[string]poolEntry),
+		History:    make(map[string][]revision),
+		Trashed:    make(map[string]trashEntry),
+		ViewCounts: make(map[string]int),
+		md5Index:   make(map[string]string),
+		childIndex: make(map[string]stringSet),
+		Version:    schemaVersion,
+	}
+	err := st.ForEachImage(func(entry imageEntry) error {
+		js.insertImage(entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = st.ForEachTag(func(tag tagEntry) error {
+		if tag.info() != (tagInfo{}) {
+			js.TagMeta[tag.Name] = tag.info()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = st.ForEachAlias(func(alias, tag string) error {
+		js.Aliases[alias] = tag
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = st.ForEachImplication(func(tag, implied string) error {
+		return js.apply(journalOp{Op: opAddImplication, Tag: tag, Implied: implied})
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = st.ForEachPool(func(pool poolEntry) error {
+		js.Pools[pool.Name] = pool
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = st.ForEachRevision(func(rev revision) error {
+		return js.apply(journalOp{Op: opAddRevision, Revision: &rev})
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = st.ForEachTrash(func(e trashEntry) error {
+		js.Trashed[e.Hash] = e
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = st.ForEachViews(func(hash string, n int) error {
+		js.ViewCounts[hash] = n
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = st.ForEachAudit(func(e auditEntry) error {
+		js.Audit = append(js.Audit, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if js.Queue, err = st.QueueItems(); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(js, "", "\t")
+}
+
+// writeArchive writes a tar archive of the database and of every blob to w.
+// The database is read-locked for the duration, so the archive is a
+// consistent snapshot.
+func (db *imageDB) writeArchive(w io.Writer, compress bool) error {
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	b, err := exportSnapshot(db.store)
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    archiveDBName,
+		Mode:    0600,
+		Size:    int64(len(b)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return err
+	}
+
+	for _, v := range blobVariants {
+		err := db.blobs.Walk(v, func(hash, ext string) error {
+			return writeArchiveBlob(tw, db.blobs, v, hash, ext)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gz != nil {
+		return gz.Close()
+	}
+	return nil
+}
+
+// writeArchiveBlob copies a single blob into tw.
+func writeArchiveBlob(tw *tar.Writer, bs BlobStore, v blobVariant, hash, ext string) error {
+	info, err := bs.Stat(v, hash, ext)
+	if err != nil {
+		return err
+	}
+	r, err := bs.Get(v, hash, ext)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	err = tw.WriteHeader(&tar.Header{
+		Name:    v.path(hash, ext),
+		Mode:    0600,
+		Size:    info.Size,
+		ModTime: info.ModTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, r)
+	return err
+}
+
+// archiveTarget returns the path within dir that the archive entry name
+// should be extracted to. Only the database and files within the blob
+// directories are permitted.
+func archiveTarget(dir, name string) (string, error) {
+	name = path.Clean(name)
+	ok := name == archiveDBName
+	for _, v := range blobVariants {
+		ok = ok || strings.HasPrefix(name, v.dir+"/")
+	}
+	if !ok || strings.Contains(name, "..") {
+		return "", errBadArchivePath
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
+}
+
+// restoreArchive extracts an archive written by writeArchive into dir, which
+// must be empty or nonexistent. Blobs are laid out as a localBlobStore rooted
+// at dir would expect. Gzipped archives are detected automatically.
+func restoreArchive(r io.Reader, dir string) error {
+	if fis, err := ioutil.ReadDir(dir); err == nil && len(fis) != 0 {
+		return errDirNotEmpty
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	r = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		target, err := archiveTarget(dir, hdr.Name)
+		if err != nil {
+			return fmt.Errorf("%v: %v", err, hdr.Name)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// adminBackupHandler streams an archive of the entire instance. Pass
+// gzip=true to compress it.
+func (db *imageDB) adminBackupHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	compress := req.FormValue("gzip") == "true"
+	name := "dispel-" + time.Now().Format("20060102-150405") + ".tar"
+	if compress {
+		name += ".gz"
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	// once the body has started, errors can only be logged
+	if err := db.writeArchive(w, compress); err != nil {
+		log.Printf("Backup for %v failed: %v", req.RemoteAddr, err)
+		return
+	}
+	log.Printf("Backup downloaded by %v", req.RemoteAddr)
+}
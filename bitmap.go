@@ -0,0 +1,381 @@
+package main
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// arrayMax is the most values a bitmap container holds as a sorted array;
+// larger containers switch to a bitset, which is then smaller.
+const arrayMax = 4096
+
+// A bitmap is a compressed set of uint32s, in the style of a roaring bitmap.
+// Values are grouped into containers by their high 16 bits, and each
+// container holds the low 16 bits of its values either as a sorted array,
+// while sparse, or as a 65536-bit bitset, once dense. Set operations work
+// container by container, so they cost far less than operations on the
+// equivalent maps.
+type bitmap struct {
+	keys       []uint16 // high bits of each container, sorted
+	containers []*container
+}
+
+// A container holds the values of a bitmap that share their high 16 bits.
+// Exactly one of array and set is used.
+type container struct {
+	array []uint16
+	set   []uint64 // 1024 words, when not nil
+	n     int
+}
+
+func newBitset() []uint64 { return make([]uint64, 1<<16/64) }
+
+// normalize switches c to whichever representation suits its size.
+func (c *container) normalize() {
+	if c.set == nil && c.n > arrayMax {
+		c.set = newBitset()
+		for _, v := range c.array {
+			c.set[v/64] |= 1 << (v % 64)
+		}
+		c.array = nil
+	} else if c.set != nil && c.n <= arrayMax {
+		c.array = make([]uint16, 0, c.n)
+		c.forEach(func(v uint16) { c.array = append(c.array, v) })
+		c.set = nil
+	}
+}
+
+func (c *container) contains(v uint16) bool {
+	if c.set != nil {
+		return c.set[v/64]&(1<<(v%64)) != 0
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= v })
+	return i < len(c.array) && c.array[i] == v
+}
+
+func (c *container) add(v uint16) {
+	if c.set != nil {
+		if c.set[v/64]&(1<<(v%64)) == 0 {
+			c.set[v/64] |= 1 << (v % 64)
+			c.n++
+		}
+		return
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= v })
+	if i < len(c.array) && c.array[i] == v {
+		return
+	}
+	c.array = append(c.array, 0)
+	copy(c.array[i+1:], c.array[i:])
+	c.array[i] = v
+	c.n++
+	c.normalize()
+}
+
+func (c *container) remove(v uint16) {
+	if c.set != nil {
+		if c.set[v/64]&(1<<(v%64)) != 0 {
+			c.set[v/64] &^= 1 << (v % 64)
+			c.n--
+			c.normalize()
+		}
+		return
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= v })
+	if i < len(c.array) && c.array[i] == v {
+		c.array = append(c.array[:i], c.array[i+1:]...)
+		c.n--
+	}
+}
+
+func (c *container) forEach(fn func(uint16)) {
+	if c.set == nil {
+		for _, v := range c.array {
+			fn(v)
+		}
+		return
+	}
+	for i, w := range c.set {
+		for w != 0 {
+			fn(uint16(i*64 + bits.TrailingZeros64(w)))
+			w &= w - 1
+		}
+	}
+}
+
+// and returns the intersection of c and d, or nil if it is empty.
+func (c *container) and(d *container) *container {
+	if c.set == nil && d.set != nil {
+		c, d = d, c
+	}
+	r := new(container)
+	switch {
+	case c.set != nil && d.set != nil:
+		r.set = newBitset()
+		for i := range r.set {
+			r.set[i] = c.set[i] & d.set[i]
+			r.n += bits.OnesCount64(r.set[i])
+		}
+	case c.set != nil:
+		for _, v := range d.array {
+			if c.contains(v) {
+				r.array = append(r.array, v)
+			}
+		}
+		r.n = len(r.array)
+	default:
+		for i, j := 0, 0; i < len(c.array) && j < len(d.array); {
+			switch {
+			case c.array[i] < d.array[j]:
+				i++
+			case c.array[i] > d.array[j]:
+				j++
+			default:
+				r.array = append(r.array, c.array[i])
+				i++
+				j++
+			}
+		}
+		r.n = len(r.array)
+	}
+	if r.n == 0 {
+		return nil
+	}
+	r.normalize()
+	return r
+}
+
+// andNot returns the values of c that are not in d, or nil if there are
+// none.
+func (c *container) andNot(d *container) *container {
+	r := new(container)
+	if c.set != nil {
+		r.set = append([]uint64(nil), c.set...)
+		if d.set != nil {
+			for i := range r.set {
+				r.set[i] &^= d.set[i]
+			}
+		} else {
+			for _, v := range d.array {
+				r.set[v/64] &^= 1 << (v % 64)
+			}
+		}
+		for _, w := range r.set {
+			r.n += bits.OnesCount64(w)
+		}
+	} else {
+		for _, v := range c.array {
+			if !d.contains(v) {
+				r.array = append(r.array, v)
+			}
+		}
+		r.n = len(r.array)
+	}
+	if r.n == 0 {
+		return nil
+	}
+	r.normalize()
+	return r
+}
+
+// clone returns a copy of c.
+func (c *container) clone() *container {
+	return &container{
+		array: append([]uint16(nil), c.array...),
+		set:   append([]uint64(nil), c.set...),
+		n:     c.n,
+	}
+}
+
+// find returns the index of the container with high bits key, and whether
+// it exists; if not, the index is where it would be inserted.
+func (b *bitmap) find(key uint16) (int, bool) {
+	i := sort.Search(len(b.keys), func(i int) bool { return b.keys[i] >= key })
+	return i, i < len(b.keys) && b.keys[i] == key
+}
+
+// Contains reports whether x is in b.
+func (b *bitmap) Contains(x uint32) bool {
+	i, ok := b.find(uint16(x >> 16))
+	return ok && b.containers[i].contains(uint16(x))
+}
+
+// Add adds x to b.
+func (b *bitmap) Add(x uint32) {
+	i, ok := b.find(uint16(x >> 16))
+	if !ok {
+		b.keys = append(b.keys, 0)
+		copy(b.keys[i+1:], b.keys[i:])
+		b.keys[i] = uint16(x >> 16)
+		b.containers = append(b.containers, nil)
+		copy(b.containers[i+1:], b.containers[i:])
+		b.containers[i] = new(container)
+	}
+	b.containers[i].add(uint16(x))
+}
+
+// Remove removes x from b.
+func (b *bitmap) Remove(x uint32) {
+	i, ok := b.find(uint16(x >> 16))
+	if !ok {
+		return
+	}
+	b.containers[i].remove(uint16(x))
+	if b.containers[i].n == 0 {
+		b.keys = append(b.keys[:i], b.keys[i+1:]...)
+		b.containers = append(b.containers[:i], b.containers[i+1:]...)
+	}
+}
+
+// Len returns the number of values in b.
+func (b *bitmap) Len() int {
+	n := 0
+	for _, c := range b.containers {
+		n += c.n
+	}
+	return n
+}
+
+// ForEach calls fn on each value in b, in increasing order.
+func (b *bitmap) ForEach(fn func(uint32)) {
+	for i, c := range b.containers {
+		high := uint32(b.keys[i]) << 16
+		c.forEach(func(v uint16) { fn(high | uint32(v)) })
+	}
+}
+
+// And returns the values in both b and o.
+func (b *bitmap) And(o *bitmap) *bitmap {
+	r := new(bitmap)
+	for i, j := 0, 0; i < len(b.keys) && j < len(o.keys); {
+		switch {
+		case b.keys[i] < o.keys[j]:
+			i++
+		case b.keys[i] > o.keys[j]:
+			j++
+		default:
+			if c := b.containers[i].and(o.containers[j]); c != nil {
+				r.keys = append(r.keys, b.keys[i])
+				r.containers = append(r.containers, c)
+			}
+			i++
+			j++
+		}
+	}
+	return r
+}
+
+// AndNot returns the values in b that are not in o.
+func (b *bitmap) AndNot(o *bitmap) *bitmap {
+	r := new(bitmap)
+	for i, j := 0, 0; i < len(b.keys); {
+		if j < len(o.keys) && o.keys[j] < b.keys[i] {
+			j++
+			continue
+		}
+		var c *container
+		if j < len(o.keys) && o.keys[j] == b.keys[i] {
+			c = b.containers[i].andNot(o.containers[j])
+		} else {
+			c = b.containers[i].clone()
+		}
+		if c != nil {
+			r.keys = append(r.keys, b.keys[i])
+			r.containers = append(r.containers, c)
+		}
+		i++
+	}
+	return r
+}
+
+// A bitmapIndex indexes the tags of a set of images as bitmaps, numbering
+// each image with a small integer ID. IDs of removed images are reused.
+type bitmapIndex struct {
+	ids    map[string]uint32 // image hash -> ID
+	hashes []string          // ID -> image hash
+	free   []uint32
+	all    *bitmap
+	tags   map[string]*bitmap
+}
+
+func newBitmapIndex() *bitmapIndex {
+	return &bitmapIndex{
+		ids:  make(map[string]uint32),
+		all:  new(bitmap),
+		tags: make(map[string]*bitmap),
+	}
+}
+
+// add indexes an image with the given tags.
+func (x *bitmapIndex) add(hash string, tags stringSet) {
+	id, ok := x.ids[hash]
+	if !ok {
+		if n := len(x.free); n > 0 {
+			id, x.free = x.free[n-1], x.free[:n-1]
+			x.hashes[id] = hash
+		} else {
+			id = uint32(len(x.hashes))
+			x.hashes = append(x.hashes, hash)
+		}
+		x.ids[hash] = id
+	}
+	x.all.Add(id)
+	for tag := range tags {
+		b, ok := x.tags[tag]
+		if !ok {
+			b = new(bitmap)
+			x.tags[tag] = b
+		}
+		b.Add(id)
+	}
+}
+
+// remove drops an image, which had the given tags, from the index.
+func (x *bitmapIndex) remove(hash string, tags stringSet) {
+	id, ok := x.ids[hash]
+	if !ok {
+		return
+	}
+	for tag := range tags {
+		if b, ok := x.tags[tag]; ok {
+			b.Remove(id)
+			if b.Len() == 0 {
+				delete(x.tags, tag)
+			}
+		}
+	}
+	x.all.Remove(id)
+	delete(x.ids, hash)
+	x.hashes[id] = ""
+	x.free = append(x.free, id)
+}
+
+// lookup returns the hashes of the images with all of include and none of
+// exclude. Tags are intersected smallest first, so that the intermediate
+// results stay small.
+func (x *bitmapIndex) lookup(include, exclude []string) []string {
+	sets := make([]*bitmap, 0, len(include))
+	for _, tag := range include {
+		b, ok := x.tags[tag]
+		if !ok {
+			return nil
+		}
+		sets = append(sets, b)
+	}
+	sort.Slice(sets, func(i, j int) bool { return sets[i].Len() < sets[j].Len() })
+	result := x.all
+	if len(sets) > 0 {
+		result = sets[0]
+		for _, b := range sets[1:] {
+			result = result.And(b)
+		}
+	}
+	for _, tag := range exclude {
+		if b, ok := x.tags[tag]; ok {
+			result = result.AndNot(b)
+		}
+	}
+	hashes := make([]string, 0, result.Len())
+	result.ForEach(func(id uint32) { hashes = append(hashes, x.hashes[id]) })
+	return hashes
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// bitmapValues returns the values in b, in order.
+func bitmapValues(b *bitmap) []uint32 {
+	var vs []uint32
+	b.ForEach(func(v uint32) { vs = append(vs, v) })
+	return vs
+}
+
+// setValues returns the values in m, in order.
+func setValues(m map[uint32]bool) []uint32 {
+	var vs []uint32
+	for v, ok := range m {
+		if ok {
+			vs = append(vs, v)
+		}
+	}
+	sort.Slice(vs, func(i, j int) bool { return vs[i] < vs[j] })
+	return vs
+}
+
+func TestBitmap(t *testing.T) {
+	assert := assert.New(t)
+	rng := rand.New(rand.NewSource(0))
+
+	// values are drawn from a few containers, some dense enough to be stored
+	// as bitsets and some sparse enough to be stored as arrays
+	random := func(n int, max uint32) (*bitmap, map[uint32]bool) {
+		b, m := new(bitmap), make(map[uint32]bool)
+		for i := 0; i < n; i++ {
+			v := uint32(rng.Int63n(int64(max)))
+			b.Add(v)
+			m[v] = true
+		}
+		return b, m
+	}
+	a, am := random(20000, 3<<16)
+	b, bm := random(5000, 4<<16)
+	assert.Equal(setValues(am), bitmapValues(a))
+	assert.Equal(len(setValues(am)), a.Len())
+
+	and, andNot := make(map[uint32]bool), make(map[uint32]bool)
+	for v := range am {
+		and[v] = bm[v]
+		andNot[v] = !bm[v]
+	}
+	assert.Equal(setValues(and), bitmapValues(a.And(b)))
+	assert.Equal(setValues(and), bitmapValues(b.And(a)))
+	assert.Equal(setValues(andNot), bitmapValues(a.AndNot(b)))
+	assert.Empty(bitmapValues(a.AndNot(a)))
+
+	// removing values shrinks bitsets back into arrays, and drops empty
+	// containers
+	for v := range am {
+		if v%4 != 0 {
+			a.Remove(v)
+			delete(am, v)
+		}
+	}
+	assert.Equal(setValues(am), bitmapValues(a))
+	for _, c := range a.containers {
+		assert.Nil(c.set)
+	}
+	for v := range am {
+		assert.True(a.Contains(v))
+		a.Remove(v)
+	}
+	assert.Zero(a.Len())
+	assert.Empty(a.containers)
+}
+
+func TestBitmapIndex(t *testing.T) {
+	assert := assert.New(t)
+	x := newBitmapIndex()
+	x.add("foo", toStringSet([]string{"bar", "baz"}))
+	x.add("qux", toStringSet([]string{"bar"}))
+	x.add("quux", nil)
+
+	assert.Equal([]string{"foo", "qux"}, x.lookup([]string{"bar"}, nil))
+	assert.Equal([]string{"foo"}, x.lookup([]string{"baz", "bar"}, nil))
+	assert.Equal([]string{"qux"}, x.lookup([]string{"bar"}, []string{"baz"}))
+	assert.Equal([]string{"qux", "quux"}, x.lookup(nil, []string{"baz"}))
+	assert.Empty(x.lookup([]string{"bar", "nope"}, nil))
+
+	// IDs are reused
+	x.remove("foo", toStringSet([]string{"bar", "baz"}))
+	assert.Equal([]string{"qux"}, x.lookup([]string{"bar"}, nil))
+	assert.Empty(x.lookup([]string{"baz"}, nil))
+	x.add("new", toStringSet([]string{"baz"}))
+	assert.Equal([]string{"new", "qux", "quux"}, x.lookup(nil, nil))
+}
+
+// benchImages returns n images tagged so that every image is "common",
+// half are "even", a third are "three", and one in a thousand is "rare".
+func benchImages(n int) []imageEntry {
+	imgs := make([]imageEntry, n)
+	for i := range imgs {
+		tags := []string{"common"}
+		if i%2 == 0 {
+			tags = append(tags, "even")
+		}
+		if i%3 == 0 {
+			tags = append(tags, "three")
+		}
+		if i%1000 == 0 {
+			tags = append(tags, "rare")
+		}
+		imgs[i] = testEntry(fmt.Sprintf("%08x", i), tags...)
+	}
+	return imgs
+}
+
+func BenchmarkLookupByTags(b *testing.B) {
+	imgs := benchImages(1e6)
+	queries := []struct {
+		name             string
+		include, exclude []string
+	}{
+		{"rare", []string{"common", "rare"}, nil},
+		{"intersect", []string{"even", "three"}, nil},
+		{"exclude", nil, []string{"even", "three"}},
+		{"mixed", []string{"common", "even"}, []string{"three"}},
+	}
+	for _, useBitmaps := range []bool{false, true} {
+		s := &jsonStore{
+			Images:     make(map[string]imageEntry, len(imgs)),
+			Tags:       make(map[string]tagEntry),
+			md5Index:   make(map[string]string),
+			childIndex: make(map[string]stringSet),
+		}
+		for _, img := range imgs {
+			s.insertImage(img)
+		}
+		if useBitmaps {
+			s.indexBitmaps()
+		}
+		for _, q := range queries {
+			b.Run(fmt.Sprintf("bitmaps=%v/%v", useBitmaps, q.name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					s.LookupByTags(q.include, q.exclude)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkBitmapIndex(b *testing.B) {
+	x := newBitmapIndex()
+	for _, img := range benchImages(1e6) {
+		x.add(img.Hash, img.Tags)
+	}
+	b.Run("intersect", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			x.tags["even"].And(x.tags["three"])
+		}
+	})
+	b.Run("exclude", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			x.all.AndNot(x.tags["even"]).AndNot(x.tags["three"])
+		}
+	})
+}
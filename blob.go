@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errBlobNotExists = errors.New("blob does not exist")
+
+// A blobVariant identifies one of the files kept for an image: the original,
+// its thumbnail, or either of those while the upload awaits approval or
+// while the image is in the trash. Each
+// variant has its own namespace, laid out as dir/<hash><suffix><ext>. Sharded
+// variants place each blob two levels down, keyed by the first four
+// characters of its hash, so that no directory grows too large.
+type blobVariant struct {
+	dir     string
+	suffix  string
+	sharded bool
+}
+
+var (
+	variantImage       = blobVariant{"static/images", "", true}
+	variantThumb       = blobVariant{"static/thumbnails", "", true}
+	variantQueued      = blobVariant{"queue", "", false}
+	variantQueuedThumb = blobVariant{"queue", "_thumb", false}
+	variantTrash       = blobVariant{"trash", "", true}
+	variantTrashThumb  = blobVariant{"trash", "_thumb", true}
+
+	blobVariants = []blobVariant{variantImage, variantThumb, variantQueued, variantQueuedThumb, variantTrash, variantTrashThumb}
+)
+
+// thumbExt is the extension of every thumbnail, which are always JPEGs.
+const thumbExt = ".jpg"
+
+// shardDir returns the shard directory of hash, e.g. "ab/cd" for "abcd...".
+// Hashes too short to shard are not sharded.
+func shardDir(hash string) string {
+	if len(hash) < 4 {
+		return ""
+	}
+	return hash[:2] + "/" + hash[2:4]
+}
+
+// flat returns the unsharded form of v, which is where blobs stored before
+// sharding was introduced are found.
+func (v blobVariant) flat() blobVariant {
+	v.sharded = false
+	return v
+}
+
+// path returns the slash-separated path of a blob, relative to the root of
+// its store.
+func (v blobVariant) path(hash, ext string) string {
+	name := hash + v.suffix + ext
+	if shard := shardDir(hash); v.sharded && shard != "" {
+		return v.dir + "/" + shard + "/" + name
+	}
+	return v.dir + "/" + name
+}
+
+// parse splits the path of a file relative to v.dir into its hash and
+// extension. It returns false if the file does not belong to v.
+func (v blobVariant) parse(name string) (hash, ext string, ok bool) {
+	dir, name := path.Split(name)
+	ext = path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for _, other := range blobVariants {
+		// a longer suffix in the same dir takes precedence
+		if other.dir == v.dir && len(other.suffix) > len(v.suffix) && strings.HasSuffix(base, other.suffix) {
+			return "", "", false
+		}
+	}
+	if !strings.HasSuffix(base, v.suffix) {
+		return "", "", false
+	}
+	hash = strings.TrimSuffix(base, v.suffix)
+	var want string
+	if v.sharded {
+		want = shardDir(hash)
+	}
+	return hash, ext, hash != "" && strings.TrimSuffix(dir, "/") == want
+}
+
+// A blobRef identifies a single blob.
+type blobRef struct {
+	v    blobVariant
+	hash string
+	ext  string
+}
+
+func (r blobRef) String() string { return r.v.path(r.hash, r.ext) }
+
+// blobInfo describes a stored blob.
+type blobInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// A BlobStore holds the image files of an imageDB, addressed by hash and
+// variant.
+type BlobStore interface {
+	// Put stores the contents of r, replacing any existing blob.
+	Put(v blobVariant, hash, ext string, r io.Reader) error
+	// Get opens a blob for reading.
+	Get(v blobVariant, hash, ext string) (io.ReadCloser, error)
+	// Delete removes a blob. Deleting a nonexistent blob is not an error.
+	Delete(v blobVariant, hash, ext string) error
+	// Exists reports whether a blob is present.
+	Exists(v blobVariant, hash, ext string) (bool, error)
+	// Stat returns the size and modification time of a blob.
+	Stat(v blobVariant, hash, ext string) (blobInfo, error)
+	// Walk calls fn on each blob of variant v, stopping at the first error.
+	Walk(v blobVariant, fn func(hash, ext string) error) error
+}
+
+// moveBlob moves a blob from one variant to another. Stores that can do so
+// cheaply are asked to rename it; otherwise it is copied and then deleted.
+func moveBlob(bs BlobStore, from, to blobVariant, hash, ext string) error {
+	if rn, ok := bs.(interface {
+		Rename(from, to blobVariant, hash, ext string) error
+	}); ok {
+		return rn.Rename(from, to, hash, ext)
+	}
+	return copyBlob(bs, from, to, hash, ext)
+}
+
+// copyBlob moves a blob by copying it and then deleting the original.
+func copyBlob(bs BlobStore, from, to blobVariant, hash, ext string) error {
+	r, err := bs.Get(from, hash, ext)
+	if err != nil {
+		return err
+	}
+	err = bs.Put(to, hash, ext, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	return bs.Delete(from, hash, ext)
+}
+
+// shardedBlobStore wraps a BlobStore so that blobs of sharded variants that
+// were stored before sharding was introduced, and so still sit flat in their
+// variant's directory, are found where they are. New blobs are always written
+// to their shard; reshard moves the old ones.
+type shardedBlobStore struct {
+	BlobStore
+}
+
+// unsharded reports whether the flat path of a blob differs from its
+// sharded one, i.e. whether it could be in the wrong place.
+func unsharded(v blobVariant, hash, ext string) bool {
+	return v.sharded && v.flat().path(hash, ext) != v.path(hash, ext)
+}
+
+// Get implements BlobStore.
+func (s shardedBlobStore) Get(v blobVariant, hash, ext string) (io.ReadCloser, error) {
+	r, err := s.BlobStore.Get(v, hash, ext)
+	if err == errBlobNotExists && unsharded(v, hash, ext) {
+		return s.BlobStore.Get(v.flat(), hash, ext)
+	}
+	return r, err
+}
+
+// Delete implements BlobStore.
+func (s shardedBlobStore) Delete(v blobVariant, hash, ext string) error {
+	if err := s.BlobStore.Delete(v, hash, ext); err != nil {
+		return err
+	} else if unsharded(v, hash, ext) {
+		return s.BlobStore.Delete(v.flat(), hash, ext)
+	}
+	return nil
+}
+
+// Exists implements BlobStore.
+func (s shardedBlobStore) Exists(v blobVariant, hash, ext string) (bool, error) {
+	_, err := s.Stat(v, hash, ext)
+	if err == errBlobNotExists {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Stat implements BlobStore.
+func (s shardedBlobStore) Stat(v blobVariant, hash, ext string) (blobInfo, error) {
+	info, err := s.BlobStore.Stat(v, hash, ext)
+	if err == errBlobNotExists && unsharded(v, hash, ext) {
+		return s.BlobStore.Stat(v.flat(), hash, ext)
+	}
+	return info, err
+}
+
+// Walk implements BlobStore. Blobs that have not yet been resharded are
+// included.
+func (s shardedBlobStore) Walk(v blobVariant, fn func(hash, ext string) error) error {
+	if err := s.BlobStore.Walk(v, fn); err != nil || !v.sharded {
+		return err
+	}
+	return s.BlobStore.Walk(v.flat(), func(hash, ext string) error {
+		if !unsharded(v, hash, ext) {
+			return nil // already visited
+		}
+		return fn(hash, ext)
+	})
+}
+
+// Rename moves a blob between variants, from wherever it currently is.
+func (s shardedBlobStore) Rename(from, to blobVariant, hash, ext string) error {
+	if unsharded(from, hash, ext) {
+		if _, err := s.BlobStore.Stat(from, hash, ext); err == errBlobNotExists {
+			from = from.flat()
+		} else if err != nil {
+			return err
+		}
+	}
+	return moveBlob(s.BlobStore, from, to, hash, ext)
+}
+
+// reshard moves every blob of a sharded variant that is still in the flat
+// layout into its shard, calling fn on each. If dryRun is set, fn is called
+// but nothing is moved.
+func (s shardedBlobStore) reshard(dryRun bool, fn func(blobRef)) error {
+	for _, v := range blobVariants {
+		if !v.sharded {
+			continue
+		}
+		// collect first, so that the walk doesn't see its own moves
+		var refs []blobRef
+		err := s.BlobStore.Walk(v.flat(), func(hash, ext string) error {
+			if unsharded(v, hash, ext) {
+				refs = append(refs, blobRef{v, hash, ext})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			fn(ref)
+			if dryRun {
+				continue
+			}
+			if err := moveBlob(s.BlobStore, v.flat(), v, ref.hash, ref.ext); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// serveBlob writes a blob to w.
+func serveBlob(w http.ResponseWriter, req *http.Request, bs BlobStore, v blobVariant, hash, ext string) {
+	r, err := bs.Get(v, hash, ext)
+	if err == errBlobNotExists {
+		http.NotFound(w, req)
+		return
+	} else if err != nil {
+		http.Error(w, "failed to load file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer r.Close()
+
+	// local files support range requests and conditional GETs
+	if rs, ok := r.(io.ReadSeeker); ok {
+		var modTime time.Time
+		if info, err := bs.Stat(v, hash, ext); err == nil {
+			modTime = info.ModTime
+		}
+		http.ServeContent(w, req, hash+ext, modTime, rs)
+		return
+	}
+	if ct := mime.TypeByExtension(ext); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	if sized, ok := r.(interface{ Size() int64 }); ok {
+		w.Header().Set("Content-Length", strconv.FormatInt(sized.Size(), 10))
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		log.Printf("Failed to serve %v: %v", v.path(hash, ext), err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// localBlobStore is a BlobStore backed by the local filesystem, using the
+// same directory layout that dispel has always used.
+type localBlobStore struct {
+	root string
+}
+
+func (s *localBlobStore) filePath(v blobVariant, hash, ext string) string {
+	return filepath.Join(s.root, filepath.FromSlash(v.path(hash, ext)))
+}
+
+// Put implements BlobStore.
+func (s *localBlobStore) Put(v blobVariant, hash, ext string, r io.Reader) error {
+	p := s.filePath(v, hash, ext)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), "put")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// Get implements BlobStore.
+func (s *localBlobStore) Get(v blobVariant, hash, ext string) (io.ReadCloser, error) {
+	f, err := os.Open(s.filePath(v, hash, ext))
+	if os.IsNotExist(err) {
+		return nil, errBlobNotExists
+	}
+	return f, err
+}
+
+// Delete implements BlobStore.
+func (s *localBlobStore) Delete(v blobVariant, hash, ext string) error {
+	err := os.Remove(s.filePath(v, hash, ext))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Exists implements BlobStore.
+func (s *localBlobStore) Exists(v blobVariant, hash, ext string) (bool, error) {
+	_, err := s.Stat(v, hash, ext)
+	if err == errBlobNotExists {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Stat implements BlobStore.
+func (s *localBlobStore) Stat(v blobVariant, hash, ext string) (blobInfo, error) {
+	info, err := os.Stat(s.filePath(v, hash, ext))
+	if os.IsNotExist(err) {
+		return blobInfo{}, errBlobNotExists
+	} else if err != nil {
+		return blobInfo{}, err
+	}
+	return blobInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Walk implements BlobStore.
+func (s *localBlobStore) Walk(v blobVariant, fn func(hash, ext string) error) error {
+	dir := filepath.Join(s.root, filepath.FromSlash(v.dir))
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() {
+			if p != dir && !v.sharded {
+				return filepath.SkipDir
+			}
+			return nil
+		} else if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if hash, ext, ok := v.parse(filepath.ToSlash(rel)); ok {
+			return fn(hash, ext)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Rename moves a blob between variants without copying it.
+func (s *localBlobStore) Rename(from, to blobVariant, hash, ext string) error {
+	dst := s.filePath(to, hash, ext)
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	return os.Rename(s.filePath(from, hash, ext), dst)
+}
+
+func newLocalBlobStore(root string) (*localBlobStore, error) {
+	s := &localBlobStore{root: root}
+	for _, v := range blobVariants {
+		if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(v.dir)), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3BlobStore is a BlobStore backed by an S3-compatible object store, such as
+// AWS S3 or MinIO. Objects are keyed by the same paths the local store uses,
+// so existing files can be uploaded with any S3 sync tool. Requests are
+// path-style and signed with AWS Signature Version 4.
+type s3BlobStore struct {
+	endpoint  string // e.g. http://localhost:9000
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// awsURIEncode escapes s as required by Signature Version 4: every byte
+// except unreserved characters is percent-encoded, and '/' is left alone
+// only if encodeSlash is false.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign adds Signature Version 4 authentication headers to req, whose body
+// hashes to payloadHash.
+func (s *s3BlobStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// canonical query string, sorted by key
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		awsURIEncode(req.URL.Path, false),
+		strings.Join(params, "&"),
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+sig)
+}
+
+// do performs a signed request against key (or the bucket itself, if key is
+// empty). Responses with unexpected status codes are converted to errors;
+// a 404 becomes errBlobNotExists.
+func (s *s3BlobStore) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u, err := url.Parse(s.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	s.sign(req, sha256Hex(body), time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errBlobNotExists
+	} else if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %v %v: %v: %s", method, key, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// Put implements BlobStore. The blob is buffered in memory, since the
+// request must be signed over a hash of its contents.
+func (s *s3BlobStore) Put(v blobVariant, hash, ext string, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do("PUT", v.path(hash, ext), nil, b)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// s3Object is the body of a GET response. It reports its size so that it can
+// be served with a Content-Length.
+type s3Object struct {
+	io.ReadCloser
+	size int64
+}
+
+func (o s3Object) Size() int64 { return o.size }
+
+// Get implements BlobStore.
+func (s *s3BlobStore) Get(v blobVariant, hash, ext string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", v.path(hash, ext), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s3Object{resp.Body, resp.ContentLength}, nil
+}
+
+// Delete implements BlobStore.
+func (s *s3BlobStore) Delete(v blobVariant, hash, ext string) error {
+	resp, err := s.do("DELETE", v.path(hash, ext), nil, nil)
+	if err == errBlobNotExists {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Exists implements BlobStore.
+func (s *s3BlobStore) Exists(v blobVariant, hash, ext string) (bool, error) {
+	_, err := s.Stat(v, hash, ext)
+	if err == errBlobNotExists {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Stat implements BlobStore.
+func (s *s3BlobStore) Stat(v blobVariant, hash, ext string) (blobInfo, error) {
+	resp, err := s.do("HEAD", v.path(hash, ext), nil, nil)
+	if err != nil {
+		return blobInfo{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return blobInfo{Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+// listBucketResult is the response to a ListObjectsV2 request.
+type listBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// Walk implements BlobStore.
+func (s *s3BlobStore) Walk(v blobVariant, fn func(hash, ext string) error) error {
+	prefix := v.dir + "/"
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+	}
+	if !v.sharded {
+		// skip the contents of shard directories
+		query.Set("delimiter", "/")
+	}
+	for {
+		resp, err := s.do("GET", "", query, nil)
+		if err != nil {
+			return err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, obj := range result.Contents {
+			if hash, ext, ok := v.parse(strings.TrimPrefix(obj.Key, prefix)); ok {
+				if err := fn(hash, ext); err != nil {
+					return err
+				}
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func newS3BlobStore(endpoint, bucket, region, accessKey, secretKey string) *s3BlobStore {
+	return &s3BlobStore{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}
+}
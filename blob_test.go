@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBlobStores returns one empty instance of each BlobStore implementation.
+// The S3 store is only tested if DISPEL_TEST_S3_ENDPOINT names a server (such
+// as a local MinIO) with an empty DISPEL_TEST_S3_BUCKET.
+func testBlobStores(t *testing.T) map[string]BlobStore {
+	dir, err := ioutil.TempDir("", "dispel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := newLocalBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]BlobStore{"local": ls}
+	if endpoint := os.Getenv("DISPEL_TEST_S3_ENDPOINT"); endpoint != "" {
+		stores["s3"] = newS3BlobStore(endpoint, os.Getenv("DISPEL_TEST_S3_BUCKET"), "us-east-1",
+			os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	}
+	return stores
+}
+
+func TestBlobStores(t *testing.T) {
+	for name, bs := range testBlobStores(t) {
+		t.Run(name, func(t *testing.T) {
+			assert, require := assert.New(t), require.New(t)
+
+			require.Nil(bs.Put(variantQueued, "foo", ".png", strings.NewReader("image")))
+			require.Nil(bs.Put(variantQueuedThumb, "foo", thumbExt, strings.NewReader("thumb")))
+
+			r, err := bs.Get(variantQueued, "foo", ".png")
+			require.Nil(err)
+			b, err := ioutil.ReadAll(r)
+			r.Close()
+			require.Nil(err)
+			assert.Equal("image", string(b))
+			info, err := bs.Stat(variantQueuedThumb, "foo", thumbExt)
+			require.Nil(err)
+			assert.EqualValues(5, info.Size)
+
+			// variants sharing a directory are kept apart
+			var walked []string
+			for _, v := range []blobVariant{variantQueued, variantQueuedThumb} {
+				require.Nil(bs.Walk(v, func(hash, ext string) error {
+					walked = append(walked, blobRef{v, hash, ext}.String())
+					return nil
+				}))
+			}
+			sort.Strings(walked)
+			assert.Equal([]string{"queue/foo.png", "queue/foo_thumb.jpg"}, walked)
+
+			require.Nil(moveBlob(bs, variantQueued, variantImage, "foo", ".png"))
+			ok, err := bs.Exists(variantQueued, "foo", ".png")
+			require.Nil(err)
+			assert.False(ok)
+			ok, err = bs.Exists(variantImage, "foo", ".png")
+			require.Nil(err)
+			assert.True(ok)
+
+			require.Nil(bs.Delete(variantImage, "foo", ".png"))
+			require.Nil(bs.Delete(variantImage, "foo", ".png"))
+			_, err = bs.Get(variantImage, "foo", ".png")
+			assert.Equal(errBlobNotExists, err)
+			require.Nil(bs.Delete(variantQueuedThumb, "foo", thumbExt))
+		})
+	}
+}
+
+func TestAWSURIEncode(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("static/images/a%20b.png", awsURIEncode("static/images/a b.png", false))
+	assert.Equal("a%2Fb~c", awsURIEncode("a/b~c", true))
+}
+
+func TestBlobVariantPath(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("static/images/ab/cd/abcdef.png", variantImage.path("abcdef", ".png"))
+	assert.Equal("queue/abcdef_thumb.jpg", variantQueuedThumb.path("abcdef", thumbExt))
+
+	hash, ext, ok := variantImage.parse("ab/cd/abcdef.png")
+	assert.True(ok)
+	assert.Equal("abcdef", hash)
+	assert.Equal(".png", ext)
+	_, _, ok = variantImage.parse("ab/ce/abcdef.png")
+	assert.False(ok)
+	_, _, ok = variantImage.parse("abcdef.png")
+	assert.False(ok)
+	_, _, ok = variantImage.flat().parse("abcdef.png")
+	assert.True(ok)
+}
+
+func TestReshard(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	dir, err := ioutil.TempDir("", "dispel")
+	require.Nil(err)
+	ls, err := newLocalBlobStore(dir)
+	require.Nil(err)
+	bs := shardedBlobStore{ls}
+
+	// one image in the old layout, one in the new
+	const old, cur = "0123456789", "abcdef0123"
+	require.Nil(ls.Put(variantImage.flat(), old, ".png", strings.NewReader("old")))
+	require.Nil(bs.Put(variantImage, cur, ".png", strings.NewReader("new")))
+	_, err = os.Stat(filepath.Join(dir, "static/images/ab/cd/abcdef0123.png"))
+	assert.Nil(err)
+
+	// both are visible through the wrapper
+	ok, err := bs.Exists(variantImage, old, ".png")
+	require.Nil(err)
+	assert.True(ok)
+	var walked []string
+	walk := func(hash, ext string) error {
+		walked = append(walked, hash)
+		return nil
+	}
+	require.Nil(bs.Walk(variantImage, walk))
+	sort.Strings(walked)
+	assert.Equal([]string{old, cur}, walked)
+
+	var moved []blobRef
+	require.Nil(bs.reshard(true, func(ref blobRef) { moved = append(moved, ref) }))
+	assert.Equal([]blobRef{{variantImage, old, ".png"}}, moved)
+	require.Nil(bs.reshard(false, func(blobRef) {}))
+	_, err = os.Stat(filepath.Join(dir, "static/images/01/23/0123456789.png"))
+	assert.Nil(err)
+	_, err = os.Stat(filepath.Join(dir, "static/images/0123456789.png"))
+	assert.True(os.IsNotExist(err))
+
+	walked = nil
+	require.Nil(bs.Walk(variantImage, walk))
+	sort.Strings(walked)
+	assert.Equal([]string{old, cur}, walked)
+}
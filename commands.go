@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var errUsage = errors.New(`usage: dispel [flags] <command> [args]
+
+commands:
+  import <imagedb.json>       copy a JSON database into the store selected by -store
+  migrate [-n] <imagedb.json> upgrade a JSON database to the current schema;
+                              with -n, only report what would change
+  backup [-z] <file>          archive the database and all stored files to
+                              file (- for stdout); with -z, gzip it
+  restore <archive> <dir>     extract an archive into an empty directory
+  check [-quick] [-repair]    report inconsistencies between the database and
+                              the files on disk; -quick skips re-hashing
+                              images, -repair rebuilds the tag index and
+                              quarantines orphaned files
+  reshard [-n]                move images and thumbnails stored in the old
+                              flat layout into hash-prefix directories; with
+                              -n, only list them`)
+
+// runCommand runs a maintenance command in place of the server.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "import":
+		if len(args) != 2 {
+			return errUsage
+		}
+		return importCommand(args[1])
+	case "migrate":
+		fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+		dryRun := fs.Bool("n", false, "report changes without writing them")
+		if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 1 {
+			return errUsage
+		}
+		return migrateCommand(fs.Arg(0), *dryRun)
+	case "backup":
+		fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+		compress := fs.Bool("z", false, "gzip the archive")
+		if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 1 {
+			return errUsage
+		}
+		return backupCommand(fs.Arg(0), *compress)
+	case "restore":
+		if len(args) != 3 {
+			return errUsage
+		}
+		return restoreCommand(args[1], args[2])
+	case "check":
+		fs := flag.NewFlagSet("check", flag.ContinueOnError)
+		quick := fs.Bool("quick", false, "skip re-hashing stored images")
+		repair := fs.Bool("repair", false, "fix what can be fixed")
+		if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 0 {
+			return errUsage
+		}
+		return checkCommand(!*quick, *repair)
+	case "reshard":
+		fs := flag.NewFlagSet("reshard", flag.ContinueOnError)
+		dryRun := fs.Bool("n", false, "list files without moving them")
+		if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 0 {
+			return errUsage
+		}
+		return reshardCommand(*dryRun)
+	default:
+		return fmt.Errorf("unknown command %q\n%v", args[0], errUsage)
+	}
+}
+
+// importCommand copies the JSON database at path into the configured store.
+// The source is only read, never modified.
+func importCommand(path string) error {
+	src, err := readJSONStore(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if err := copyStore(dst, src); err != nil {
+		return err
+	}
+	log.Printf("Imported %v images from %v", len(src.Images), path)
+	return nil
+}
+
+// migrateCommand reports the migrations needed to bring the JSON database at
+// path up to date, and performs them unless dryRun is set.
+func migrateCommand(path string, dryRun bool) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	doc, err := decodeJSONObject(b)
+	if err != nil {
+		return err
+	}
+	from, err := docVersion(doc)
+	if err != nil {
+		return err
+	}
+	if from == schemaVersion {
+		fmt.Printf("%v is already at schema version %v\n", path, schemaVersion)
+		return nil
+	}
+	journal, err := readJournalObjects(path + ".journal")
+	if err != nil {
+		return err
+	}
+	reports, err := migrateDB(doc, journal, from)
+	if err != nil {
+		return err
+	}
+	for _, r := range reports {
+		fmt.Println(r)
+	}
+	if dryRun {
+		fmt.Println("dry run; no changes written")
+		return nil
+	}
+	// loading the store performs the upgrade
+	s, err := newJSONStore(path)
+	if err != nil {
+		return err
+	}
+	return s.Close()
+}
+
+// readJournalObjects decodes each complete entry of the journal at path into
+// a generic object.
+func readJournalObjects(path string) ([]map[string]interface{}, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ops []map[string]interface{}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// any remainder is a torn write
+			return ops, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		op, err := decodeJSONObject(line)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+}
+
+// backupCommand writes an archive of the instance to path.
+func backupCommand(path string, compress bool) error {
+	st, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	blobs, err := openBlobStore()
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if path != "-" {
+		if w, err = os.Create(path); err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+	if err := newImageDB(st, blobs).writeArchive(w, compress); err != nil {
+		return err
+	}
+	return w.Sync()
+}
+
+// restoreCommand extracts the archive at path into dir. The archived
+// database is a JSON snapshot; if another store type is selected, it is
+// imported into a store of that type alongside it.
+func restoreCommand(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := restoreArchive(f, dir); err != nil {
+		return err
+	}
+	if *storeType == "json" {
+		log.Printf("Restored %v into %v", path, dir)
+		return nil
+	}
+
+	src, err := newJSONStore(filepath.Join(dir, archiveDBName))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dstPath := filepath.Join(dir, "imagedb."+*storeType)
+	dst, err := newStore(*storeType, dstPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if err := copyStore(dst, src); err != nil {
+		return err
+	}
+	log.Printf("Restored %v into %v, with the database imported into %v", path, dir, dstPath)
+	return nil
+}
+
+// checkCommand reports every inconsistency in the instance, optionally
+// repairing them.
+func checkCommand(rehash, repair bool) error {
+	st, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	blobs, err := openBlobStore()
+	if err != nil {
+		return err
+	}
+	db := newImageDB(st, blobs)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	r, err := db.check(rehash)
+	if err != nil {
+		return err
+	}
+	for _, p := range r.Problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("%v problems found\n", len(r.Problems))
+	if !repair || len(r.Problems) == 0 {
+		return nil
+	}
+	if err := db.repair(r); err != nil {
+		return err
+	}
+	if r.TagIndexBad {
+		fmt.Println("rebuilt tag index")
+	}
+	if len(r.Orphans) != 0 {
+		fmt.Printf("moved %v orphaned files to %v\n", len(r.Orphans), quarantineDir)
+	}
+	return nil
+}
+
+// reshardCommand moves every blob still in the flat layout into its shard.
+// The server can keep running meanwhile, since blobs are found in either
+// layout.
+func reshardCommand(dryRun bool) error {
+	blobs, err := openBlobStore()
+	if err != nil {
+		return err
+	}
+	var n int
+	err = blobs.reshard(dryRun, func(ref blobRef) {
+		fmt.Println(ref.v.flat().path(ref.hash, ref.ext), "->", ref)
+		n++
+	})
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		fmt.Printf("%v files to move; dry run, nothing moved\n", n)
+	} else {
+		fmt.Printf("%v files moved\n", n)
+	}
+	return nil
+}
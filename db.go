@@ -1,55 +1,135 @@
 package main
 
 import (
+	"crypto/md5"
 	"encoding/json"
 	"errors"
-	"io"
-	"os"
 	"sync"
+	"time"
 )
 
 const (
 	actionUpload  = "upload"
 	actionSetTags = "set tags"
 	actionDelete  = "delete"
+	actionSetPool = "set pool"
 )
 
 var (
 	errImageExists    = errors.New("image already exists")
 	errImageNotExists = errors.New("image does not exist")
+	errBadQueueIndex  = errors.New("invalid queue index")
 )
 
 type (
 	stringSet map[string]struct{}
 
+	// A tag exists while any image has it, or while it has a category or
+	// description. Count is the number of images with the tag; stores keep
+	// it so that it can be read without loading Images.
 	tagEntry struct {
-		Name   string
-		Images stringSet
+		Name        string
+		Category    string `json:",omitempty"`
+		Description string `json:",omitempty"`
+		Count       int    `json:"-"`
+		Images      stringSet
 	}
 
+	// tagInfo is the metadata of a tag, as opposed to its images.
+	tagInfo struct {
+		Category    string `json:",omitempty"`
+		Description string `json:",omitempty"`
+	}
+
+	// Images are keyed by the hex SHA-256 hash of their contents. Images
+	// added before SHA-256 was adopted were keyed by MD5 instead, until
+	// migrateHashes rekeys them; MD5 records the old key for lookups.
 	imageEntry struct {
 		Hash      string
+		MD5       string `json:",omitempty"`
 		Ext       string
-		DateAdded string
+		DateAdded time.Time
 		Tags      stringSet
+		// Parent is the hash of the image this one derives from, if any,
+		// e.g. the uncropped original or the first page of a set.
+		Parent string `json:",omitempty"`
+
+		// metadata recorded when the image was uploaded; images uploaded
+		// before it was recorded lack it
+		Width    int    `json:",omitempty"`
+		Height   int    `json:",omitempty"`
+		Size     int64  `json:",omitempty"`
+		Format   string `json:",omitempty"` // as detected, e.g. "png"
+		Frames   int    `json:",omitempty"` // 1 unless animated
+		Filename string `json:",omitempty"` // as uploaded
+		Source   string `json:",omitempty"` // URL, if fetched from one
+	}
+
+	// a trashEntry is a deleted image awaiting purging
+	trashEntry struct {
+		imageEntry
+		Deleted time.Time
+	}
+
+	// a revision is an approved change to the tags of an image
+	revision struct {
+		Hash      string
+		OldTags   stringSet `json:",omitempty"`
+		NewTags   stringSet
+		Date      time.Time
+		Submitter string `json:",omitempty"`
+	}
+
+	// an auditEntry records a moderation decision on a queue item
+	auditEntry struct {
+		Date      time.Time
+		Action    string
+		Hash      string `json:",omitempty"`
+		Pool      string `json:",omitempty"`
+		Approved  bool
+		Admin     string   // address the decision was made from
+		Submitter string   `json:",omitempty"`
+		Added     []string `json:",omitempty"`
+		Removed   []string `json:",omitempty"`
+	}
+
+	// a poolEntry is a named sequence of images, such as the pages of a
+	// story
+	poolEntry struct {
+		Name        string
+		Description string `json:",omitempty"`
+		Pages       []poolPage
+	}
+
+	poolPage struct {
+		Hash    string
+		Caption string `json:",omitempty"`
 	}
 
 	// a queueItem is a user action awaiting review
 	queueItem struct {
 		Action string
 		imageEntry
+		// Categories holds the categories given to tags, e.g. as
+		// artist:name, which are applied when the item is approved.
+		Categories map[string]string `json:",omitempty"`
+		// Pool is the new contents of a pool, for actionSetPool.
+		Pool *poolEntry `json:",omitempty"`
+		// Submitter is the address the item was submitted from.
+		Submitter string `json:",omitempty"`
 	}
 
-	// imageDB is a tagged image database.
-	// eventually a true db, for now all in-memory
+	// imageDB is a tagged image database. It layers tag aliasing and
+	// moderation on top of a Store, which holds the metadata, and a
+	// BlobStore, which holds the image files.
 	imageDB struct {
-		Tags    map[string]tagEntry
-		Images  map[string]imageEntry
-		Aliases map[string]string
-
-		Queue []queueItem
+		store Store
+		blobs BlobStore
+		mu    sync.RWMutex
 
-		mu sync.RWMutex
+		// views counted since they were last flushed to store
+		views   map[string]int
+		viewsMu sync.Mutex
 	}
 )
 
@@ -116,125 +196,69 @@ func (ie imageEntry) missingTags(tags []string) bool { return ie.checkTags(tags,
 // lookupByTags returns the set of images that match all of 'include' and none
 // of 'exclude'.
 func (db *imageDB) lookupByTags(include, exclude []string) (imgs []imageEntry, err error) {
-	// expand tag aliases
-	for i, tag := range include {
-		if alias, ok := db.Aliases[tag]; ok {
-			include[i] = alias
-		}
-	}
-	for i, tag := range exclude {
-		if alias, ok := db.Aliases[tag]; ok {
-			exclude[i] = alias
-		}
-	}
-
-	// if no include tags are supplied, filter the entire database
-	if len(include) == 0 {
-		for _, entry := range db.Images {
-			if entry.missingTags(exclude) {
-				imgs = append(imgs, entry)
-			}
-		}
-		return
-	}
+	return db.store.LookupByTags(include, exclude)
+}
 
-	// Get initial set by querying a single tag. Then, of these, filter out
-	// those that do not contain all of include and none of exclude.
-	for url := range db.Tags[include[0]].Images {
-		entry := db.Images[url]
-		if entry.hasTags(include) && entry.missingTags(exclude) {
-			imgs = append(imgs, entry)
-		}
+// resolveAlias returns the tag that tag is an alias of, or tag itself if it
+// is not an alias.
+func (db *imageDB) resolveAlias(tag string) (string, error) {
+	alias, ok, err := db.store.Alias(tag)
+	if err != nil || !ok {
+		return tag, err
 	}
-	return
+	return alias, nil
 }
 
-func (db *imageDB) expandAliases(tags stringSet) stringSet {
+func (db *imageDB) expandAliases(tags stringSet) (stringSet, error) {
 	post := make(stringSet)
 	for tag := range tags {
 		// expand alias, if there is one
-		if alias, ok := db.Aliases[tag]; ok {
-			tag = alias
+		tag, err := db.resolveAlias(tag)
+		if err != nil {
+			return nil, err
 		}
 		post[tag] = struct{}{}
 	}
-	return post
+	return post, nil
 }
 
-// addImage adds an image and its tags to the database.
-func (db *imageDB) addImage(entry imageEntry) error {
-	if _, ok := db.Images[entry.Hash]; ok {
-		return errImageExists
+// findImage returns the image with the given hash, which may also be the MD5
+// hash the image was known by before it was keyed by SHA-256.
+func (db *imageDB) findImage(hash string) (imageEntry, bool, error) {
+	entry, ok, err := db.store.Image(hash)
+	if err != nil || ok || len(hash) != md5.Size*2 {
+		return entry, ok, err
 	}
-	// expand aliases
-	entry.Tags = db.expandAliases(entry.Tags)
-	db.Images[entry.Hash] = entry
-	for tag := range entry.Tags {
-		// create tag if it does not already exist
-		if _, ok := db.Tags[tag]; !ok {
-			db.Tags[tag] = tagEntry{
-				Name:   tag,
-				Images: make(stringSet),
-			}
-		}
-		// add image to tag
-		db.Tags[tag].Images[entry.Hash] = struct{}{}
-	}
-	return nil
+	return db.store.ImageByMD5(hash)
 }
 
-// removeImage deletes an image from the database. If a tag only applied to
-// that image, the tag is also deleted.
-func (db *imageDB) removeImage(hash string) error {
-	img, ok := db.Images[hash]
-	if !ok {
-		return errImageNotExists
-	}
-	// delete tags
-	for t := range img.Tags {
-		tag, ok := db.Tags[t]
-		if !ok {
-			continue
-		}
-		delete(tag.Images, hash)
-		if len(tag.Images) == 0 {
-			delete(db.Tags, t)
-		}
+// addImage adds an image and its tags, plus any tags they imply, to the
+// database.
+func (db *imageDB) addImage(entry imageEntry) error {
+	if _, ok, err := db.store.Image(entry.Hash); err != nil {
+		return err
+	} else if ok {
+		return errImageExists
 	}
-	// delete image entry
-	delete(db.Images, hash)
-	return nil
-}
-
-func (db *imageDB) save() error {
-	f, err := os.Create("imagedb.json")
+	// expand aliases, then implications
+	tags, err := db.expandAliases(entry.Tags)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	b, err := json.MarshalIndent(db, "", "\t")
+	tags, err = db.expandImplications(tags)
 	if err != nil {
 		return err
 	}
-	_, err = f.Write(b)
-	return err
+	entry.Tags = tags
+	return db.store.AddImage(entry)
 }
 
-func newImageDB(dbpath string) (*imageDB, error) {
-	f, err := os.OpenFile(dbpath, os.O_RDWR|os.O_CREATE, 0666)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
+// removeImage deletes an image from the database. If a tag only applied to
+// that image, the tag is also deleted.
+func (db *imageDB) removeImage(hash string) error {
+	return db.store.RemoveImage(hash)
+}
 
-	db := &imageDB{
-		Tags:    make(map[string]tagEntry),
-		Images:  make(map[string]imageEntry),
-		Aliases: make(map[string]string),
-	}
-	err = json.NewDecoder(f).Decode(&db)
-	if err != nil && err != io.EOF {
-		return nil, err
-	}
-	return db, nil
+func newImageDB(store Store, blobs BlobStore) *imageDB {
+	return &imageDB{store: store, blobs: blobs}
 }
@@ -1,124 +1,207 @@
 package main
 
 import (
-	"crypto/md5"
-	"encoding/hex"
+	"bytes"
 	"image"
 	"io"
 	"io/ioutil"
 	"os"
-	"path/filepath"
 	"time"
 
 	// register these image formats
-	_ "image/gif"
+	"image/gif"  // need full import, since we count frames
 	"image/jpeg" // need full import, since we write jpeg thumbnails
 	_ "image/png"
 
 	"github.com/nfnt/resize"
 )
 
-func currentTime() string { return time.Now().Format("Mon Jan 02 15:04:05 EST 2006") }
+// readImageMeta returns an imageEntry holding the metadata of the image file
+// f, which decoded to img in the given format.
+func readImageMeta(f *os.File, img image.Image, format string) (imageEntry, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return imageEntry{}, err
+	}
+	bounds := img.Bounds()
+	meta := imageEntry{
+		Width:  bounds.Dx(),
+		Height: bounds.Dy(),
+		Size:   info.Size(),
+		Format: format,
+		Frames: 1,
+	}
+	if format == "gif" {
+		// image.Decode only returns the first frame
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return imageEntry{}, err
+		}
+		g, err := gif.DecodeAll(f)
+		if err != nil {
+			return imageEntry{}, err
+		}
+		meta.Width, meta.Height = g.Config.Width, g.Config.Height
+		meta.Frames = len(g.Image)
+	}
+	return meta, nil
+}
 
 // QueueDelete adds an image to the delete queue.
 func (db *imageDB) QueueDelete(hash string) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	entry, ok := db.Images[hash]
-	if !ok {
+	entry, ok, err := db.findImage(hash)
+	if err != nil {
+		return err
+	} else if !ok {
 		return errImageNotExists
 	}
-	db.Queue = append(db.Queue, queueItem{
+	return db.store.PushQueue(queueItem{
 		Action:     actionDelete,
 		imageEntry: entry,
 	})
-	return db.save()
 }
 
-// QueueSetTags adds an image to the tags queue.
-func (db *imageDB) QueueSetTags(hash string, tags []string) error {
+// QueueSetTags adds an image to the tags queue. categories holds the
+// categories given to any of the tags, and parent is the hash of the image's
+// parent, or empty if it has none. submitter is recorded in the image's
+// history if the change is approved.
+func (db *imageDB) QueueSetTags(hash string, tags []string, categories map[string]string, parent, submitter string) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	entry, ok := db.Images[hash]
-	if !ok {
+	entry, ok, err := db.findImage(hash)
+	if err != nil {
+		return err
+	} else if !ok {
 		return errImageNotExists
 	}
+	entry.Parent, err = db.resolveParent(entry.Hash, parent)
+	if err != nil {
+		return err
+	}
 	entry.Tags = make(stringSet)
 	for _, t := range tags {
 		entry.Tags[t] = struct{}{}
 	}
-	db.Queue = append(db.Queue, queueItem{
+	return db.store.PushQueue(queueItem{
 		Action:     actionSetTags,
 		imageEntry: entry,
+		Categories: categories,
+		Submitter:  submitter,
+	})
+}
+
+// QueuePool adds a pool to the pool queue, to be created or to replace the
+// pool of the same name.
+func (db *imageDB) QueuePool(pool poolEntry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	pool, err := db.resolvePool(pool)
+	if err != nil {
+		return err
+	}
+	// the first page stands in for the pool in the queue
+	entry, _, err := db.store.Image(pool.Pages[0].Hash)
+	if err != nil {
+		return err
+	}
+	return db.store.PushQueue(queueItem{
+		Action:     actionSetPool,
+		imageEntry: entry,
+		Pool:       &pool,
 	})
-	return db.save()
 }
 
-// QueueUpload adds an image to the upload queue and generates a thumbnail for
-// it. It returns the image's MD5 hash.
-func (db *imageDB) QueueUpload(r io.Reader, tags []string, ext string) error {
-	// simultaneously copy image to disk and calculate md5 hash
+// QueueUpload adds an image to the upload queue, keyed by its SHA-256 hash,
+// and generates a thumbnail for it. filename and source are recorded with the
+// image; source is the URL it was fetched from, if any. categories holds the
+// categories given to any of the tags, and submitter is recorded as the
+// author of its initial tags.
+func (db *imageDB) QueueUpload(r io.Reader, tags []string, categories map[string]string, ext, filename, source, submitter string) error {
+	// simultaneously copy image to disk and calculate its hashes
 	tmpFile, err := ioutil.TempFile(os.TempDir(), "dispel")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(tmpFile.Name())
 	defer tmpFile.Close()
-	hasher := md5.New()
-	img, _, err := image.Decode(
+	h := newImageHasher()
+	img, format, err := image.Decode(
 		io.TeeReader(
 			r, // decode file data
 			io.MultiWriter(
 				tmpFile, // also write to disk
-				hasher,  // also write to hasher
+				h,       // also write to hasher
 			),
 		),
 	)
 	if err != nil {
 		return err
 	}
-	hash := hex.EncodeToString(hasher.Sum(nil))
+	// the decoder may stop short of the end of the file
+	if _, err := io.Copy(io.MultiWriter(tmpFile, h), r); err != nil {
+		return err
+	}
+	hash, md5Hash := h.sums()
+	meta, err := readImageMeta(tmpFile, img, format)
+	if err != nil {
+		return err
+	}
+	meta.Filename, meta.Source = filename, source
 
 	db.mu.RLock()
-	curEntry, exists := db.Images[hash]
+	// images that predate SHA-256 are still keyed by MD5
+	curEntry, exists, err := db.findImage(hash)
+	if err == nil && !exists {
+		curEntry, exists, err = db.findImage(md5Hash)
+	}
+	var newTags stringSet
+	if err == nil && exists {
+		newTags, err = db.expandAliases(toStringSet(tags))
+	}
 	db.mu.RUnlock()
-	if exists {
+	if err != nil {
+		return err
+	} else if exists {
 		// if image was already uploaded, convert to setTags action instead,
 		// adding any unseen tags.
-		added, _ := curEntry.Tags.diff(db.expandAliases(toStringSet(tags)))
-		newTags := append(fromStringSet(curEntry.Tags), added...)
-		return db.QueueSetTags(hash, newTags)
+		added, _ := curEntry.Tags.diff(newTags)
+		return db.QueueSetTags(curEntry.Hash, append(fromStringSet(curEntry.Tags), added...), categories, curEntry.Parent, submitter)
 	}
 
 	// create thumbnail
-	thumbFile, err := os.Create(filepath.Join("queue", hash+"_thumb.jpg"))
+	var thumbBuf bytes.Buffer
+	thumb := resize.Thumbnail(150, 150, img, resize.MitchellNetravali)
+	err = jpeg.Encode(&thumbBuf, thumb, nil)
 	if err != nil {
 		return err
 	}
-	defer thumbFile.Close()
-	thumb := resize.Thumbnail(150, 150, img, resize.MitchellNetravali)
-	err = jpeg.Encode(thumbFile, thumb, nil)
+	err = db.blobs.Put(variantQueuedThumb, hash, thumbExt, &thumbBuf)
 	if err != nil {
-		os.Remove(filepath.Join("queue", hash+"_thumb.jpg"))
 		return err
 	}
 
-	// move image file to queue dir
-	err = os.Rename(tmpFile.Name(), filepath.Join("queue", hash+ext))
+	// copy image file to queue
+	if _, err = tmpFile.Seek(0, io.SeekStart); err == nil {
+		err = db.blobs.Put(variantQueued, hash, ext, tmpFile)
+	}
 	if err != nil {
+		db.blobs.Delete(variantQueuedThumb, hash, thumbExt)
 		return err
 	}
 
 	// add image to queue
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	db.Queue = append(db.Queue, queueItem{
-		Action: actionUpload,
-		imageEntry: imageEntry{
-			Hash:      hash,
-			Ext:       ext,
-			DateAdded: currentTime(),
-			Tags:      toStringSet(tags),
-		},
+	meta.Hash = hash
+	meta.MD5 = md5Hash
+	meta.Ext = ext
+	meta.DateAdded = time.Now()
+	meta.Tags = toStringSet(tags)
+	return db.store.PushQueue(queueItem{
+		Action:     actionUpload,
+		imageEntry: meta,
+		Categories: categories,
+		Submitter:  submitter,
 	})
-	return db.save()
 }
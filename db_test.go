@@ -1,71 +1,642 @@
 package main
 
 import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// newTestStore returns an empty jsonStore in a temporary directory.
+func newTestStore(t *testing.T) (*jsonStore, string) {
+	dir, err := ioutil.TempDir("", "dispel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbpath := filepath.Join(dir, "imagedb.json")
+	s, err := newJSONStore(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, dbpath
+}
+
+// newTestDB returns an empty imageDB backed by a jsonStore, with its blobs
+// stored alongside it.
+func newTestDB(t *testing.T) (*imageDB, string) {
+	s, dbpath := newTestStore(t)
+	dir := filepath.Dir(dbpath)
+	blobs, err := newLocalBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newImageDB(s, shardedBlobStore{blobs}), dir
+}
+
+func testEntry(hash string, tags ...string) imageEntry {
+	return imageEntry{Hash: hash, Tags: toStringSet(tags)}
+}
+
 func TestAddImage(t *testing.T) {
 	assert, require := assert.New(t), require.New(t)
-	db := newImageDB()
+	db, _ := newTestDB(t)
 
-	err := db.addImage("foo", []string{"bar", "baz"})
+	err := db.addImage(testEntry("foo", "bar", "baz"))
 	require.Nil(err)
 
-	err = db.addImage("foo", []string{"bar", "baz"})
+	err = db.addImage(testEntry("foo", "bar", "baz"))
 	assert.Equal(err, errImageExists)
 
-	urls, err := db.lookupByTags([]string{"bar"}, nil)
+	imgs, err := db.lookupByTags([]string{"bar"}, nil)
 	assert.Nil(err)
-	assert.Contains(urls, "foo")
+	assert.Contains(imgs, testEntry("foo", "bar", "baz"))
 
-	urls, err = db.lookupByTags([]string{"baz"}, nil)
+	imgs, err = db.lookupByTags([]string{"baz"}, nil)
 	assert.Nil(err)
-	assert.Contains(urls, "foo")
+	assert.Contains(imgs, testEntry("foo", "bar", "baz"))
 }
 
 func TestAddTags(t *testing.T) {
 	assert, require := assert.New(t), require.New(t)
-	db := newImageDB()
+	db, _ := newTestDB(t)
 
-	err := db.addTags("foo", []string{"bar", "baz"})
+	err := db.runSetTags(queueItem{Action: actionSetTags, imageEntry: testEntry("foo", "bar", "baz")})
 	assert.Equal(err, errImageNotExists)
 
-	err = db.addImage("foo", nil)
+	err = db.addImage(testEntry("foo"))
 	require.Nil(err)
 
-	err = db.addTags("foo", []string{"bar", "baz"})
+	err = db.runSetTags(queueItem{Action: actionSetTags, imageEntry: testEntry("foo", "bar", "baz")})
 	assert.Nil(err)
 
-	urls, err := db.lookupByTags([]string{"bar"}, nil)
+	imgs, err := db.lookupByTags([]string{"bar"}, nil)
 	assert.Nil(err)
-	assert.Contains(urls, "foo")
+	assert.Contains(imgs, testEntry("foo", "bar", "baz"))
 
-	urls, err = db.lookupByTags([]string{"baz"}, nil)
+	imgs, err = db.lookupByTags([]string{"baz"}, nil)
 	assert.Nil(err)
-	assert.Contains(urls, "foo")
+	assert.Contains(imgs, testEntry("foo", "bar", "baz"))
+}
+
+func TestAddAlias(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	db, _ := newTestDB(t)
+
+	require.Nil(db.addImage(testEntry("foo", "kitty", "bar")))
+	require.Nil(db.addImage(testEntry("qux", "kitty", "cat")))
+	require.Nil(db.addImage(testEntry("quux", "cat")))
+	require.Nil(db.store.SetTagInfo("kitty", tagInfo{Category: "character"}))
+	require.Nil(db.store.AddImplication("kitty", "pet"))
+
+	// existing images are retagged, and implications move to the tag
+	n, err := db.addAlias("kitty", "cat")
+	require.Nil(err)
+	assert.Equal(2, n)
+	entry, _, err := db.store.Image("foo")
+	require.Nil(err)
+	assert.Equal(toStringSet([]string{"cat", "bar", "pet"}), entry.Tags)
+	implied, err := db.store.Implications("cat")
+	require.Nil(err)
+	assert.Equal([]string{"pet"}, implied)
+	_, ok, err := db.store.Tag("kitty")
+	require.Nil(err)
+	assert.False(ok)
+	tag, _, err := db.store.TagInfo("cat")
+	require.Nil(err)
+	assert.Equal(3, tag.Count)
+	assert.Equal("character", tag.Category)
+
+	// aliases do not chain
+	_, err = db.addAlias("cat", "kitty")
+	assert.Equal(errAliasSelf, err)
+	_, err = db.addAlias("kitty", "bar")
+	assert.Equal(errAliasExists, err)
+	_, err = db.addAlias("-kitty", "bar")
+	assert.Equal(errBadTagName, err)
+	n, err = db.addAlias("cat", "feline")
+	require.Nil(err)
+	assert.Equal(3, n)
+	tagName, _, err := db.store.Alias("kitty")
+	require.Nil(err)
+	assert.Equal("feline", tagName)
+	imgs, err := db.lookupByTags([]string{"kitty"}, nil)
+	require.Nil(err)
+	assert.Len(imgs, 3)
+
+	require.Nil(db.removeAlias("kitty"))
+	assert.Equal(errAliasNotExists, db.removeAlias("kitty"))
+	imgs, err = db.lookupByTags([]string{"feline"}, nil)
+	require.Nil(err)
+	assert.Len(imgs, 3)
+}
+
+func TestImplications(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	db, _ := newTestDB(t)
+
+	require.Nil(db.addImage(testEntry("foo", "kitten")))
+	require.Nil(db.addImage(testEntry("bar", "kitten", "cat", "animal")))
+	require.Nil(db.store.SetAlias("kitty", "kitten"))
+
+	require.Nil(db.addImplication("cat", "animal"))
+	n, err := db.previewImplication("kitty", "cat")
+	require.Nil(err)
+	assert.Equal(1, n)
+	require.Nil(db.addImplication("kitty", "cat"))
+	implied, err := db.store.Implications("kitten")
+	require.Nil(err)
+	assert.Equal([]string{"cat"}, implied)
+
+	assert.Equal(errImplicationSelf, db.addImplication("kitten", "kitty"))
+	assert.Equal(errImplicationCycle, db.addImplication("animal", "kitten"))
+	assert.Equal(errBadTagName, db.addImplication("-cat", "animal"))
+
+	// new images get implied tags transitively
+	require.Nil(db.addImage(testEntry("baz", "kitty")))
+	entry, _, err := db.store.Image("baz")
+	require.Nil(err)
+	assert.Equal(toStringSet([]string{"kitten", "cat", "animal"}), entry.Tags)
+	require.Nil(db.runSetTags(queueItem{Action: actionSetTags, imageEntry: testEntry("baz", "cat")}))
+	entry, _, err = db.store.Image("baz")
+	require.Nil(err)
+	assert.Equal(toStringSet([]string{"cat", "animal"}), entry.Tags)
+
+	// existing images are updated by applyImplications
+	n, err = db.applyImplications("kitten")
+	require.Nil(err)
+	assert.Equal(1, n)
+	entry, _, err = db.store.Image("foo")
+	require.Nil(err)
+	assert.Equal(toStringSet([]string{"kitten", "cat", "animal"}), entry.Tags)
+	n, err = db.previewImplication("kitten", "cat")
+	require.Nil(err)
+	assert.Equal(0, n)
+
+	require.Nil(db.removeImplication("kitten", "cat"))
+	assert.Equal(errImplicationNotExists, db.removeImplication("kitten", "cat"))
+}
+
+func TestMergeTag(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	db, dir := newTestDB(t)
+
+	require.Nil(db.addImage(testEntry("foo", "kitty")))
+	require.Nil(db.addImage(testEntry("bar", "cat")))
+	require.Nil(db.store.SetAlias("kitten", "kitty"))
+	require.Nil(db.store.AddImplication("kitty", "pet"))
+
+	_, err := db.mergeTag("cat", "cat", true)
+	assert.Equal(errMergeSelf, err)
+	_, err = db.mergeTag("dog", "cat", true)
+	assert.Equal(errTagNotExists, err)
+
+	n, err := db.mergeTag("kitty", "cat", true)
+	require.Nil(err)
+	assert.Equal(1, n)
+	imgs, err := db.lookupByTags([]string{"cat"}, nil)
+	require.Nil(err)
+	assert.Len(imgs, 2)
+	// the old name, and its aliases, now refer to the new one
+	for _, alias := range []string{"kitty", "kitten"} {
+		tag, err := db.resolveAlias(alias)
+		require.Nil(err)
+		assert.Equal("cat", tag)
+	}
+	implied, err := db.store.Implications("cat")
+	require.Nil(err)
+	assert.Equal([]string{"pet"}, implied)
+
+	// without an alias, the old name is gone
+	n, err = db.mergeTag("cat", "feline", false)
+	require.Nil(err)
+	assert.Equal(2, n)
+	imgs, err = db.lookupByTags([]string{"cat"}, nil)
+	require.Nil(err)
+	assert.Empty(imgs)
+	tag, err := db.resolveAlias("kitty")
+	require.Nil(err)
+	assert.Equal("feline", tag)
+
+	// each merge is replayed from the journal as a whole
+	require.Nil(db.store.Close())
+	s, err := newJSONStore(filepath.Join(dir, "imagedb.json"))
+	require.Nil(err)
+	defer s.Close()
+	assert.Equal("feline", s.Aliases["kitty"])
+	assert.Equal(toStringSet([]string{"pet"}), s.Implies["feline"])
+	imgs, err = s.LookupByTags([]string{"feline"}, nil)
+	require.Nil(err)
+	assert.Len(imgs, 2)
+}
+
+func TestParents(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	db, _ := newTestDB(t)
+
+	require.Nil(db.addImage(testEntry("foo", "bar")))
+	require.Nil(db.addImage(testEntry("baz", "bar")))
+	require.Nil(db.addImage(testEntry("qux", "bar")))
+
+	assert.Equal(errParentNotExists, db.QueueSetTags("baz", []string{"bar"}, nil, "nope", ""))
+	assert.Equal(errParentSelf, db.QueueSetTags("baz", []string{"bar"}, nil, "baz", ""))
+	require.Nil(db.QueueSetTags("baz", []string{"bar"}, nil, "foo", ""))
+	require.Nil(db.QueueSetTags("qux", []string{"bar"}, nil, "baz", ""))
+	queue, err := db.store.QueueItems()
+	require.Nil(err)
+	require.Len(queue, 2)
+	assert.Equal("foo", queue[0].Parent)
+	for _, item := range queue {
+		require.Nil(db.runSetTags(item))
+	}
+	assert.Equal(errParentCycle, db.QueueSetTags("foo", []string{"bar"}, nil, "qux", ""))
+
+	children, err := db.store.Children("foo")
+	require.Nil(err)
+	require.Len(children, 1)
+	assert.Equal("baz", children[0].Hash)
+
+	q, err := parseQuery("bar parent:baz")
+	require.Nil(err)
+	imgs, err := db.search(q)
+	require.Nil(err)
+	require.Len(imgs, 1)
+	assert.Equal("qux", imgs[0].Hash)
+
+	// deleting a parent orphans its children
+	require.Nil(db.runDelete(queueItem{Action: actionDelete, imageEntry: testEntry("baz")}))
+	entry, _, err := db.store.Image("qux")
+	require.Nil(err)
+	assert.Empty(entry.Parent)
+	children, err = db.store.Children("baz")
+	require.Nil(err)
+	assert.Empty(children)
+}
+
+func TestPools(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	db, _ := newTestDB(t)
+
+	require.Nil(db.addImage(testEntry("foo", "bar")))
+	require.Nil(db.addImage(testEntry("baz", "bar")))
+	require.Nil(db.addImage(testEntry("qux", "bar", "last")))
+
+	pages := parsePoolPages("baz  In the beginning\n\nFOO\nqux the end\n")
+	assert.Equal([]poolPage{{"baz", "In the beginning"}, {"foo", ""}, {"qux", "the end"}}, pages)
+	assert.Equal(errBadPoolName, db.QueuePool(poolEntry{Name: "a/b", Pages: pages}))
+	assert.Equal(errPoolEmpty, db.QueuePool(poolEntry{Name: "story"}))
+	assert.Equal(errPoolPageNotExists, db.QueuePool(poolEntry{Name: "story", Pages: []poolPage{{Hash: "nope"}}}))
+	assert.Equal(errPoolDuplicatePage, db.QueuePool(poolEntry{Name: "story", Pages: []poolPage{{Hash: "foo"}, {Hash: "foo"}}}))
+	require.Nil(db.QueuePool(poolEntry{Name: "story", Pages: pages}))
+	queue, err := db.store.QueueItems()
+	require.Nil(err)
+	require.Len(queue, 1)
+	assert.Equal("baz", queue[0].Hash)
+	require.Nil(db.runSetPool(queue[0]))
+
+	search := func(query string) (hashes []string) {
+		q, err := parseQuery(query)
+		require.Nil(err)
+		imgs, err := db.search(q)
+		require.Nil(err)
+		for _, img := range imgs {
+			hashes = append(hashes, img.Hash)
+		}
+		return hashes
+	}
+	assert.Equal([]string{"baz", "foo", "qux"}, search("pool:story"))
+	assert.Equal([]string{"baz", "foo"}, search("bar -last pool:STORY"))
+	assert.Empty(search("pool:nope"))
+	_, err = parseQuery("pool:")
+	assert.NotNil(err)
+
+	// deleting an image removes its page
+	require.Nil(db.runDelete(queueItem{Action: actionDelete, imageEntry: testEntry("foo")}))
+	pool, ok, err := db.store.Pool("story")
+	require.Nil(err)
+	require.True(ok)
+	assert.Equal([]poolPage{{"baz", "In the beginning"}, {"qux", "the end"}}, pool.Pages)
+}
+
+func TestAdminQueueEscaping(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	// pool descriptions, captions and tag names are all submitted
+	// anonymously, so admin pages must escape them
+	evil := `"><script>alert(1)</script>`
+	render := func(tmpl *template.Template, data interface{}) string {
+		var buf bytes.Buffer
+		require.Nil(tmpl.Execute(&buf, data), tmpl.Name())
+		assert.NotContains(buf.String(), "<script>alert(1)", tmpl.Name())
+		return buf.String()
+	}
+
+	pool := &poolEntry{Name: "story", Description: evil, Pages: []poolPage{{"foo", evil}}}
+	out := render(adminQueueSetPoolTemplate, queueSetPoolArgs{
+		queueItem: queueItem{Action: actionSetPool, Pool: pool},
+		OldPool:   pool,
+	})
+	assert.Contains(out, "&lt;script&gt;alert(1)&lt;/script&gt;")
+
+	render(adminTagsTemplate, struct {
+		Tags       []tagEntry
+		Categories []string
+	}{[]tagEntry{{Name: evil, Description: evil}}, tagCategories})
+	render(adminAliasesTemplate, []aliasEntry{{evil, evil}})
+	// the preview echoes the request's parameters
+	render(adminImplicationsTemplate, struct {
+		Implications []implicationEntry
+		Preview      *implicationEntry
+		Affected     int
+	}{[]implicationEntry{{evil, evil}}, &implicationEntry{evil, evil}, 1})
+
+	item := queueItem{Action: actionSetTags, imageEntry: testEntry(evil, evil), Submitter: evil}
+	item.Parent = evil
+	render(adminQueueTemplate, []queueItem{item})
+	render(adminQueueDeleteTemplate, queueDeleteArgs{item, 0})
+	render(adminQueueSetTagsTemplate, queueSetTagsArgs{item, 0, []string{evil}, []string{evil}, ""})
+	render(adminQueueUploadTemplate, queueUploadArgs{item, 0})
+	render(adminAuditTemplate, struct {
+		Entries []auditEntry
+		Filter  auditFilter
+		Actions []string
+	}{[]auditEntry{{Action: actionSetTags, Submitter: evil, Added: []string{evil}}}, auditFilter{}, queueActions})
+	render(adminTrashTemplate, struct {
+		Entries   []trashEntry
+		Retention time.Duration
+	}{[]trashEntry{{imageEntry: item.imageEntry}}, time.Hour})
+	render(uploadImageTemplate, nil)
+}
+
+func TestHistory(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	db, _ := newTestDB(t)
+	require.Nil(db.addImplication("kitten", "cat"))
+	require.Nil(db.blobs.Put(variantQueued, "foo", "", strings.NewReader("image")))
+	require.Nil(db.blobs.Put(variantQueuedThumb, "foo", thumbExt, strings.NewReader("thumb")))
+
+	require.Nil(db.runUpload(queueItem{Action: actionUpload, imageEntry: testEntry("foo", "bar"), Submitter: "1.2.3.4"}))
+	require.Nil(db.runSetTags(queueItem{Action: actionSetTags, imageEntry: testEntry("foo", "kitten"), Submitter: "5.6.7.8"}))
+	// no change, so no revision
+	require.Nil(db.runSetTags(queueItem{Action: actionSetTags, imageEntry: testEntry("foo", "kitten", "cat")}))
+	revs, err := db.store.Revisions("foo")
+	require.Nil(err)
+	require.Len(revs, 2)
+	assert.Empty(revs[0].OldTags)
+	assert.Equal([]string{"bar"}, revs[0].Added())
+	assert.Equal("1.2.3.4", revs[0].Submitter)
+	assert.Equal([]string{"cat", "kitten"}, revs[1].Added())
+	assert.Equal([]string{"bar"}, revs[1].Removed())
+	assert.Equal("5.6.7.8", revs[1].Submitter)
+	assert.False(revs[1].Date.IsZero())
+
+	assert.Equal(errRevisionNotExists, db.revertImage("foo", 2, "admin"))
+	assert.Equal(errImageNotExists, db.revertImage("nope", 0, "admin"))
+	require.Nil(db.revertImage("foo", 0, "admin"))
+	entry, _, err := db.store.Image("foo")
+	require.Nil(err)
+	assert.Equal(toStringSet([]string{"bar"}), entry.Tags)
+	revs, err = db.store.Revisions("foo")
+	require.Nil(err)
+	require.Len(revs, 3)
+	assert.Equal([]string{"bar"}, revs[2].Added())
+	assert.Equal("admin", revs[2].Submitter)
+
+	// deleting an image keeps its history until it is purged
+	require.Nil(db.runDelete(queueItem{Action: actionDelete, imageEntry: testEntry("foo")}))
+	revs, err = db.store.Revisions("foo")
+	require.Nil(err)
+	assert.Len(revs, 3)
+	require.Nil(db.purgeImage("foo"))
+	revs, err = db.store.Revisions("foo")
+	require.Nil(err)
+	assert.Empty(revs)
+}
+
+func TestTrash(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	db, _ := newTestDB(t)
+
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte("image")))
+	require.Nil(db.blobs.Put(variantImage, hash, ".png", strings.NewReader("image")))
+	require.Nil(db.blobs.Put(variantThumb, hash, thumbExt, strings.NewReader("thumb")))
+	entry := imageEntry{Hash: hash, Ext: ".png", Tags: toStringSet([]string{"bar"}), Parent: "gone", Width: 10}
+	require.Nil(db.store.AddImage(entry))
+	require.Nil(db.addImage(testEntry("child", "bar")))
+	require.Nil(db.blobs.Put(variantImage, "child", "", strings.NewReader("child")))
+	require.Nil(db.blobs.Put(variantThumb, "child", thumbExt, strings.NewReader("thumb")))
+
+	require.Nil(db.runDelete(queueItem{Action: actionDelete, imageEntry: entry}))
+	imgs, err := db.lookupByTags([]string{"bar"}, nil)
+	require.Nil(err)
+	require.Len(imgs, 1)
+	assert.Equal("child", imgs[0].Hash)
+	trashed, ok, err := db.store.Trash(hash)
+	require.Nil(err)
+	require.True(ok)
+	assert.Equal(entry, trashed.imageEntry)
+	assert.False(trashed.Deleted.IsZero())
+	ok, err = db.blobs.Exists(variantImage, hash, ".png")
+	require.Nil(err)
+	assert.False(ok)
+	ok, err = db.blobs.Exists(variantTrashThumb, hash, thumbExt)
+	require.Nil(err)
+	assert.True(ok)
+	r, err := db.check(false)
+	require.Nil(err)
+	assert.Empty(r.Problems)
+
+	// restoring drops the missing parent, but keeps everything else
+	require.Nil(db.restoreImage(hash))
+	assert.Equal(errNotInTrash, db.restoreImage(hash))
+	restored, ok, err := db.store.Image(hash)
+	require.Nil(err)
+	require.True(ok)
+	assert.Empty(restored.Parent)
+	assert.Equal(10, restored.Width)
+	ok, err = db.blobs.Exists(variantImage, hash, ".png")
+	require.Nil(err)
+	assert.True(ok)
+
+	// only images older than the retention period are purged
+	require.Nil(db.runDelete(queueItem{Action: actionDelete, imageEntry: entry}))
+	n, err := db.purgeTrash(time.Hour)
+	require.Nil(err)
+	assert.Equal(0, n)
+	n, err = db.purgeTrash(0)
+	require.Nil(err)
+	assert.Equal(1, n)
+	_, ok, err = db.store.Trash(hash)
+	require.Nil(err)
+	assert.False(ok)
+	ok, err = db.blobs.Exists(variantTrash, hash, ".png")
+	require.Nil(err)
+	assert.False(ok)
+	assert.Equal(errNotInTrash, db.purgeImage(hash))
+}
+
+func TestAdminAuditEscaping(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	// denied submissions are logged too, so their tags are untrusted
+	evil := `<script>alert(1)</script>`
+	var buf bytes.Buffer
+	require.Nil(adminAuditTemplate.Execute(&buf, struct {
+		Entries []auditEntry
+		Filter  auditFilter
+		Actions []string
+	}{[]auditEntry{{
+		Action:    actionSetTags,
+		Hash:      "foo",
+		Submitter: evil,
+		Added:     []string{evil},
+		Removed:   []string{evil},
+	}}, auditFilter{}, queueActions}))
+	assert.NotContains(buf.String(), evil)
+	assert.Contains(buf.String(), "+&lt;script&gt;alert(1)&lt;/script&gt;")
+}
+
+func TestAuditLog(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	db, _ := newTestDB(t)
+	require.Nil(db.addImage(testEntry("foo", "bar", "baz")))
+
+	e, err := db.newAuditEntry(queueItem{Action: actionSetTags, imageEntry: testEntry("foo", "baz", "qux"), Submitter: "1.2.3.4"}, true, "127.0.0.1")
+	require.Nil(err)
+	assert.Equal([]string{"qux"}, e.Added)
+	assert.Equal([]string{"bar"}, e.Removed)
+	assert.Equal("1.2.3.4", e.Submitter)
+	assert.Equal("127.0.0.1", e.Admin)
+	assert.True(e.Approved)
+	require.Nil(db.store.AddAudit(e))
+
+	pool := poolEntry{Name: "story", Pages: []poolPage{{Hash: "foo"}}}
+	e, err = db.newAuditEntry(queueItem{Action: actionSetPool, imageEntry: testEntry("foo"), Pool: &pool}, false, "127.0.0.1")
+	require.Nil(err)
+	assert.Equal("story", e.Pool)
+	assert.Equal([]string{"1:foo"}, e.Added)
+	e.Date = time.Date(2020, 1, 2, 0, 0, 0, 0, time.Local)
+	require.Nil(db.store.AddAudit(e))
+
+	filter := func(query string) []auditEntry {
+		req, err := http.NewRequest("GET", "/admin/audit?"+query, nil)
+		require.Nil(err)
+		f, err := parseAuditFilter(req)
+		require.Nil(err)
+		entries, err := db.auditLog(f)
+		require.Nil(err)
+		return entries
+	}
+	assert.Len(filter(""), 2)
+	assert.Len(filter("action=set+tags"), 1)
+	assert.Len(filter("action=delete"), 0)
+	entries := filter("to=2020-01")
+	require.Len(entries, 1)
+	assert.Equal(actionSetPool, entries[0].Action)
+	assert.False(entries[0].Approved)
+	assert.Len(filter("from=2020-01-03"), 1)
+	assert.Len(filter("from=2020-01-02&to=2020-01-02"), 1)
+
+	req, _ := http.NewRequest("GET", "/admin/audit?action=nope", nil)
+	_, err = parseAuditFilter(req)
+	assert.NotNil(err)
 }
 
 func TestLookupByTags(t *testing.T) {
 	assert, require := assert.New(t), require.New(t)
-	db := newImageDB()
+	db, _ := newTestDB(t)
 
-	urls, err := db.lookupByTags([]string{"bar"}, nil)
+	imgs, err := db.lookupByTags([]string{"bar"}, nil)
 	assert.Nil(err)
-	assert.Empty(urls)
+	assert.Empty(imgs)
 
-	err = db.addImage("foo", []string{"bar", "baz"})
+	err = db.addImage(testEntry("foo", "bar", "baz"))
 	require.Nil(err)
 
-	urls, err = db.lookupByTags([]string{"bar"}, nil)
+	imgs, err = db.lookupByTags([]string{"bar"}, nil)
 	assert.Nil(err)
-	assert.Contains(urls, "foo")
+	assert.Contains(imgs, testEntry("foo", "bar", "baz"))
 
-	urls, err = db.lookupByTags([]string{"baz"}, nil)
+	imgs, err = db.lookupByTags([]string{"baz"}, nil)
 	assert.Nil(err)
-	assert.Contains(urls, "foo")
+	assert.Contains(imgs, testEntry("foo", "bar", "baz"))
+}
+
+func TestJournalReplay(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	s, dbpath := newTestStore(t)
+
+	require.Nil(s.AddImage(testEntry("foo", "bar")))
+	require.Nil(s.AddImage(testEntry("qux", "bar")))
+	require.Nil(s.RemoveImage("qux"))
+	require.Nil(s.PushQueue(queueItem{Action: actionDelete, imageEntry: testEntry("foo", "bar")}))
+	require.Nil(s.SetAlias("baz", "bar"))
+	require.Nil(s.SetTagInfo("bar", tagInfo{Category: "meta"}))
+	s.Close()
+
+	// simulate a crash in the middle of an append
+	f, err := os.OpenFile(dbpath+".journal", os.O_WRONLY|os.O_APPEND, 0666)
+	require.Nil(err)
+	f.WriteString(`{"Seq":7,"Op":"add im`)
+	f.Close()
+
+	s, err = newJSONStore(dbpath)
+	require.Nil(err)
+	assert.Equal(uint64(6), s.Seq)
+	assert.Contains(s.Images, "foo")
+	assert.NotContains(s.Images, "qux")
+	assert.Len(s.Queue, 1)
+	assert.Equal("bar", s.Aliases["baz"])
+	assert.Equal("meta", s.TagMeta["bar"].Category)
+
+	// compacting should produce an equivalent snapshot
+	require.Nil(s.compact())
+	s.Close()
+	s, err = newJSONStore(dbpath)
+	require.Nil(err)
+	assert.Equal(uint64(6), s.Seq)
+	assert.Contains(s.Images, "foo")
+	assert.Len(s.Queue, 1)
+	assert.Equal("meta", s.TagMeta["bar"].Category)
+	assert.Zero(s.journalLen)
+}
+
+func TestJournalWriteFailure(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	s, dbpath := newTestStore(t)
+
+	require.Nil(s.AddImage(testEntry("foo", "bar")))
+	// invalid ops are rejected before they are written
+	assert.Equal(errImageNotExists, s.RemoveImage("nope"))
+	assert.Equal(errBadQueueIndex, s.PopQueue(0))
+	assert.Equal(uint64(1), s.Seq)
+
+	// an op that cannot be journaled is not applied either
+	require.Nil(s.journal.Close())
+	assert.NotNil(s.AddImage(testEntry("qux", "bar")))
+	assert.NotContains(s.Images, "qux")
+	assert.Equal(uint64(1), s.Seq)
+
+	s, err := newJSONStore(dbpath)
+	require.Nil(err)
+	defer s.Close()
+	assert.Equal(uint64(1), s.Seq)
+	assert.Contains(s.Images, "foo")
 }
 
 func TestParseTags(t *testing.T) {
@@ -73,20 +644,582 @@ func TestParseTags(t *testing.T) {
 	tests := []struct {
 		tagQuery         string
 		include, exclude []string
+		categories       map[string]string
 	}{
-		{"", nil, nil},
-		{"-", nil, nil},
-		{"- --  ---   ", nil, []string{"-", "--"}},
-		{"foo", []string{"foo"}, nil},
-		{" foo", []string{"foo"}, nil},
-		{"foo -", []string{"foo"}, nil},
-		{"foo bar", []string{"foo", "bar"}, nil},
-		{"foo -bar", []string{"foo"}, []string{"bar"}},
-		{"-bar", nil, []string{"bar"}},
+		{"", nil, nil, nil},
+		{"-", nil, nil, nil},
+		{"- --  ---   ", nil, []string{"-", "--"}, nil},
+		{"foo", []string{"foo"}, nil, nil},
+		{" foo", []string{"foo"}, nil, nil},
+		{"foo -", []string{"foo"}, nil, nil},
+		{"foo bar", []string{"foo", "bar"}, nil, nil},
+		{"foo -bar", []string{"foo"}, []string{"bar"}, nil},
+		{"-bar", nil, []string{"bar"}, nil},
+		{"Artist:Foo bar", []string{"foo", "bar"}, nil, map[string]string{"foo": "artist"}},
+		{"series:foo -character:bar", []string{"foo"}, []string{"bar"}, map[string]string{"foo": "series", "bar": "character"}},
+		{"general:foo", []string{"foo"}, nil, nil},
+		{"artist: :foo bar:baz", []string{"artist:", ":foo", "bar:baz"}, nil, nil},
 	}
 	for _, test := range tests {
-		inc, ex := parseTags(test.tagQuery)
+		inc, ex, cats := parseTags(test.tagQuery)
 		assert.Equal(inc, test.include)
 		assert.Equal(ex, test.exclude)
+		assert.Equal(cats, test.categories)
+	}
+}
+
+// matchQuery reports whether entry matches query.
+func matchQuery(t *testing.T, db *imageDB, query string, entry imageEntry) bool {
+	q, err := parseQuery(query)
+	require.Nil(t, err, query)
+	match, err := db.compileQuery(q)
+	require.Nil(t, err, query)
+	return match(entry)
+}
+
+func TestParseSearch(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	db, _ := newTestDB(t)
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.Local) }
+	tests := []struct {
+		term string
+		in   []time.Time
+		out  []time.Time
+	}{
+		{"date:2025-03", []time.Time{day(2025, 3, 1), day(2025, 3, 31)}, []time.Time{day(2025, 2, 28), day(2025, 4, 1)}},
+		{"date:2025-03-14", []time.Time{day(2025, 3, 14)}, []time.Time{day(2025, 3, 15)}},
+		{"date:>2025-01-01", []time.Time{day(2025, 1, 2)}, []time.Time{day(2025, 1, 1), {}}},
+		{"date:>=2025", []time.Time{day(2025, 1, 1)}, []time.Time{day(2024, 12, 31)}},
+		{"DATE:<2025-01", []time.Time{day(2024, 12, 31)}, []time.Time{day(2025, 1, 1)}},
+		{"date:<=2025-01", []time.Time{day(2025, 1, 31)}, []time.Time{day(2025, 2, 1)}},
+	}
+	for _, test := range tests {
+		query := "foo -bar " + test.term
+		q, err := parseQuery(query)
+		require.Nil(err, test.term)
+		include, exclude := requiredTags(q.expr)
+		assert.Equal([]string{"foo"}, include)
+		assert.Equal([]string{"bar"}, exclude)
+		for _, d := range test.in {
+			entry := imageEntry{Tags: toStringSet([]string{"foo"}), DateAdded: d}
+			assert.True(matchQuery(t, db, query, entry), "%v should match %v", test.term, d)
+		}
+		for _, d := range test.out {
+			entry := imageEntry{Tags: toStringSet([]string{"foo"}), DateAdded: d}
+			assert.False(matchQuery(t, db, query, entry), "%v should not match %v", test.term, d)
+		}
+	}
+
+	entry := imageEntry{
+		Hash:   "abc123",
+		MD5:    "def456",
+		Ext:    ".jpg",
+		Tags:   toStringSet([]string{"foo", "bar"}),
+		Width:  1920,
+		Height: 1080,
+		Size:   3 << 20,
+		Format: "jpeg",
+		Frames: 1,
+	}
+	for query, match := range map[string]bool{
+		"width:1920":                true,
+		"width:>1920":               false,
+		"height:>=1080 width:<2000": true,
+		"size:>2mb":                 true,
+		"size:<=3M":                 true,
+		"frames:>1":                 false,
+		"format:jpg":                true,
+		"FORMAT:PNG":                false,
+		"ext:jpg":                   true,
+		"ext:.JPG":                  true,
+		"ext:png":                   false,
+		"tagcount:2":                true,
+		"tagcount:<2":               false,
+		"hash:abc":                  true,
+		"hash:DEF4":                 true,
+		"hash:bc":                   false,
+	} {
+		assert.Equal(match, matchQuery(t, db, query, entry), query)
+	}
+
+	for _, bad := range []string{"date:yesterday", "date:>", "date:2025-13", "width:wide", "size:>-1", "hash:xyz", "widht:>10"} {
+		_, err := parseQuery(bad)
+		assert.NotNil(err, bad)
+	}
+}
+
+func TestQueryLanguage(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	db, _ := newTestDB(t)
+
+	require.Nil(db.addImage(testEntry("a", "cat", "black")))
+	require.Nil(db.addImage(testEntry("b", "dog", "black")))
+	require.Nil(db.addImage(testEntry("c", "catgirl", "white")))
+	require.Nil(db.addImage(testEntry("d", "bobcat", "saber_(fate)")))
+	require.Nil(db.addImage(testEntry("e", "bird")))
+	require.Nil(db.store.SetAlias("kitty", "cat"))
+
+	search := func(query string) []string {
+		q, err := parseQuery(query)
+		require.Nil(err, query)
+		imgs, err := db.search(q)
+		require.Nil(err, query)
+		hashes := []string{}
+		for _, img := range imgs {
+			hashes = append(hashes, img.Hash)
+		}
+		sort.Strings(hashes)
+		return hashes
+	}
+	tests := []struct {
+		query  string
+		hashes []string
+	}{
+		{"", []string{"a", "b", "c", "d", "e"}},
+		{"cat | dog", []string{"a", "b"}},
+		{"kitty|dog", []string{"a", "b"}},
+		{"black (cat | white)", []string{"a"}},
+		{"(cat | dog) -black", []string{}},
+		{"-(cat | dog)", []string{"c", "d", "e"}},
+		{"--bird", []string{"e"}},
+		{"cat*", []string{"a", "c"}},
+		{"*cat", []string{"a", "d"}},
+		{"*cat* -cat", []string{"c", "d"}},
+		{"CAT* | bird", []string{"a", "c", "e"}},
+		{"saber_(fate)", []string{"d"}},
+		{"(saber_(fate) | dog)", []string{"b", "d"}},
+		{"general:bird", []string{"e"}},
+		{"black hash:a | tagcount:1", []string{"a", "e"}},
+	}
+	for _, test := range tests {
+		assert.Equal(test.hashes, search(test.query), test.query)
+	}
+
+	for query, err := range map[string]error{
+		"(cat":       errQueryUnclosed,
+		"cat)":       errQueryUnopened,
+		")":          errQueryUnopened,
+		"()":         errQueryEmptyGroup,
+		"cat |":      errQueryDanglingOr,
+		"| cat":      errQueryDanglingOr,
+		"cat || dog": errQueryDanglingOr,
+		"(cat |)":    errQueryDanglingOr,
+		"cat -":      errQueryDanglingNot,
+		"-|":         errQueryDanglingNot,
+	} {
+		_, qerr := parseQuery(query)
+		assert.Equal(err, qerr, query)
+	}
+}
+
+func TestSearchOrder(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	db, _ := newTestDB(t)
+
+	day := func(d int) time.Time { return time.Date(2025, 3, d, 0, 0, 0, 0, time.Local) }
+	for _, e := range []imageEntry{
+		{Hash: "a", DateAdded: day(1), Size: 30, Tags: toStringSet([]string{"x"})},
+		{Hash: "b", DateAdded: day(3), Size: 10, Tags: toStringSet([]string{"x", "y", "z"})},
+		{Hash: "c", DateAdded: day(2), Size: 20, Tags: toStringSet([]string{"x", "y"})},
+		{Hash: "d", DateAdded: day(2), Size: 20, Tags: toStringSet([]string{"x", "y"})},
+	} {
+		require.Nil(db.addImage(e))
+	}
+	db.countView("c")
+	db.countView("c")
+	db.countView("a")
+	db.countView("deleted")
+	require.Nil(db.flushViews())
+	views, err := db.store.Views("c")
+	require.Nil(err)
+	assert.Equal(2, views)
+	views, err = db.store.Views("deleted")
+	require.Nil(err)
+	assert.Zero(views)
+
+	search := func(query string) (hashes []string) {
+		q, err := parseQuery(query)
+		require.Nil(err, query)
+		imgs, err := db.search(q)
+		require.Nil(err, query)
+		for _, img := range imgs {
+			hashes = append(hashes, img.Hash)
+		}
+		return hashes
+	}
+	for query, want := range map[string][]string{
+		"x":               {"b", "c", "d", "a"},
+		"order:newest x":  {"b", "c", "d", "a"},
+		"order:oldest":    {"a", "c", "d", "b"},
+		"order:tags":      {"b", "c", "d", "a"},
+		"order:largest":   {"a", "c", "d", "b"},
+		"ORDER:POPULAR":   {"c", "a", "b", "d"},
+		"order:score y":   {"c", "b", "d"},
+		"-z order:oldest": {"a", "c", "d"},
+	} {
+		assert.Equal(want, search(query), query)
+	}
+
+	// the same seed always gives the same order
+	random := search("order:random:42")
+	assert.Len(random, 4)
+	for i := 0; i < 5; i++ {
+		assert.Equal(random, search("order:random:42"))
+	}
+	require.Nil(db.addImage(testEntry("e", "x")))
+	assert.Equal(random, filterHashes(search("order:random:42"), "e"))
+
+	// an explicit order overrides a pool's
+	require.Nil(db.store.SetPool(poolEntry{Name: "p", Pages: []poolPage{{Hash: "a"}, {Hash: "b"}}}))
+	assert.Equal([]string{"a", "b"}, search("pool:p"))
+	assert.Equal([]string{"b", "a"}, search("pool:p order:newest"))
+
+	for _, bad := range []string{"order:best", "order:random:x", "order:newest order:oldest", "-order:newest", "(x | order:oldest)"} {
+		_, err := parseQuery(bad)
+		assert.NotNil(err, bad)
+	}
+
+	// the search page's order and seed apply unless the query has its own
+	req, _ := http.NewRequest("GET", "/images?t=x&order=random&seed=42", nil)
+	q, err := parseSearchRequest(req)
+	require.Nil(err)
+	assert.Equal(searchOrder{orderRandom, 42}, q.order)
+	req, _ = http.NewRequest("GET", "/images?t=x+order:tags&order=oldest", nil)
+	q, err = parseSearchRequest(req)
+	require.Nil(err)
+	assert.Equal(orderTags, q.order.By)
+}
+
+func TestParsePage(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	parse := func(query string) (resultPage, error) {
+		req, err := http.NewRequest("GET", "/images?"+query, nil)
+		require.Nil(err)
+		return parsePage(req)
+	}
+	p, err := parse("t=x")
+	require.Nil(err)
+	assert.Equal(resultPage{Number: 1, Size: defaultPageSize}, p)
+	for _, bad := range []string{"page=0", "page=x", "size=0", "size=501", "size=-1"} {
+		_, err := parse(bad)
+		assert.NotNil(err, bad)
+	}
+
+	imgs := make([]imageEntry, 5)
+	for i := range imgs {
+		imgs[i] = testEntry(fmt.Sprint(i))
+	}
+	for _, test := range []struct {
+		query  string
+		hashes []string
+		pages  int
+	}{
+		{"size=2", []string{"0", "1"}, 3},
+		{"size=2&page=3", []string{"4"}, 3},
+		{"size=2&page=4", nil, 3},
+		{"size=2&page=4611686018427387905", nil, 3},
+		{"size=5", []string{"0", "1", "2", "3", "4"}, 1},
+	} {
+		p, err := parse(test.query)
+		require.Nil(err, test.query)
+		var hashes []string
+		for _, img := range p.slice(imgs) {
+			hashes = append(hashes, img.Hash)
+		}
+		assert.Equal(test.hashes, hashes, test.query)
+		assert.Equal(5, p.Total)
+		assert.Equal(test.pages, p.Pages(), test.query)
+	}
+
+	req, err := http.NewRequest("GET", "/images?t=cat+order%3Aoldest&page=2&size=10", nil)
+	require.Nil(err)
+	assert.Equal("/images?page=3&size=10&t=cat+order%3Aoldest", pageURL(req, 3))
+}
+
+// filterHashes returns hashes without exclude.
+func filterHashes(hashes []string, exclude string) []string {
+	var filtered []string
+	for _, h := range hashes {
+		if h != exclude {
+			filtered = append(filtered, h)
+		}
+	}
+	return filtered
+}
+
+func TestRestoreBackup(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	s, dbpath := newTestStore(t)
+
+	require.Nil(s.AddImage(testEntry("foo", "bar")))
+	require.Nil(s.compact())
+	require.Nil(s.AddImage(testEntry("baz", "bar")))
+	s.Close()
+
+	backups, err := backupPaths(dbpath)
+	require.Nil(err)
+	assert.Len(backups, 1)
+
+	// corrupt the primary snapshot
+	require.Nil(ioutil.WriteFile(dbpath, []byte("{garbage"), 0666))
+
+	s, err = newJSONStore(dbpath)
+	require.Nil(err)
+	assert.Contains(s.Images, "foo")
+	assert.Contains(s.Images, "baz")
+
+	// the primary should have been rewritten
+	_, err = readSnapshot(dbpath)
+	assert.Nil(err)
+}
+
+func TestMigrateSnapshot(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	dir, err := ioutil.TempDir("", "dispel")
+	require.Nil(err)
+	dbpath := filepath.Join(dir, "imagedb.json")
+
+	// an unversioned snapshot, as written before schema versions existed
+	old := `{"Tags":{"bar":{"Name":"bar","Images":["foo"]}},"Images":{"foo":{"Hash":"foo","Ext":".png","DateAdded":"Tue Mar 04 10:30:00 EST 2025","Tags":["bar"]}},"Aliases":{},"Queue":null,"Seq":1}`
+	require.Nil(ioutil.WriteFile(dbpath, []byte(old), 0666))
+	require.Nil(ioutil.WriteFile(dbpath+".journal", []byte(`{"Seq":2,"Op":"add image","Image":{"Hash":"baz","Tags":["bar"]}}`+"\n"), 0666))
+
+	s, err := newJSONStore(dbpath)
+	require.Nil(err)
+	assert.Equal(schemaVersion, s.Version)
+	assert.Contains(s.Images, "foo")
+	assert.Contains(s.Images, "baz")
+	assert.True(time.Date(2025, 3, 4, 10, 30, 0, 0, time.Local).Equal(s.Images["foo"].DateAdded))
+	assert.True(s.Images["baz"].DateAdded.IsZero())
+	s.Close()
+
+	// the upgraded snapshot is versioned, and the original is preserved
+	b, err := ioutil.ReadFile(dbpath)
+	require.Nil(err)
+	doc, err := decodeJSONObject(b)
+	require.Nil(err)
+	v, err := docVersion(doc)
+	require.Nil(err)
+	assert.Equal(schemaVersion, v)
+	b, err = ioutil.ReadFile(dbpath + ".v0")
+	require.Nil(err)
+	assert.Equal(old, string(b))
+
+	// snapshots from the future are rejected
+	require.Nil(ioutil.WriteFile(dbpath, []byte(`{"Version":9999}`), 0666))
+	_, err = newJSONStore(dbpath)
+	assert.Equal(errSchemaTooNew, err)
+}
+
+func TestArchive(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	db, dir := newTestDB(t)
+	require.Nil(db.addImage(testEntry("foo", "bar")))
+	require.Nil(db.store.SetAlias("baz", "bar"))
+	require.Nil(db.blobs.Put(variantImage, "foo", ".png", strings.NewReader("image")))
+	require.Nil(db.blobs.Put(variantQueuedThumb, "qux", thumbExt, strings.NewReader("thumb")))
+
+	for _, compress := range []bool{false, true} {
+		var buf bytes.Buffer
+		require.Nil(db.writeArchive(&buf, compress))
+
+		target := filepath.Join(dir, "restored", fmt.Sprint(compress))
+		require.Nil(restoreArchive(&buf, target))
+		b, err := ioutil.ReadFile(filepath.Join(target, "static/images/foo.png"))
+		require.Nil(err)
+		assert.Equal("image", string(b))
+		b, err = ioutil.ReadFile(filepath.Join(target, "queue/qux_thumb.jpg"))
+		require.Nil(err)
+		assert.Equal("thumb", string(b))
+
+		s, err := newJSONStore(filepath.Join(target, archiveDBName))
+		require.Nil(err)
+		assert.Contains(s.Images, "foo")
+		assert.Equal("bar", s.Aliases["baz"])
+		s.Close()
+
+		// restoring over existing data is refused
+		require.Nil(db.writeArchive(&buf, compress))
+		assert.Equal(errDirNotEmpty, restoreArchive(&buf, target))
+	}
+
+	_, err := archiveTarget(dir, "static/images/../../../etc/passwd")
+	assert.Equal(errBadArchivePath, err)
+}
+
+func TestCheck(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	db, dir := newTestDB(t)
+	s := db.store.(*jsonStore)
+
+	// quarantineDir is relative to the working directory
+	wd, _ := os.Getwd()
+	require.Nil(os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	// a healthy image
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("image data")))
+	require.Nil(db.blobs.Put(variantImage, hash, ".png", strings.NewReader("image data")))
+	require.Nil(db.blobs.Put(variantThumb, hash, thumbExt, strings.NewReader("")))
+	require.Nil(db.addImage(imageEntry{Hash: hash, Ext: ".png", Tags: toStringSet([]string{"bar"})}))
+
+	r, err := db.check(true)
+	require.Nil(err)
+	assert.Empty(r.Problems)
+
+	// corrupt the tag index, the image, and leave an orphan
+	s.Tags["bar"].Images["ghost"] = struct{}{}
+	require.Nil(db.blobs.Put(variantImage, hash, ".png", strings.NewReader("rotten")))
+	require.Nil(db.blobs.Put(variantQueued, "denied", ".png", strings.NewReader("")))
+
+	r, err = db.check(true)
+	require.Nil(err)
+	assert.Len(r.Problems, 3)
+	assert.True(r.TagIndexBad)
+	assert.Equal([]blobRef{{variantQueued, "denied", ".png"}}, r.Orphans)
+
+	require.Nil(db.repair(r))
+	r, err = db.check(false)
+	require.Nil(err)
+	assert.Empty(r.Problems)
+	_, err = os.Stat(filepath.Join(quarantineDir, "queue", "denied.png"))
+	assert.Nil(err)
+	ok, err := db.blobs.Exists(variantQueued, "denied", ".png")
+	require.Nil(err)
+	assert.False(ok)
+}
+
+func TestMigrateHashes(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	db, _ := newTestDB(t)
+
+	data := "image data"
+	sumMD5 := fmt.Sprintf("%x", md5.Sum([]byte(data)))
+	sumSHA := fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+	require.Nil(db.blobs.Put(variantImage, sumMD5, ".png", strings.NewReader(data)))
+	require.Nil(db.blobs.Put(variantThumb, sumMD5, thumbExt, strings.NewReader("thumb")))
+	require.Nil(db.addImage(imageEntry{Hash: sumMD5, Ext: ".png", Tags: toStringSet([]string{"bar"})}))
+	require.Nil(db.QueueSetTags(sumMD5, []string{"baz"}, nil, "", ""))
+	require.Nil(db.store.AddRevision(revision{Hash: sumMD5, NewTags: toStringSet([]string{"bar"})}))
+	child := fmt.Sprintf("%x", sha256.Sum256([]byte("child")))
+	require.Nil(db.blobs.Put(variantImage, child, ".png", strings.NewReader("child")))
+	require.Nil(db.blobs.Put(variantThumb, child, thumbExt, strings.NewReader("thumb")))
+	require.Nil(db.addImage(imageEntry{Hash: child, Ext: ".png", Parent: sumMD5, Tags: toStringSet([]string{"bar"})}))
+
+	n, err := db.migrateHashes()
+	require.Nil(err)
+	assert.Equal(1, n)
+
+	// links to the parent's children made before it was rekeyed still work
+	q, err := parseQuery("parent:" + sumMD5)
+	require.Nil(err)
+	imgs, err := db.search(q)
+	require.Nil(err)
+	require.Len(imgs, 1)
+	assert.Equal(child, imgs[0].Hash)
+
+	// the image is keyed by SHA-256, but can still be found by MD5
+	entry, ok, err := db.store.Image(sumSHA)
+	require.Nil(err)
+	require.True(ok)
+	assert.Equal(sumMD5, entry.MD5)
+	entry, ok, err = db.findImage(sumMD5)
+	require.Nil(err)
+	assert.True(ok)
+	assert.Equal(sumSHA, entry.Hash)
+	ok, err = db.blobs.Exists(variantThumb, sumSHA, thumbExt)
+	require.Nil(err)
+	assert.True(ok)
+	ok, err = db.blobs.Exists(variantImage, sumMD5, ".png")
+	require.Nil(err)
+	assert.False(ok)
+	entry, _, err = db.store.Image(child)
+	require.Nil(err)
+	assert.Equal(sumSHA, entry.Parent)
+	revs, err := db.store.Revisions(sumSHA)
+	require.Nil(err)
+	require.Len(revs, 1)
+	assert.Equal(sumSHA, revs[0].Hash)
+
+	// items queued under the old key still apply
+	queue, err := db.store.QueueItems()
+	require.Nil(err)
+	require.Nil(db.runSetTags(queue[0]))
+	entry, _, err = db.store.Image(sumSHA)
+	require.Nil(err)
+	assert.Equal(toStringSet([]string{"baz"}), entry.Tags)
+	assert.Equal(sumMD5, entry.MD5)
+
+	r, err := db.check(true)
+	require.Nil(err)
+	assert.Empty(r.Problems)
+
+	// nothing left to do
+	n, err = db.migrateHashes()
+	require.Nil(err)
+	assert.Equal(0, n)
+}
+
+func TestQueueUpload(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	db, _ := newTestDB(t)
+
+	var pngData bytes.Buffer
+	require.Nil(png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 40, 30))))
+	pal := []color.Color{color.Black, color.White}
+	anim := &gif.GIF{
+		Image: []*image.Paletted{
+			image.NewPaletted(image.Rect(0, 0, 20, 10), pal),
+			image.NewPaletted(image.Rect(0, 0, 20, 10), pal),
+			image.NewPaletted(image.Rect(0, 0, 20, 10), pal),
+		},
+		Delay: []int{10, 10, 10},
 	}
+	var gifData bytes.Buffer
+	require.Nil(gif.EncodeAll(&gifData, anim))
+
+	require.Nil(db.QueueUpload(bytes.NewReader(pngData.Bytes()), []string{"foo"}, map[string]string{"foo": "artist"}, ".png", "foo.png", "", "1.2.3.4"))
+	require.Nil(db.QueueUpload(bytes.NewReader(gifData.Bytes()), []string{"bar"}, nil, ".gif", "bar.gif", "http://example.com/bar.gif", ""))
+
+	queue, err := db.store.QueueItems()
+	require.Nil(err)
+	require.Len(queue, 2)
+	p, g := queue[0], queue[1]
+	assert.Equal(fmt.Sprintf("%x", sha256.Sum256(pngData.Bytes())), p.Hash)
+	assert.Equal(fmt.Sprintf("%x", md5.Sum(pngData.Bytes())), p.MD5)
+	assert.Equal(40, p.Width)
+	assert.Equal(30, p.Height)
+	assert.Equal(int64(pngData.Len()), p.Size)
+	assert.Equal("png", p.Format)
+	assert.Equal(1, p.Frames)
+	assert.Equal("foo.png", p.Filename)
+	assert.Empty(p.Source)
+	assert.False(p.DateAdded.IsZero())
+
+	assert.Equal("gif", g.Format)
+	assert.Equal(3, g.Frames)
+	assert.Equal(20, g.Width)
+	assert.Equal("http://example.com/bar.gif", g.Source)
+	ok, err := db.blobs.Exists(variantQueuedThumb, g.Hash, thumbExt)
+	require.Nil(err)
+	assert.True(ok)
+
+	// once approved, uploading a duplicate queues a tag update instead
+	require.Nil(db.runUpload(p))
+	entry, ok, err := db.store.Image(p.Hash)
+	require.Nil(err)
+	require.True(ok)
+	assert.Equal(40, entry.Width)
+	tag, ok, err := db.store.TagInfo("foo")
+	require.Nil(err)
+	require.True(ok)
+	assert.Equal("artist", tag.Category)
+	assert.Equal(1, tag.Count)
+	require.Nil(db.QueueUpload(bytes.NewReader(pngData.Bytes()), []string{"baz"}, nil, ".png", "foo.png", "", ""))
+	queue, err = db.store.QueueItems()
+	require.Nil(err)
+	require.Len(queue, 3)
+	assert.Equal(actionSetTags, queue[2].Action)
+	assert.Equal(toStringSet([]string{"foo", "baz"}), queue[2].Tags)
+	assert.Equal("png", queue[2].Format)
 }
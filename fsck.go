@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// quarantineDir is where repair moves orphaned blobs, preserving their paths
+// within the blob store.
+const quarantineDir = "quarantine"
+
+// fsckResult describes the inconsistencies found by check.
+type fsckResult struct {
+	// Problems describes every inconsistency found, one per line.
+	Problems []string
+	// Orphans are blobs that no image or queue item refers to.
+	Orphans []blobRef
+	// TagIndexBad is set if the tag index disagrees with the images' tags.
+	TagIndexBad bool
+}
+
+func (r *fsckResult) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// check verifies that the tag index agrees with each image's tags, that every
+// image, trashed image and pending upload has its files on disk, and that no
+// files are orphaned. If rehash is set, stored images are also re-hashed to
+// detect corruption. The caller must hold db.mu.
+func (db *imageDB) check(rehash bool) (*fsckResult, error) {
+	r := new(fsckResult)
+
+	images := make(map[string]imageEntry)
+	err := db.store.ForEachImage(func(entry imageEntry) error {
+		images[entry.Hash] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// tag index, in both directions
+	indexed := make(map[string]stringSet)
+	err = db.store.ForEachTag(func(tag tagEntry) error {
+		for hash := range tag.Images {
+			entry, ok := images[hash]
+			if !ok {
+				r.problem("tag %q lists nonexistent image %v", tag.Name, hash)
+				r.TagIndexBad = true
+				continue
+			} else if _, ok := entry.Tags[tag.Name]; !ok {
+				r.problem("tag %q lists image %v, which does not have that tag", tag.Name, hash)
+				r.TagIndexBad = true
+			}
+			if indexed[hash] == nil {
+				indexed[hash] = make(stringSet)
+			}
+			indexed[hash][tag.Name] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for hash, entry := range images {
+		for tag := range entry.Tags {
+			if _, ok := indexed[hash][tag]; !ok {
+				r.problem("image %v has tag %q, but is missing from its index", hash, tag)
+				r.TagIndexBad = true
+			}
+		}
+	}
+
+	// files belonging to stored images
+	expected := make(map[blobRef]struct{})
+	for hash, entry := range images {
+		expected[blobRef{variantImage, hash, entry.Ext}] = struct{}{}
+		expected[blobRef{variantThumb, hash, thumbExt}] = struct{}{}
+		if _, err := db.blobs.Stat(variantThumb, hash, thumbExt); err != nil {
+			r.problem("image %v: thumbnail: %v", hash, err)
+		}
+		if _, err := db.blobs.Stat(variantImage, hash, entry.Ext); err != nil {
+			r.problem("image %v: %v", hash, err)
+			continue
+		}
+		if rehash {
+			sha, sumMD5, err := hashBlob(db.blobs, variantImage, hash, entry.Ext)
+			if err != nil {
+				r.problem("image %v: %v", hash, err)
+			} else if sum := sha; hash != sha && hash != sumMD5 {
+				// images not yet rekeyed are still keyed by MD5
+				if len(hash) == len(sumMD5) {
+					sum = sumMD5
+				}
+				r.problem("image %v: contents hash to %v; file is corrupt", hash, sum)
+			} else if entry.MD5 != "" && entry.MD5 != sumMD5 {
+				r.problem("image %v: recorded MD5 %v does not match contents", hash, entry.MD5)
+			}
+		}
+	}
+
+	// files belonging to images in the trash
+	err = db.store.ForEachTrash(func(e trashEntry) error {
+		for _, ref := range []blobRef{
+			{variantTrash, e.Hash, e.Ext},
+			{variantTrashThumb, e.Hash, thumbExt},
+		} {
+			expected[ref] = struct{}{}
+			if _, err := db.blobs.Stat(ref.v, ref.hash, ref.ext); err != nil {
+				r.problem("trashed image %v: %v", e.Hash, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// files belonging to pending uploads
+	queue, err := db.store.QueueItems()
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range queue {
+		if item.Action != actionUpload {
+			continue
+		}
+		for _, ref := range []blobRef{
+			{variantQueued, item.Hash, item.Ext},
+			{variantQueuedThumb, item.Hash, thumbExt},
+		} {
+			expected[ref] = struct{}{}
+			if _, err := db.blobs.Stat(ref.v, ref.hash, ref.ext); err != nil {
+				r.problem("queued upload %v: %v", item.Hash, err)
+			}
+		}
+	}
+
+	// anything else is an orphan
+	for _, v := range blobVariants {
+		err := db.blobs.Walk(v, func(hash, ext string) error {
+			ref := blobRef{v, hash, ext}
+			if _, ok := expected[ref]; !ok {
+				r.problem("orphaned file %v", ref)
+				r.Orphans = append(r.Orphans, ref)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(r.Problems)
+	return r, nil
+}
+
+// repair fixes the problems in r that can be fixed: the tag index is rebuilt
+// from the images' tags, and orphaned files are moved into quarantineDir.
+// Missing and corrupt files must be restored from a backup. The caller must
+// hold db.mu.
+func (db *imageDB) repair(r *fsckResult) error {
+	if r.TagIndexBad {
+		if err := db.store.RebuildTagIndex(); err != nil {
+			return err
+		}
+	}
+	for _, ref := range r.Orphans {
+		if err := quarantineBlob(db.blobs, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quarantineBlob copies a blob into quarantineDir and removes it from bs.
+func quarantineBlob(bs BlobStore, ref blobRef) error {
+	r, err := bs.Get(ref.v, ref.hash, ref.ext)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	dst := filepath.Join(quarantineDir, filepath.FromSlash(ref.String()))
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return bs.Delete(ref.v, ref.hash, ref.ext)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log"
+)
+
+// imageHasher computes both the SHA-256 hash that identifies an image and
+// the MD5 hash it would have been known by previously.
+type imageHasher struct {
+	sha hash.Hash
+	md5 hash.Hash
+}
+
+func (h imageHasher) Write(p []byte) (int, error) {
+	h.sha.Write(p)
+	return h.md5.Write(p)
+}
+
+// sums returns the hex SHA-256 and MD5 hashes of the data written so far.
+func (h imageHasher) sums() (sha, md5 string) {
+	return hex.EncodeToString(h.sha.Sum(nil)), hex.EncodeToString(h.md5.Sum(nil))
+}
+
+func newImageHasher() imageHasher {
+	return imageHasher{sha: sha256.New(), md5: md5.New()}
+}
+
+// hashBlob returns the hex SHA-256 and MD5 hashes of a blob's contents.
+func hashBlob(bs BlobStore, v blobVariant, hash, ext string) (sha, md5 string, err error) {
+	r, err := bs.Get(v, hash, ext)
+	if err != nil {
+		return "", "", err
+	}
+	defer r.Close()
+	h := newImageHasher()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", "", err
+	}
+	sha, md5 = h.sums()
+	return sha, md5, nil
+}
+
+// rekeyImage re-identifies an image keyed by its MD5 hash by its SHA-256
+// hash, recording the MD5 hash for lookups. The blobs are copied before the
+// database is updated and the originals deleted afterwards, so an
+// interruption at any point leaves the image intact under one key or the
+// other. It takes db.mu itself.
+func (db *imageDB) rekeyImage(oldHash string) error {
+	db.mu.RLock()
+	entry, ok, err := db.store.Image(oldHash)
+	db.mu.RUnlock()
+	if err != nil || !ok {
+		return err
+	}
+	newHash, sumMD5, err := hashBlob(db.blobs, variantImage, oldHash, entry.Ext)
+	if err != nil {
+		return err
+	} else if sumMD5 != oldHash {
+		// leave corrupt files for check to report
+		log.Printf("Not rekeying %v: contents hash to %v", oldHash, sumMD5)
+		return nil
+	}
+
+	// copy the blobs first; they are orphans until the database refers to
+	// them
+	for _, ref := range []blobRef{{variantImage, "", entry.Ext}, {variantThumb, "", thumbExt}} {
+		r, err := db.blobs.Get(ref.v, oldHash, ref.ext)
+		if err != nil {
+			return err
+		}
+		err = db.blobs.Put(ref.v, newHash, ref.ext, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	db.mu.Lock()
+	cur, stillOld, err := db.store.Image(oldHash)
+	var haveNew bool
+	if err == nil {
+		// the image may already exist under its new key if an earlier
+		// attempt was interrupted
+		_, haveNew, err = db.store.Image(newHash)
+	}
+	if err == nil && stillOld {
+		// tags may have changed while the blobs were copied
+		cur.Hash, cur.MD5 = newHash, oldHash
+		if !haveNew {
+			err = db.store.AddImage(cur)
+		}
+		if err == nil {
+			err = db.store.RemoveImage(oldHash)
+		}
+		if err == nil {
+			err = db.reparentChildren(oldHash, newHash)
+		}
+		if err == nil {
+			err = db.repoolImage(oldHash, newHash)
+		}
+		if err == nil {
+			err = db.moveRevisions(oldHash, newHash)
+		}
+		if err == nil {
+			err = db.moveViews(oldHash, newHash)
+		}
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	discard := oldHash
+	if !stillOld {
+		if haveNew {
+			return nil
+		}
+		// deleted in the meantime; discard the copies
+		discard = newHash
+	}
+	db.blobs.Delete(variantImage, discard, entry.Ext)
+	db.blobs.Delete(variantThumb, discard, thumbExt)
+	return nil
+}
+
+// migrateHashes rekeys every image still keyed by MD5, returning the number
+// rekeyed. It is intended to run in the background: the database is only
+// locked while each image's entry is updated.
+func (db *imageDB) migrateHashes() (int, error) {
+	var hashes []string
+	db.mu.RLock()
+	err := db.store.ForEachImage(func(entry imageEntry) error {
+		if len(entry.Hash) == md5.Size*2 {
+			hashes = append(hashes, entry.Hash)
+		}
+		return nil
+	})
+	db.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	for i, hash := range hashes {
+		if err := db.rekeyImage(hash); err != nil {
+			return i, err
+		}
+		if (i+1)%1000 == 0 {
+			log.Printf("Rekeyed %v of %v images by SHA-256", i+1, len(hashes))
+		}
+	}
+	return len(hashes), nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var errRevisionNotExists = errors.New("revision does not exist")
+
+// Added returns the tags the revision added, sorted.
+func (r revision) Added() []string {
+	added, _ := r.OldTags.diff(r.NewTags)
+	sort.Strings(added)
+	return added
+}
+
+// Removed returns the tags the revision removed, sorted.
+func (r revision) Removed() []string {
+	_, removed := r.OldTags.diff(r.NewTags)
+	sort.Strings(removed)
+	return removed
+}
+
+// recordRevision adds a revision to the history of the image hash if its
+// tags now differ from old. It should be called once the new tags have been
+// stored, so that they include any aliases and implications applied.
+func (db *imageDB) recordRevision(hash string, old stringSet, submitter string) error {
+	entry, ok, err := db.store.Image(hash)
+	if err != nil || !ok {
+		return err
+	}
+	if added, removed := old.diff(entry.Tags); len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	return db.store.AddRevision(revision{
+		Hash:      hash,
+		OldTags:   old,
+		NewTags:   entry.Tags,
+		Date:      time.Now(),
+		Submitter: submitter,
+	})
+}
+
+// moveRevisions moves the history of the image from to to, e.g. when it is
+// rekeyed.
+func (db *imageDB) moveRevisions(from, to string) error {
+	revs, err := db.store.Revisions(from)
+	if err != nil || len(revs) == 0 {
+		return err
+	}
+	for _, rev := range revs {
+		rev.Hash = to
+		if err := db.store.AddRevision(rev); err != nil {
+			return err
+		}
+	}
+	return db.store.RemoveRevisions(from)
+}
+
+// revertImage sets the tags of an image back to those it had after the
+// revision at index, counting from its oldest. The revert is itself recorded
+// as a revision.
+func (db *imageDB) revertImage(hash string, index int, submitter string) error {
+	entry, ok, err := db.store.Image(hash)
+	if err != nil {
+		return err
+	} else if !ok {
+		return errImageNotExists
+	}
+	revs, err := db.store.Revisions(hash)
+	if err != nil {
+		return err
+	} else if index < 0 || index >= len(revs) {
+		return errRevisionNotExists
+	}
+	old := entry.Tags
+	if err := db.removeImage(hash); err != nil {
+		return err
+	}
+	entry.Tags = revs[index].NewTags
+	if err := db.addImage(entry); err != nil {
+		return err
+	}
+	return db.recordRevision(hash, old, submitter)
+}
+
+// adminRevertHandlerPOST reverts the tags of an image to a revision in its
+// history.
+func (db *imageDB) adminRevertHandlerPOST(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var index int
+	if _, err := fmt.Sscan(req.FormValue("rev"), &index); err != nil {
+		http.Error(w, "invalid revision", http.StatusBadRequest)
+		return
+	}
+	hash := ps.ByName("img")
+	db.mu.Lock()
+	err := db.revertImage(hash, index, remoteHost(req))
+	db.mu.Unlock()
+	if err == errImageNotExists || err == errRevisionNotExists {
+		http.Error(w, "failed to revert image: "+err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "failed to revert image: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/images/show/"+hash, http.StatusSeeOther)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
@@ -9,7 +10,30 @@ import (
 	"github.com/julienschmidt/httprouter"
 )
 
-var searchImageTemplate = template.Must(template.New("searchImage").Parse(`
+// templateFuncs are the functions available to page templates.
+var templateFuncs = map[string]interface{}{
+	"imageURL":   func(hash, ext string) string { return "/" + variantImage.path(hash, ext) },
+	"thumbURL":   func(hash string) string { return "/" + variantThumb.path(hash, thumbExt) },
+	"formatSize": formatSize,
+	"inc":        func(i int) int { return i + 1 },
+	"dec":        func(i int) int { return i - 1 },
+}
+
+// formatSize formats a byte count for display, e.g. "1.5 MB".
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGT"[exp])
+}
+
+var searchImageTemplate = template.Must(template.New("searchImage").Funcs(templateFuncs).Parse(`
 <!DOCTYPE html>
 <html>
 	<head>
@@ -23,27 +47,40 @@ var searchImageTemplate = template.Must(template.New("searchImage").Parse(`
 			<a href="/images">Dispel</a>
 			|
 			<a href="/images/upload">Upload</a>
+			|
+			<a href="/pools">Pools</a>
 		</header>
-		<div style="margin: 0 1.5% 24px 1.5%;">
-			<input id="searchbar" type="search" placeholder="yeb guac" value="{{ .Search }}" />
-		</div>
+		<form class="search" action="/images" method="get">
+			<input id="searchbar" type="search" name="t" placeholder="yeb guac" value="{{ .Search }}" />
+			<select id="order" name="order">
+				{{ range .Orders }}<option value="{{ .Name }}"{{ if eq .Name $.Order.By }} selected{{ end }}>{{ .Label }}</option>{{ end }}
+			</select>
+			{{ if eq .Order.By "random" }}<input type="hidden" name="seed" value="{{ .Order.Seed }}" />{{ end }}
+			{{ if not .Page.DefaultSize }}<input type="hidden" name="size" value="{{ .Page.Size }}" />{{ end }}
+			<label><input id="infinite" type="checkbox" /> Infinite scroll</label>
+		</form>
 		<div class="imagelist">
 			{{ range .Images }}
 				<a href="/images/show/{{ .Hash }}">
 					<span class="thumb">
-						<img class="preview" src="/static/thumbnails/{{ .Hash }}.jpg" />
+						<img class="preview" src="{{ thumbURL .Hash }}" />
 					</span>
 				</a>
 			{{ else }}
 				<span>No results!</span><br/><br/>
 			{{ end }}
 		</div>
+		<nav class="search-nav">
+			{{ if .PrevURL }}<a id="prev" href="{{ .PrevURL }}">&larr; Previous</a>{{ else }}<span></span>{{ end }}
+			<span>{{ .Page.Total }} result{{ if ne .Page.Total 1 }}s{{ end }}{{ if gt .Page.Pages 1 }}, page {{ .Page.Number }} of {{ .Page.Pages }}{{ end }}</span>
+			{{ if .NextURL }}<a id="next" href="{{ .NextURL }}">Next &rarr;</a>{{ else }}<span></span>{{ end }}
+		</nav>
 		<footer></footer>
 	</body>
 </html>
 `))
 
-var showImageTemplate = template.Must(template.New("showImage").Parse(`
+var showImageTemplate = template.Must(template.New("showImage").Funcs(templateFuncs).Parse(`
 <!DOCTYPE html>
 <html>
 	<head>
@@ -56,26 +93,79 @@ var showImageTemplate = template.Must(template.New("showImage").Parse(`
 			<a href="/images">Dispel</a>
 			|
 			<a href="/images/upload">Upload</a>
+			|
+			<a href="/pools">Pools</a>
 		</header>
 		<div class="flex">
 			<div class="sidebar">
-				{{ range $tag, $element := .Tags }}
-					<div>
-						<a href="/images?t={{ $tag }}">{{ $tag }}</a>
-					</div>
+				{{ range .TagGroups }}
+					<h6>{{ .Category }}</h6>
+					{{ range .Tags }}
+						<div class="tag tag-{{ .DisplayCategory }}"{{ if .Description }} title="{{ .Description }}"{{ end }}>
+							<a href="/images?t={{ .Name }}">{{ .Name }}</a> <span class="tag-count">{{ .Count }}</span>
+						</div>
+					{{ end }}
+				{{ end }}
+				<p>
+					{{ if not .DateAdded.IsZero }}
+						Added <time datetime="{{ .DateAdded.Format "2006-01-02T15:04:05Z07:00" }}">{{ .DateAdded.Local.Format "Jan 2, 2006 15:04 MST" }}</time><br/>
+					{{ end }}
+					{{ if .Width }}{{ .Width }}×{{ .Height }}<br/>{{ end }}
+					{{ if .Format }}{{ .Format }}{{ if gt .Frames 1 }}, {{ .Frames }} frames{{ end }}<br/>{{ end }}
+					{{ if .Size }}{{ formatSize .Size }}<br/>{{ end }}
+					{{ if .Filename }}Uploaded as {{ .Filename }}<br/>{{ end }}
+					{{ if .Source }}<a href="{{ .Source }}">Source</a><br/>{{ end }}
+				</p>
+				{{ if .Parent }}
+					<h6>Parent</h6>
+					<a href="/images/show/{{ .Parent }}">
+						<span class="thumb">
+							<img class="preview" src="{{ thumbURL .Parent }}" />
+						</span>
+					</a>
+				{{ end }}
+				{{ if .Children }}
+					<h6><a href="/images?t=parent:{{ .Hash }}">Children</a></h6>
+					{{ range .Children }}
+						<a href="/images/show/{{ .Hash }}">
+							<span class="thumb">
+								<img class="preview" src="{{ thumbURL .Hash }}" />
+							</span>
+						</a>
+					{{ end }}
 				{{ end }}
 			</div>
 			<div class="content">
 				<div class="content-img">
-					<img style="max-width: 100%;" src="/static/images/{{ .Hash }}{{ .Ext }}" />
+					<img style="max-width: 100%;" src="{{ imageURL .Hash .Ext }}" />
 				</div>
 				<div class="content-edit">
 					<h5>Edit Tags:</h5>
 					<form action="/images/update/{{ .Hash }}" method="post">
-						<textarea name="tags">{{ range $tag, $element := .Tags }}{{ $tag }} {{ end }}</textarea>
+						<textarea name="tags">{{ range .TagGroups }}{{ $c := .Category }}{{ range .Tags }}{{ if ne $c "general" }}{{ $c }}:{{ end }}{{ .Name }} {{ end }}{{ end }}</textarea>
+						<input type="text" name="parent" placeholder="Parent image hash" value="{{ .Parent }}" />
 						<input type="submit" value="Save changes" />
 					</form>
 				</div>
+				{{ if .History }}
+				<div class="content-edit">
+					<h5>History:</h5>
+					{{ range .History }}
+						<div class="revision">
+							<time datetime="{{ .Date.Format "2006-01-02T15:04:05Z07:00" }}">{{ .Date.Local.Format "Jan 2, 2006 15:04 MST" }}</time>
+							{{ if .Submitter }}by {{ .Submitter }}{{ end }}:
+							<span style="color: green">{{ range .Added }}+{{ . }} {{ end }}</span>
+							<span style="color: red">{{ range .Removed }}-{{ . }} {{ end }}</span>
+							{{ if $.Admin }}
+							<form action="/admin/images/{{ $.Hash }}/revert" method="post">
+								<input type="hidden" name="rev" value="{{ .Index }}" />
+								<input type="submit" value="Revert to this" />
+							</form>
+							{{ end }}
+						</div>
+					{{ end }}
+				</div>
+				{{ end }}
 			</div>
 		</div>
 		<footer></footer>
@@ -101,60 +191,142 @@ var thanksTemplate = template.Must(template.New("thanks").Parse(`
 </html>
 `))
 
+// A historyEntry is a revision as listed on an image's page.
+type historyEntry struct {
+	revision
+	Index int
+}
+
 func thanksHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	thanksTemplate.Execute(w, nil)
 }
 
-func parseTags(tagQuery string) (include, exclude []string) {
+// parseTags splits a space-separated list of tags into those to include and
+// those, prefixed with -, to exclude. Tags may be given a category, as in
+// artist:name; the prefix is stripped, and the category of each such tag is
+// returned in categories.
+func parseTags(tagQuery string) (include, exclude []string, categories map[string]string) {
 	for _, tag := range strings.Fields(tagQuery) {
 		tag = strings.ToLower(tag)
 		if strings.TrimPrefix(tag, "-") == "" {
 			continue
 		}
-		if strings.HasPrefix(tag, "-") {
-			exclude = append(exclude, tag[1:])
+		neg := strings.HasPrefix(tag, "-")
+		name, category, ok := splitTagCategory(strings.TrimPrefix(tag, "-"))
+		if ok && category != "" {
+			if categories == nil {
+				categories = make(map[string]string)
+			}
+			categories[name] = category
+		}
+		if neg {
+			exclude = append(exclude, name)
 		} else {
-			include = append(include, tag)
+			include = append(include, name)
 		}
 	}
 	return
 }
 
-// imageSearchHandler is the handler for the /images route. If
+// imageSearchHandler is the handler for the /images route. It shows a page
+// of the images matching the search t, with links to the pages either side.
 func (db *imageDB) imageSearchHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	searchTags := req.FormValue("t")
+	q, err := parseSearchRequest(req)
+	if err != nil {
+		http.Error(w, "invalid search: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := parsePage(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.order.By == orderRandom && req.FormValue("order") == orderRandom && req.FormValue("seed") == "" {
+		// pin the seed, so that reloading gives the same order
+		v := req.URL.Query()
+		v.Set("seed", fmt.Sprint(q.order.Seed))
+		http.Redirect(w, req, "/images?"+v.Encode(), http.StatusSeeOther)
+		return
+	}
+	if q.order.By == "" && q.pool == "" {
+		q.order.By = orderNewest
+	}
 	db.mu.RLock()
-	urls, err := db.lookupByTags(parseTags(searchTags))
+	urls, err := db.search(q)
 	db.mu.RUnlock()
 	if err != nil {
 		http.Error(w, "Lookup failed", http.StatusInternalServerError)
 		return
 	}
-	// for now, limit to 100 images
-	if len(urls) > 100 {
-		urls = urls[:100]
+	urls = page.slice(urls)
+	var prev, next string
+	if page.Number > 1 {
+		prev = pageURL(req, page.Number-1)
+	}
+	if page.Number < page.Pages() {
+		next = pageURL(req, page.Number+1)
 	}
 	log.Printf("Search from %v: %v", req.RemoteAddr, req.FormValue("t"))
 	searchImageTemplate.Execute(w, struct {
-		Search string
-		Images []imageEntry
-	}{searchTags, urls})
+		Search  string
+		Images  []imageEntry
+		Order   searchOrder
+		Orders  []struct{ Name, Label string }
+		Page    resultPage
+		PrevURL string
+		NextURL string
+	}{searchTags, urls, q.order, searchOrders, page, prev, next})
 }
 
 func (db *imageDB) imageShowHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	db.mu.RLock()
-	entry, ok := db.Images[ps.ByName("img")]
+	entry, ok, err := db.findImage(ps.ByName("img"))
 	db.mu.RUnlock()
-	if !ok {
+	if err != nil {
+		http.Error(w, "Lookup failed", http.StatusInternalServerError)
+		return
+	} else if !ok {
 		http.NotFound(w, req)
 		return
+	} else if entry.Hash != ps.ByName("img") {
+		// an old MD5 link
+		http.Redirect(w, req, "/images/show/"+entry.Hash, http.StatusMovedPermanently)
+		return
+	}
+	db.mu.RLock()
+	groups, err := db.tagGroups(entry.Tags)
+	var children []imageEntry
+	if err == nil {
+		children, err = db.store.Children(entry.Hash)
+	}
+	var revs []revision
+	if err == nil {
+		revs, err = db.store.Revisions(entry.Hash)
+	}
+	db.mu.RUnlock()
+	if err != nil {
+		http.Error(w, "Lookup failed", http.StatusInternalServerError)
+		return
 	}
 	log.Printf("Hit from %v on %v", req.RemoteAddr, entry.Hash)
-	showImageTemplate.Execute(w, entry)
+	db.countView(entry.Hash)
+	// newest first, remembering each revision's index for reverting
+	history := make([]historyEntry, len(revs))
+	for i, rev := range revs {
+		history[len(revs)-1-i] = historyEntry{rev, i}
+	}
+	showImageTemplate.Execute(w, struct {
+		imageEntry
+		TagGroups []tagGroup
+		Children  []imageEntry
+		History   []historyEntry
+		Admin     bool
+	}{entry, groups, children, history, remoteHost(req) == *adminIP})
 }
 
 func (db *imageDB) imageUpdateHandlerPOST(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	tags, badTags := parseTags(req.FormValue("tags"))
+	tags, badTags, categories := parseTags(req.FormValue("tags"))
 	if len(tags) == 0 {
 		http.Error(w, "failed to update image: please supply at least one tag", http.StatusBadRequest)
 		return
@@ -163,8 +335,12 @@ func (db *imageDB) imageUpdateHandlerPOST(w http.ResponseWriter, req *http.Reque
 		return
 	}
 	hash := ps.ByName("img")
-	err := db.QueueSetTags(hash, tags)
-	if err != nil {
+	parent := strings.ToLower(strings.TrimSpace(req.FormValue("parent")))
+	err := db.QueueSetTags(hash, tags, categories, parent, remoteHost(req))
+	if err == errParentNotExists || err == errParentSelf || err == errParentCycle {
+		http.Error(w, "Update failed: "+err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		http.Error(w, "Update failed: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var (
+	errImplicationSelf      = errors.New("a tag cannot imply itself")
+	errImplicationCycle     = errors.New("implication would create a cycle")
+	errImplicationNotExists = errors.New("implication does not exist")
+)
+
+// expandImplications returns tags plus every tag they imply, transitively.
+// Implications are stored between canonical tags, so tags should already
+// have had their aliases expanded.
+func (db *imageDB) expandImplications(tags stringSet) (stringSet, error) {
+	post := make(stringSet)
+	queue := fromStringSet(tags)
+	for len(queue) > 0 {
+		tag := queue[0]
+		queue = queue[1:]
+		if _, ok := post[tag]; ok {
+			continue
+		}
+		post[tag] = struct{}{}
+		implied, err := db.store.Implications(tag)
+		if err != nil {
+			return nil, err
+		}
+		queue = append(queue, implied...)
+	}
+	return post, nil
+}
+
+// resolveImplication resolves the aliases of an implication and checks that
+// it is valid to add.
+func (db *imageDB) resolveImplication(tag, implied string) (string, string, error) {
+	if !validTagName(tag) || !validTagName(implied) {
+		return "", "", errBadTagName
+	}
+	tag, err := db.resolveAlias(tag)
+	if err != nil {
+		return "", "", err
+	}
+	implied, err = db.resolveAlias(implied)
+	if err != nil {
+		return "", "", err
+	}
+	if tag == implied {
+		return "", "", errImplicationSelf
+	}
+	// tag must not already be implied by implied
+	closure, err := db.expandImplications(toStringSet([]string{implied}))
+	if err != nil {
+		return "", "", err
+	} else if _, ok := closure[tag]; ok {
+		return "", "", errImplicationCycle
+	}
+	return tag, implied, nil
+}
+
+// addImplication records that tag implies implied, after resolving aliases.
+// Only images added or retagged from now on are affected; applyImplications
+// updates existing images.
+func (db *imageDB) addImplication(tag, implied string) error {
+	tag, implied, err := db.resolveImplication(tag, implied)
+	if err != nil {
+		return err
+	}
+	return db.store.AddImplication(tag, implied)
+}
+
+// removeImplication deletes an implication. Images already tagged with the
+// implied tag keep it.
+func (db *imageDB) removeImplication(tag, implied string) error {
+	implications, err := db.store.Implications(tag)
+	if err != nil {
+		return err
+	}
+	for _, t := range implications {
+		if t == implied {
+			return db.store.RemoveImplication(tag, implied)
+		}
+	}
+	return errImplicationNotExists
+}
+
+// previewImplication returns the number of existing images that would gain
+// tags if tag implied implied.
+func (db *imageDB) previewImplication(tag, implied string) (int, error) {
+	tag, implied, err := db.resolveImplication(tag, implied)
+	if err != nil {
+		return 0, err
+	}
+	closure, err := db.expandImplications(toStringSet([]string{implied}))
+	if err != nil {
+		return 0, err
+	}
+	imgs, err := db.lookupByTags([]string{tag}, nil)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, entry := range imgs {
+		if !entry.hasTags(fromStringSet(closure)) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// applyImplications adds the tags implied by tag to every image tagged with
+// it, returning the number of images changed. Like migrateHashes, it is
+// intended to run in the background, and takes db.mu itself for each image.
+func (db *imageDB) applyImplications(tag string) (int, error) {
+	db.mu.RLock()
+	imgs, err := db.lookupByTags([]string{tag}, nil)
+	db.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, img := range imgs {
+		changed, err := db.applyImplicationsTo(img.Hash)
+		if err != nil {
+			return n, err
+		} else if changed {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// applyImplicationsTo retags an image with the tags its tags imply,
+// reporting whether any were missing.
+func (db *imageDB) applyImplicationsTo(hash string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// the image may have changed or been deleted since it was looked up
+	entry, ok, err := db.store.Image(hash)
+	if err != nil || !ok {
+		return false, err
+	}
+	tags, err := db.expandImplications(entry.Tags)
+	if err != nil {
+		return false, err
+	} else if len(tags) == len(entry.Tags) {
+		return false, nil
+	}
+	if err := db.removeImage(hash); err != nil {
+		return false, err
+	}
+	entry.Tags = tags
+	return true, db.addImage(entry)
+}
+
+// An implicationEntry is a tag and a tag it implies.
+type implicationEntry struct {
+	Tag, Implied string
+}
+
+var adminImplicationsTemplate = template.Must(template.New("adminImplications").Parse(`
+<!DOCTYPE html>
+<html>
+	<head>
+		<title>Dispel - Admin Implications</title>
+		<link rel="stylesheet" href="/static/css/milligram.min.css">
+		<link rel="stylesheet" href="/static/css/images.css">
+	</head>
+	<body>
+		<header>
+			<a href="/images">Dispel</a>
+			|
+			<a href="/admin/queue">Queue</a>
+			|
+			<a href="/admin/tags">Tags</a>
+			|
+			<a href="/admin/aliases">Aliases</a>
+			|
+			<a href="/admin/audit">Audit</a>
+		</header>
+		<div class="content">
+			{{ with .Preview }}
+				<form class="tag-edit" action="/admin/implications" method="post">
+					<span>Adding {{ .Tag }} &rarr; {{ .Implied }} will retag {{ $.Affected }} existing images.</span>
+					<input type="hidden" name="tag" value="{{ .Tag }}" />
+					<input type="hidden" name="implied" value="{{ .Implied }}" />
+					<input type="submit" value="Confirm" />
+				</form>
+			{{ else }}
+				<form class="tag-edit" action="/admin/implications" method="get">
+					<input type="text" name="tag" placeholder="Tag" />
+					<input type="text" name="implied" placeholder="Implies" />
+					<input type="submit" value="Preview" />
+				</form>
+			{{ end }}
+			{{ range .Implications }}
+				<form class="tag-edit" action="/admin/implications/{{ .Tag }}/{{ .Implied }}/delete" method="post">
+					<span class="tag"><a href="/images?t={{ .Tag }}">{{ .Tag }}</a></span>
+					<span>&rarr;</span>
+					<span class="tag"><a href="/images?t={{ .Implied }}">{{ .Implied }}</a></span>
+					<input type="submit" value="Delete" />
+				</form>
+			{{ else }}
+				<span>No implications!</span><br/><br/>
+			{{ end }}
+		</div>
+		<footer></footer>
+	</body>
+</html>
+`))
+
+// adminImplicationsHandler lists every implication. Given tag and implied, it
+// previews the number of images that adding that implication would retag.
+func (db *imageDB) adminImplicationsHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var args struct {
+		Implications []implicationEntry
+		Preview      *implicationEntry
+		Affected     int
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	err := db.store.ForEachImplication(func(tag, implied string) error {
+		args.Implications = append(args.Implications, implicationEntry{tag, implied})
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "failed to load implications: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(args.Implications, func(i, j int) bool {
+		a, b := args.Implications[i], args.Implications[j]
+		return a.Tag < b.Tag || (a.Tag == b.Tag && a.Implied < b.Implied)
+	})
+	if req.FormValue("tag") != "" || req.FormValue("implied") != "" {
+		tag := strings.ToLower(strings.TrimSpace(req.FormValue("tag")))
+		implied := strings.ToLower(strings.TrimSpace(req.FormValue("implied")))
+		args.Affected, err = db.previewImplication(tag, implied)
+		if err == errBadTagName || err == errImplicationSelf || err == errImplicationCycle {
+			http.Error(w, "invalid implication: "+err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "failed to preview implication: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		args.Preview = &implicationEntry{tag, implied}
+	}
+	adminImplicationsTemplate.Execute(w, args)
+}
+
+// adminImplicationsHandlerPOST adds an implication, then applies it to
+// existing images in the background.
+func (db *imageDB) adminImplicationsHandlerPOST(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	tag := strings.ToLower(strings.TrimSpace(req.FormValue("tag")))
+	implied := strings.ToLower(strings.TrimSpace(req.FormValue("implied")))
+	db.mu.Lock()
+	err := db.addImplication(tag, implied)
+	if err == nil {
+		tag, err = db.resolveAlias(tag)
+	}
+	db.mu.Unlock()
+	if err == errBadTagName || err == errImplicationSelf || err == errImplicationCycle {
+		http.Error(w, "failed to add implication: "+err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "failed to add implication: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	go func() {
+		n, err := db.applyImplications(tag)
+		if err != nil {
+			log.Printf("Failed to apply implications of %v: %v", tag, err)
+		} else {
+			log.Printf("Applied implications of %v to %v images", tag, n)
+		}
+	}()
+	http.Redirect(w, req, "/admin/implications", http.StatusSeeOther)
+}
+
+// adminImplicationDeleteHandlerPOST deletes an implication.
+func (db *imageDB) adminImplicationDeleteHandlerPOST(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	db.mu.Lock()
+	err := db.removeImplication(ps.ByName("tag"), ps.ByName("implied"))
+	db.mu.Unlock()
+	if err == errImplicationNotExists {
+		http.Error(w, "failed to delete implication: "+err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "failed to delete implication: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/admin/implications", http.StatusSeeOther)
+}
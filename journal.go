@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+)
+
+var (
+	errBadJournalOp = errors.New("unrecognized journal op")
+	errJournalGap   = errors.New("journal does not follow snapshot")
+	errTornJournal  = errors.New("journal ends in an incomplete entry")
+)
+
+// compactThreshold is the number of journal entries that may accumulate
+// before the journal is folded into a fresh snapshot.
+const compactThreshold = 1000
+
+// journal operations
+const (
+	opAddImage          = "add image"
+	opRemoveImage       = "remove image"
+	opPushQueue         = "push queue"
+	opPopQueue          = "pop queue"
+	opSetAlias          = "set alias"
+	opRemoveAlias       = "remove alias"
+	opRebuildTags       = "rebuild tags"
+	opSetTagInfo        = "set tag info"
+	opAddImplication    = "add implication"
+	opRemoveImplication = "remove implication"
+	opRenameTag         = "rename tag"
+	opMergeTag          = "merge tag"
+	opSetPool           = "set pool"
+	opRemovePool        = "remove pool"
+	opAddRevision       = "add revision"
+	opRemoveRevisions   = "remove revisions"
+	opAddAudit          = "add audit"
+	opAddTrash          = "add trash"
+	opRemoveTrash       = "remove trash"
+	opAddViews          = "add views"
+	opRemoveViews       = "remove views"
+)
+
+// A journalOp is a single mutation of a jsonStore. Ops are appended to the
+// journal as they are committed, and replayed on top of the last snapshot
+// when the database is loaded.
+type journalOp struct {
+	Seq      uint64
+	Op       string
+	Image    *imageEntry `json:",omitempty"`
+	Hash     string      `json:",omitempty"`
+	Item     *queueItem  `json:",omitempty"`
+	Index    int         `json:",omitempty"`
+	Alias    string      `json:",omitempty"`
+	Tag      string      `json:",omitempty"`
+	Info     *tagInfo    `json:",omitempty"`
+	Implied  string      `json:",omitempty"`
+	NewTag   string      `json:",omitempty"`
+	Pool     *poolEntry  `json:",omitempty"`
+	Revision *revision   `json:",omitempty"`
+	Audit    *auditEntry `json:",omitempty"`
+	Trash    *trashEntry `json:",omitempty"`
+	Views    int         `json:",omitempty"`
+	Merge    *tagMerge   `json:",omitempty"`
+}
+
+// check returns the error that applying op would fail with, if any.
+func (s *jsonStore) check(op journalOp) error {
+	switch op.Op {
+	case opRemoveImage:
+		if _, ok := s.Images[op.Hash]; !ok {
+			return errImageNotExists
+		}
+	case opPopQueue:
+		if op.Index < 0 || op.Index >= len(s.Queue) {
+			return errBadQueueIndex
+		}
+	}
+	return nil
+}
+
+// apply performs the mutation described by op. It does not touch the journal.
+func (s *jsonStore) apply(op journalOp) error {
+	if err := s.check(op); err != nil {
+		return err
+	}
+	switch op.Op {
+	case opAddImage:
+		s.insertImage(*op.Image)
+	case opRemoveImage:
+		s.deleteImage(op.Hash)
+	case opPushQueue:
+		s.Queue = append(s.Queue, *op.Item)
+	case opPopQueue:
+		s.Queue = append(s.Queue[:op.Index], s.Queue[op.Index+1:]...)
+	case opSetAlias:
+		s.Aliases[op.Alias] = op.Tag
+	case opRemoveAlias:
+		delete(s.Aliases, op.Alias)
+	case opSetTagInfo:
+		if *op.Info == (tagInfo{}) {
+			delete(s.TagMeta, op.Tag)
+		} else {
+			s.TagMeta[op.Tag] = *op.Info
+		}
+	case opAddImplication:
+		if s.Implies[op.Tag] == nil {
+			s.Implies[op.Tag] = make(stringSet)
+		}
+		s.Implies[op.Tag][op.Implied] = struct{}{}
+	case opRemoveImplication:
+		delete(s.Implies[op.Tag], op.Implied)
+		if len(s.Implies[op.Tag]) == 0 {
+			delete(s.Implies, op.Tag)
+		}
+	case opRenameTag:
+		if op.Tag == op.NewTag {
+			break
+		}
+		for _, hash := range fromStringSet(s.Tags[op.Tag].Images) {
+			entry := s.Images[hash]
+			s.deleteImage(hash)
+			s.insertImage(entry.renameTag(op.Tag, op.NewTag))
+		}
+		if info, ok := s.TagMeta[op.Tag]; ok {
+			s.TagMeta[op.NewTag] = mergeTagInfo(s.TagMeta[op.NewTag], info)
+			delete(s.TagMeta, op.Tag)
+		}
+	case opMergeTag:
+		m := op.Merge
+		s.apply(journalOp{Op: opRenameTag, Tag: m.From, NewTag: m.To})
+		for alias, tag := range m.Aliases {
+			s.apply(journalOp{Op: opSetAlias, Alias: alias, Tag: tag})
+		}
+		for _, imp := range m.RemoveImplications {
+			s.apply(journalOp{Op: opRemoveImplication, Tag: imp.Tag, Implied: imp.Implied})
+		}
+		for _, imp := range m.AddImplications {
+			s.apply(journalOp{Op: opAddImplication, Tag: imp.Tag, Implied: imp.Implied})
+		}
+	case opSetPool:
+		s.Pools[op.Pool.Name] = *op.Pool
+	case opRemovePool:
+		delete(s.Pools, op.Pool.Name)
+	case opAddRevision:
+		s.History[op.Revision.Hash] = append(s.History[op.Revision.Hash], *op.Revision)
+	case opRemoveRevisions:
+		delete(s.History, op.Hash)
+	case opAddAudit:
+		s.Audit = append(s.Audit, *op.Audit)
+	case opAddTrash:
+		s.Trashed[op.Trash.Hash] = *op.Trash
+	case opRemoveTrash:
+		delete(s.Trashed, op.Hash)
+	case opAddViews:
+		s.ViewCounts[op.Hash] += op.Views
+	case opRemoveViews:
+		delete(s.ViewCounts, op.Hash)
+	case opRebuildTags:
+		s.Tags = make(map[string]tagEntry)
+		if s.bitmaps != nil {
+			s.bitmaps = newBitmapIndex()
+		}
+		for _, entry := range s.Images {
+			s.insertImage(entry)
+		}
+	default:
+		return errBadJournalOp
+	}
+	s.Seq = op.Seq
+	return nil
+}
+
+// commit appends op to the journal and applies it to the database. op is
+// only applied once it is safely in the journal, so that a failed commit
+// leaves the database unchanged. Once the journal grows past
+// compactThreshold entries, it is compacted.
+func (s *jsonStore) commit(op journalOp) error {
+	op.Seq = s.Seq + 1
+	if err := s.check(op); err != nil {
+		return err
+	}
+	if s.journal == nil {
+		// purely in-memory database
+		return s.apply(op)
+	}
+	b, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	if err := s.appendJournal(b); err != nil {
+		return err
+	}
+	if err := s.apply(op); err != nil {
+		return err
+	}
+	s.journalLen++
+	if s.journalLen >= compactThreshold {
+		return s.compact()
+	}
+	return nil
+}
+
+// compact writes a snapshot of the database and empties the journal. Each op
+// carries a sequence number, so a crash between the two steps is harmless:
+// ops already reflected in the snapshot are skipped during replay.
+func (s *jsonStore) compact() error {
+	if err := s.save(); err != nil {
+		return err
+	}
+	if err := s.journal.Truncate(0); err != nil {
+		return err
+	}
+	s.journalLen = 0
+	return s.journal.Sync()
+}
+
+// replay applies each op in the journal that is newer than the snapshot. A
+// torn final entry, left behind by a crash mid-append, is discarded.
+func (s *jsonStore) replay() error {
+	n, err := s.replayFrom(s.journal)
+	if err == errTornJournal {
+		// incomplete write; chop it off
+		return s.journal.Truncate(n)
+	}
+	return err
+}
+
+// replayFrom applies each op read from r that is newer than the snapshot,
+// returning the length of the complete entries in r. If r ends in a torn
+// entry, replayFrom returns errTornJournal after applying the rest.
+func (s *jsonStore) replayFrom(r io.Reader) (int64, error) {
+	var offset int64
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) != 0 {
+				return offset, errTornJournal
+			}
+			return offset, nil
+		} else if err != nil {
+			return offset, err
+		}
+		offset += int64(len(line))
+
+		if s.journalVersion < schemaVersion {
+			if line, err = migrateJournalOp(line, s.journalVersion); err != nil {
+				return offset, err
+			}
+		}
+		var op journalOp
+		if err := json.Unmarshal(line, &op); err != nil {
+			return offset, err
+		}
+		s.journalLen++
+		if op.Seq <= s.Seq {
+			continue
+		} else if op.Seq != s.Seq+1 {
+			return offset, errJournalGap
+		}
+		if err := s.apply(op); err != nil {
+			return offset, err
+		}
+	}
+}
+
+// appendJournal writes an encoded op to the journal and syncs it. If either
+// fails, the journal is truncated back to its previous length, so that the op
+// is not replayed later.
+func (s *jsonStore) appendJournal(b []byte) error {
+	info, err := s.journal.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = s.journal.Write(append(b, '\n'))
+	if err == nil {
+		err = s.journal.Sync()
+	}
+	if err != nil {
+		s.journal.Truncate(info.Size())
+		return err
+	}
+	return nil
+}
+
+func openJournal(dbpath string) (*os.File, error) {
+	return os.OpenFile(dbpath+".journal", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// search result orders, as named by order: terms
+const (
+	orderNewest  = "newest"
+	orderOldest  = "oldest"
+	orderRandom  = "random"
+	orderTags    = "tags"
+	orderLargest = "largest"
+	orderPopular = "popular"
+)
+
+// searchOrders are the orders search results can be sorted in, as offered
+// on the search page.
+var searchOrders = []struct{ Name, Label string }{
+	{orderNewest, "Newest"},
+	{orderOldest, "Oldest"},
+	{orderRandom, "Random"},
+	{orderTags, "Most tags"},
+	{orderLargest, "Largest"},
+	{orderPopular, "Most viewed"},
+}
+
+// A searchOrder is the order search results are sorted in.
+type searchOrder struct {
+	By string
+	// Seed determines the shuffle when By is orderRandom, so that the same
+	// seed always gives the same order.
+	Seed int64
+}
+
+// String returns o as the argument of an order: term.
+func (o searchOrder) String() string {
+	if o.By == orderRandom {
+		return fmt.Sprintf("%v:%v", o.By, o.Seed)
+	}
+	return o.By
+}
+
+// parseOrder parses the argument of an order: term: the name of an order,
+// or for a random order, optionally random:seed. A random order without a
+// seed is given a new one. score is accepted as a synonym for popular.
+func parseOrder(s string) (searchOrder, error) {
+	s = strings.ToLower(s)
+	if s == "score" {
+		s = orderPopular
+	}
+	if seed := strings.TrimPrefix(s, orderRandom+":"); seed != s {
+		n, err := strconv.ParseInt(seed, 10, 64)
+		if err != nil {
+			return searchOrder{}, fmt.Errorf("invalid random seed %q: expected a number", seed)
+		}
+		return searchOrder{orderRandom, n}, nil
+	}
+	for _, o := range searchOrders {
+		if o.Name == s {
+			o := searchOrder{By: s}
+			if s == orderRandom {
+				o.Seed = rand.Int63n(1e9)
+			}
+			return o, nil
+		}
+	}
+	return searchOrder{}, fmt.Errorf("unknown order %q: expected newest, oldest, random, tags, largest or popular", s)
+}
+
+// newer reports whether a was added after b, breaking ties by hash so that
+// the order is always the same.
+func newer(a, b imageEntry) bool {
+	if !a.DateAdded.Equal(b.DateAdded) {
+		return a.DateAdded.After(b.DateAdded)
+	}
+	return a.Hash < b.Hash
+}
+
+// sortImages sorts imgs in order o; ties are broken newest first. views,
+// which is only needed for orderPopular, maps image hashes to their view
+// counts.
+func sortImages(imgs []imageEntry, o searchOrder, views map[string]int) {
+	var less func(a, b imageEntry) bool
+	switch o.By {
+	case orderOldest:
+		less = func(a, b imageEntry) bool {
+			if !a.DateAdded.Equal(b.DateAdded) {
+				return a.DateAdded.Before(b.DateAdded)
+			}
+			return a.Hash < b.Hash
+		}
+	case orderRandom:
+		// hashing each image with the seed, rather than shuffling, keeps
+		// the order of existing images when new ones are added
+		keys := make(map[string]uint64, len(imgs))
+		for _, img := range imgs {
+			h := fnv.New64a()
+			binary.Write(h, binary.BigEndian, o.Seed)
+			h.Write([]byte(img.Hash))
+			keys[img.Hash] = h.Sum64()
+		}
+		less = func(a, b imageEntry) bool {
+			if keys[a.Hash] != keys[b.Hash] {
+				return keys[a.Hash] < keys[b.Hash]
+			}
+			return newer(a, b)
+		}
+	case orderTags:
+		less = func(a, b imageEntry) bool {
+			if len(a.Tags) != len(b.Tags) {
+				return len(a.Tags) > len(b.Tags)
+			}
+			return newer(a, b)
+		}
+	case orderLargest:
+		less = func(a, b imageEntry) bool {
+			if a.Size != b.Size {
+				return a.Size > b.Size
+			}
+			return newer(a, b)
+		}
+	case orderPopular:
+		less = func(a, b imageEntry) bool {
+			if views[a.Hash] != views[b.Hash] {
+				return views[a.Hash] > views[b.Hash]
+			}
+			return newer(a, b)
+		}
+	default:
+		less = newer
+	}
+	sort.Slice(imgs, func(i, j int) bool { return less(imgs[i], imgs[j]) })
+}
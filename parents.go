@@ -0,0 +1,61 @@
+package main
+
+import "errors"
+
+var (
+	errParentNotExists = errors.New("parent image does not exist")
+	errParentSelf      = errors.New("an image cannot be its own parent")
+	errParentCycle     = errors.New("parent would create a cycle")
+)
+
+// resolveParent checks that parent may be made the parent of the image hash,
+// returning parent's current hash, since it may be given by MD5. An empty
+// parent is always valid, and clears the relationship.
+func (db *imageDB) resolveParent(hash, parent string) (string, error) {
+	if parent == "" {
+		return "", nil
+	}
+	entry, ok, err := db.findImage(parent)
+	if err != nil {
+		return "", err
+	} else if !ok {
+		return "", errParentNotExists
+	} else if entry.Hash == hash {
+		return "", errParentSelf
+	}
+	// hash must not be an ancestor of parent
+	seen := make(stringSet)
+	for cur := entry; cur.Parent != ""; {
+		if cur.Parent == hash {
+			return "", errParentCycle
+		} else if _, ok := seen[cur.Parent]; ok {
+			break
+		}
+		seen[cur.Parent] = struct{}{}
+		if cur, ok, err = db.store.Image(cur.Parent); err != nil {
+			return "", err
+		} else if !ok {
+			break
+		}
+	}
+	return entry.Hash, nil
+}
+
+// reparentChildren sets the parent of each child of the image from to to,
+// which may be empty, e.g. when from is deleted.
+func (db *imageDB) reparentChildren(from, to string) error {
+	children, err := db.store.Children(from)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := db.removeImage(child.Hash); err != nil {
+			return err
+		}
+		child.Parent = to
+		if err := db.addImage(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
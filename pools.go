@@ -0,0 +1,367 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var (
+	errBadPoolName       = errors.New("pool names must be non-empty and contain no spaces or slashes")
+	errPoolEmpty         = errors.New("a pool must have at least one page")
+	errPoolPageNotExists = errors.New("pool page does not exist")
+	errPoolDuplicatePage = errors.New("an image may only appear once in a pool")
+)
+
+// validPoolName reports whether name can be stored as a pool name. Pool names
+// appear in URLs and in pool: search terms.
+func validPoolName(name string) bool {
+	return name != "" && !strings.ContainsRune(name, '/') && len(strings.Fields(name)) == 1
+}
+
+// parsePoolPages parses the pages of a pool, one per line: an image hash,
+// optionally followed by a caption.
+func parsePoolPages(text string) []poolPage {
+	var pages []poolPage
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var page poolPage
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			page.Hash, page.Caption = line[:i], strings.TrimSpace(line[i:])
+		} else {
+			page.Hash = line
+		}
+		page.Hash = strings.ToLower(page.Hash)
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+// hashes returns the set of images in the pool.
+func (p poolEntry) hashes() stringSet {
+	set := make(stringSet, len(p.Pages))
+	for _, page := range p.Pages {
+		set[page.Hash] = struct{}{}
+	}
+	return set
+}
+
+// resolvePool checks that pool may be stored, returning a copy whose pages
+// are keyed by each image's current hash, since they may be given by MD5.
+func (db *imageDB) resolvePool(pool poolEntry) (poolEntry, error) {
+	if !validPoolName(pool.Name) {
+		return poolEntry{}, errBadPoolName
+	} else if len(pool.Pages) == 0 {
+		return poolEntry{}, errPoolEmpty
+	}
+	pages := make([]poolPage, len(pool.Pages))
+	seen := make(stringSet)
+	for i, page := range pool.Pages {
+		entry, ok, err := db.findImage(page.Hash)
+		if err != nil {
+			return poolEntry{}, err
+		} else if !ok {
+			return poolEntry{}, errPoolPageNotExists
+		} else if _, ok := seen[entry.Hash]; ok {
+			return poolEntry{}, errPoolDuplicatePage
+		}
+		seen[entry.Hash] = struct{}{}
+		pages[i] = poolPage{Hash: entry.Hash, Caption: page.Caption}
+	}
+	pool.Pages = pages
+	return pool, nil
+}
+
+// repoolImage replaces the image from with to in every pool. If to is empty,
+// e.g. when from is deleted, its page is removed instead; a pool left with
+// no pages is deleted.
+func (db *imageDB) repoolImage(from, to string) error {
+	var changed []poolEntry
+	err := db.store.ForEachPool(func(pool poolEntry) error {
+		if _, ok := pool.hashes()[from]; ok {
+			changed = append(changed, pool)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, pool := range changed {
+		var pages []poolPage
+		for _, page := range pool.Pages {
+			if page.Hash == from {
+				if to == "" {
+					continue
+				}
+				page.Hash = to
+			}
+			pages = append(pages, page)
+		}
+		pool.Pages = pages
+		if len(pages) == 0 {
+			err = db.store.RemovePool(pool.Name)
+		} else {
+			err = db.store.SetPool(pool)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var poolListTemplate = template.Must(template.New("poolList").Funcs(templateFuncs).Parse(`
+<!DOCTYPE html>
+<html>
+	<head>
+		<title>Dispel - Pools</title>
+		<link rel="stylesheet" href="/static/css/milligram.min.css">
+		<link rel="stylesheet" href="/static/css/images.css">
+	</head>
+	<body>
+		<header>
+			<a href="/images">Dispel</a>
+			|
+			<a href="/images/upload">Upload</a>
+			|
+			<a href="/pools">Pools</a>
+		</header>
+		<div class="content">
+			<form class="tag-edit" action="/pools" method="get">
+				<input type="text" name="name" placeholder="Pool name" />
+				<input type="submit" value="New pool" />
+			</form>
+		</div>
+		<div class="imagelist">
+			{{ range . }}
+				<a href="/pools/{{ .Name }}">
+					<span class="thumb">
+						<img class="preview" src="{{ thumbURL (index .Pages 0).Hash }}" />
+					</span>
+				</a>
+				<span class="pool-name"><a href="/pools/{{ .Name }}">{{ .Name }}</a> <span class="tag-count">{{ len .Pages }}</span></span>
+			{{ else }}
+				<span>No pools!</span><br/><br/>
+			{{ end }}
+		</div>
+		<footer></footer>
+	</body>
+</html>
+`))
+
+var poolTemplate = template.Must(template.New("pool").Funcs(templateFuncs).Parse(`
+<!DOCTYPE html>
+<html>
+	<head>
+		<title>Dispel - {{ .Name }}</title>
+		<link rel="stylesheet" href="/static/css/milligram.min.css">
+		<link rel="stylesheet" href="/static/css/images.css">
+	</head>
+	<body>
+		<header>
+			<a href="/images">Dispel</a>
+			|
+			<a href="/images/upload">Upload</a>
+			|
+			<a href="/pools">Pools</a>
+		</header>
+		<div class="content">
+			<h5>{{ .Name }}</h5>
+			{{ if .Description }}<p>{{ .Description }}</p>{{ end }}
+			<p>
+				<a href="/images?t=pool:{{ .Name }}">Search</a>
+				|
+				<a href="/pools/{{ .Name }}/edit">Edit</a>
+			</p>
+		</div>
+		<div class="imagelist">
+			{{ range $i, $page := .Pages }}
+				<a href="/pools/{{ $.Name }}?page={{ inc $i }}"{{ if $page.Caption }} title="{{ $page.Caption }}"{{ end }}>
+					<span class="thumb">
+						<img class="preview" src="{{ thumbURL $page.Hash }}" />
+					</span>
+				</a>
+			{{ end }}
+		</div>
+		<footer></footer>
+	</body>
+</html>
+`))
+
+var poolPageTemplate = template.Must(template.New("poolPage").Funcs(templateFuncs).Parse(`
+<!DOCTYPE html>
+<html>
+	<head>
+		<title>Dispel - {{ .Name }} - Page {{ .Page }}</title>
+		<link rel="stylesheet" href="/static/css/milligram.min.css">
+		<link rel="stylesheet" href="/static/css/images.css">
+	</head>
+	<body>
+		<header>
+			<a href="/images">Dispel</a>
+			|
+			<a href="/images/upload">Upload</a>
+			|
+			<a href="/pools">Pools</a>
+		</header>
+		<div class="content">
+			<nav class="pool-nav">
+				{{ if gt .Page 1 }}<a href="/pools/{{ .Name }}?page={{ dec .Page }}">&larr; Previous</a>{{ else }}<span></span>{{ end }}
+				<a href="/pools/{{ .Name }}">{{ .Name }}</a>
+				<span>{{ .Page }} / {{ len .Pages }}</span>
+				{{ if lt .Page (len .Pages) }}<a href="/pools/{{ .Name }}?page={{ inc .Page }}">Next &rarr;</a>{{ else }}<span></span>{{ end }}
+			</nav>
+			<div class="content-img">
+				<a href="/images/show/{{ .Current.Hash }}">
+					<img style="max-width: 100%;" src="{{ imageURL .Current.Hash .Ext }}" />
+				</a>
+			</div>
+			{{ if .Current.Caption }}<p class="pool-caption">{{ .Current.Caption }}</p>{{ end }}
+		</div>
+		<footer></footer>
+	</body>
+</html>
+`))
+
+var poolEditTemplate = template.Must(template.New("poolEdit").Funcs(templateFuncs).Parse(`
+<!DOCTYPE html>
+<html>
+	<head>
+		<title>Dispel - Edit {{ .Name }}</title>
+		<link rel="stylesheet" href="/static/css/milligram.min.css">
+		<link rel="stylesheet" href="/static/css/images.css">
+	</head>
+	<body>
+		<header>
+			<a href="/images">Dispel</a>
+			|
+			<a href="/images/upload">Upload</a>
+			|
+			<a href="/pools">Pools</a>
+		</header>
+		<div class="content">
+			<div class="content-edit">
+				<h5>Edit {{ .Name }}:</h5>
+				<form action="/pools/{{ .Name }}" method="post">
+					<input type="text" name="description" placeholder="Description" value="{{ .Description }}" />
+					<textarea name="pages" rows="12" placeholder="One page per line: image hash, then an optional caption">{{ range .Pages }}{{ .Hash }}{{ if .Caption }} {{ .Caption }}{{ end }}
+{{ end }}</textarea>
+					<input type="submit" value="Save changes" />
+				</form>
+			</div>
+		</div>
+		<footer></footer>
+	</body>
+</html>
+`))
+
+// poolListHandler lists every pool. Given the name of a new pool, it
+// redirects to that pool's edit page instead.
+func (db *imageDB) poolListHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if name := strings.ToLower(strings.TrimSpace(req.FormValue("name"))); name != "" {
+		if !validPoolName(name) {
+			http.Error(w, "invalid pool: "+errBadPoolName.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, req, "/pools/"+name+"/edit", http.StatusSeeOther)
+		return
+	}
+	var pools []poolEntry
+	db.mu.RLock()
+	err := db.store.ForEachPool(func(pool poolEntry) error {
+		pools = append(pools, pool)
+		return nil
+	})
+	db.mu.RUnlock()
+	if err != nil {
+		http.Error(w, "failed to load pools: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+	poolListTemplate.Execute(w, pools)
+}
+
+// poolHandler shows a pool. Given page, counting from 1, it shows that page
+// alone, with links to the next and previous pages; otherwise it shows a
+// thumbnail of every page.
+func (db *imageDB) poolHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	pool, ok, err := db.store.Pool(ps.ByName("name"))
+	if err != nil {
+		http.Error(w, "failed to load pool: "+err.Error(), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if req.FormValue("page") == "" {
+		poolTemplate.Execute(w, pool)
+		return
+	}
+
+	var page int
+	_, err = fmt.Sscan(req.FormValue("page"), &page)
+	if err != nil || page < 1 || page > len(pool.Pages) {
+		http.Error(w, "invalid page number", http.StatusBadRequest)
+		return
+	}
+	cur := pool.Pages[page-1]
+	entry, _, err := db.store.Image(cur.Hash)
+	if err != nil {
+		http.Error(w, "failed to load image: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	poolPageTemplate.Execute(w, struct {
+		poolEntry
+		Page    int
+		Current poolPage
+		Ext     string
+	}{pool, page, cur, entry.Ext})
+}
+
+// poolEditHandler shows a form to change the description and pages of a
+// pool, or to create it if it does not exist.
+func (db *imageDB) poolEditHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	name := strings.ToLower(ps.ByName("name"))
+	if !validPoolName(name) {
+		http.Error(w, "invalid pool: "+errBadPoolName.Error(), http.StatusBadRequest)
+		return
+	}
+	db.mu.RLock()
+	pool, ok, err := db.store.Pool(name)
+	db.mu.RUnlock()
+	if err != nil {
+		http.Error(w, "failed to load pool: "+err.Error(), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		pool = poolEntry{Name: name}
+	}
+	poolEditTemplate.Execute(w, pool)
+}
+
+// poolHandlerPOST queues a pool to be created or replaced.
+func (db *imageDB) poolHandlerPOST(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	pool := poolEntry{
+		Name:        strings.ToLower(ps.ByName("name")),
+		Description: strings.TrimSpace(req.FormValue("description")),
+		Pages:       parsePoolPages(req.FormValue("pages")),
+	}
+	err := db.QueuePool(pool)
+	if err == errBadPoolName || err == errPoolEmpty || err == errPoolPageNotExists || err == errPoolDuplicatePage {
+		http.Error(w, "Update failed: "+err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Update failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/thanks", http.StatusSeeOther)
+}
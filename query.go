@@ -0,0 +1,413 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+var (
+	errQueryEmptyGroup  = errors.New("empty parentheses")
+	errQueryUnclosed    = errors.New("missing ) to close (")
+	errQueryUnopened    = errors.New("unexpected ) without matching (")
+	errQueryDanglingOr  = errors.New("| must come between two terms")
+	errQueryDanglingNot = errors.New("- must be followed by a term or group")
+)
+
+// A queryExpr is a node of a parsed search query.
+type queryExpr interface {
+	// compile resolves the expression against db, e.g. expanding aliases and
+	// wildcards, and returns a filter matching the images it selects.
+	compile(db *imageDB) (imageFilter, error)
+}
+
+type (
+	// a tag, as typed; aliases are resolved when compiled
+	queryTag string
+	// a tag pattern containing *, matching any tag that fits it
+	queryWildcard string
+	// a metadata term, such as width:>1920
+	queryMeta imageFilter
+	// a pool: term, matching the images in the pool
+	queryPool string
+	// a parent: term, matching the children of the image
+	queryParent string
+	// an order: term, which sorts results rather than selecting them
+	queryOrder searchOrder
+	// a negated term or group
+	queryNot struct{ x queryExpr }
+	// terms that must all match
+	queryAnd []queryExpr
+	// terms of which at least one must match
+	queryOr []queryExpr
+)
+
+func (t queryTag) compile(db *imageDB) (imageFilter, error) {
+	tag, err := db.resolveAlias(string(t))
+	if err != nil {
+		return nil, err
+	}
+	return func(e imageEntry) bool {
+		_, ok := e.Tags[tag]
+		return ok
+	}, nil
+}
+
+func (w queryWildcard) compile(db *imageDB) (imageFilter, error) {
+	tags := make(stringSet)
+	err := db.store.ForEachTag(func(tag tagEntry) error {
+		if matchWildcard(string(w), tag.Name) {
+			tags[tag.Name] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func(e imageEntry) bool {
+		for tag := range e.Tags {
+			if _, ok := tags[tag]; ok {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func (m queryMeta) compile(*imageDB) (imageFilter, error) {
+	return imageFilter(m), nil
+}
+
+func (p queryPool) compile(db *imageDB) (imageFilter, error) {
+	pool, _, err := db.store.Pool(string(p))
+	if err != nil {
+		return nil, err
+	}
+	hashes := pool.hashes()
+	return func(e imageEntry) bool {
+		_, ok := hashes[e.Hash]
+		return ok
+	}, nil
+}
+
+func (p queryParent) compile(db *imageDB) (imageFilter, error) {
+	// the image may have been rekeyed since the link was made
+	parent := string(p)
+	entry, ok, err := db.findImage(parent)
+	if err != nil {
+		return nil, err
+	} else if ok {
+		parent = entry.Hash
+	}
+	return func(e imageEntry) bool { return e.Parent == parent }, nil
+}
+
+func (queryOrder) compile(*imageDB) (imageFilter, error) {
+	return func(imageEntry) bool { return true }, nil
+}
+
+func (n queryNot) compile(db *imageDB) (imageFilter, error) {
+	f, err := n.x.compile(db)
+	if err != nil {
+		return nil, err
+	}
+	return func(e imageEntry) bool { return !f(e) }, nil
+}
+
+func (a queryAnd) compile(db *imageDB) (imageFilter, error) {
+	fs, err := compileAll(db, a)
+	if err != nil {
+		return nil, err
+	}
+	return func(e imageEntry) bool {
+		for _, f := range fs {
+			if !f(e) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func (o queryOr) compile(db *imageDB) (imageFilter, error) {
+	fs, err := compileAll(db, o)
+	if err != nil {
+		return nil, err
+	}
+	return func(e imageEntry) bool {
+		for _, f := range fs {
+			if f(e) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func compileAll(db *imageDB, xs []queryExpr) ([]imageFilter, error) {
+	fs := make([]imageFilter, len(xs))
+	for i, x := range xs {
+		f, err := x.compile(db)
+		if err != nil {
+			return nil, err
+		}
+		fs[i] = f
+	}
+	return fs, nil
+}
+
+// matchWildcard reports whether s matches pattern, in which each * stands
+// for any run of characters.
+func matchWildcard(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return s == pattern
+	} else if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// tokenizeQuery splits a search query into terms and the operators (, ) and
+// |. A - at the start of a term is returned as a separate token, so that
+// groups can be negated. Parentheses within a term, as in saber_(fate), are
+// part of it.
+func tokenizeQuery(query string) []string {
+	var tokens []string
+	var term strings.Builder
+	depth := 0 // of parentheses within term
+	flush := func() {
+		if term.Len() > 0 {
+			tokens = append(tokens, term.String())
+			term.Reset()
+		}
+		depth = 0
+	}
+	for _, c := range query {
+		switch {
+		case unicode.IsSpace(c):
+			flush()
+		case c == '|':
+			flush()
+			tokens = append(tokens, "|")
+		case c == '(' && term.Len() > 0:
+			depth++
+			term.WriteRune(c)
+		case c == ')' && depth > 0:
+			depth--
+			term.WriteRune(c)
+		case c == '(' || c == ')':
+			flush()
+			tokens = append(tokens, string(c))
+		case c == '-' && term.Len() == 0:
+			tokens = append(tokens, "-")
+		default:
+			term.WriteRune(c)
+		}
+	}
+	flush()
+	return tokens
+}
+
+// A queryParser parses a tokenized search query by recursive descent:
+//
+//	or   = and { "|" and }
+//	and  = not { not }
+//	not  = "-" not | "(" or ")" | term
+type queryParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *queryParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *queryParser) parseOr() (queryExpr, error) {
+	var or queryOr
+	for {
+		x, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		} else if x == nil {
+			if len(or) == 0 && p.peek() == ")" {
+				return nil, errQueryUnopened
+			}
+			return nil, errQueryDanglingOr
+		}
+		or = append(or, x)
+		if p.peek() != "|" {
+			break
+		}
+		p.pos++
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+// parseAnd returns nil if there are no terms before the next | or ).
+func (p *queryParser) parseAnd() (queryExpr, error) {
+	var and queryAnd
+	for tok := p.peek(); tok != "|" && tok != ")" && tok != ""; tok = p.peek() {
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, x)
+	}
+	switch len(and) {
+	case 0:
+		return nil, nil
+	case 1:
+		return and[0], nil
+	default:
+		return and, nil
+	}
+}
+
+func (p *queryParser) parseNot() (queryExpr, error) {
+	tok := p.peek()
+	p.pos++
+	switch tok {
+	case "-":
+		if next := p.peek(); next == "|" || next == ")" || next == "" {
+			return nil, errQueryDanglingNot
+		}
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return queryNot{x}, nil
+	case "(":
+		if p.peek() == ")" {
+			return nil, errQueryEmptyGroup
+		}
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		} else if p.peek() != ")" {
+			return nil, errQueryUnclosed
+		}
+		p.pos++
+		return x, nil
+	default:
+		return parseQueryTerm(tok)
+	}
+}
+
+// parseQueryTerm parses a single term of a search query: a metadata term,
+// as parsed by parseFilter, a pool:, parent: or order: term, or a tag, which
+// may contain wildcards. As when tagging, a category prefix on a tag is ignored.
+func parseQueryTerm(term string) (queryExpr, error) {
+	term = strings.ToLower(term)
+	if strings.HasPrefix(term, "pool:") {
+		name := strings.TrimPrefix(term, "pool:")
+		if !validPoolName(name) {
+			return nil, fmt.Errorf("invalid pool %q", name)
+		}
+		return queryPool(name), nil
+	} else if strings.HasPrefix(term, "parent:") && term != "parent:" {
+		return queryParent(strings.TrimPrefix(term, "parent:")), nil
+	} else if strings.HasPrefix(term, "order:") {
+		o, err := parseOrder(strings.TrimPrefix(term, "order:"))
+		return queryOrder(o), err
+	}
+	f, ok, err := parseFilter(term)
+	if err != nil {
+		return nil, err
+	} else if ok {
+		return queryMeta(f), nil
+	}
+	name, _, _ := splitTagCategory(term)
+	if i := strings.IndexByte(name, ':'); i > 0 && strings.IndexAny(name[i+1:], "<>") == 0 {
+		// almost certainly a misspelled metadata term, not a tag
+		return nil, fmt.Errorf("unknown search term %q", name[:i+1])
+	}
+	if strings.Contains(name, "*") {
+		return queryWildcard(name), nil
+	}
+	return queryTag(name), nil
+}
+
+// parseQueryExpr parses a search query. Terms separated by spaces must all
+// match, terms separated by | are alternatives, and parentheses group terms;
+// a - before a term or group negates it. An empty query parses as nil, which
+// matches every image.
+func parseQueryExpr(query string) (queryExpr, error) {
+	p := &queryParser{tokens: tokenizeQuery(query)}
+	if len(p.tokens) == 0 {
+		return nil, nil
+	}
+	x, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	} else if p.pos < len(p.tokens) {
+		// parseOr only stops early at an unmatched )
+		return nil, errQueryUnopened
+	}
+	return x, nil
+}
+
+// conjuncts returns the terms of x that must all match.
+func conjuncts(x queryExpr) []queryExpr {
+	if and, ok := x.(queryAnd); ok {
+		return and
+	} else if x != nil {
+		return []queryExpr{x}
+	}
+	return nil
+}
+
+// hasOrder reports whether x contains an order: term.
+func hasOrder(x queryExpr) bool {
+	switch x := x.(type) {
+	case queryOrder:
+		return true
+	case queryNot:
+		return hasOrder(x.x)
+	case queryAnd:
+		for _, c := range x {
+			if hasOrder(c) {
+				return true
+			}
+		}
+	case queryOr:
+		for _, c := range x {
+			if hasOrder(c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requiredTags returns the tags that every image matching x must have, and
+// those that none may have, which can be looked up in the tag index rather
+// than by testing every image.
+func requiredTags(x queryExpr) (include, exclude []string) {
+	for _, c := range conjuncts(x) {
+		switch c := c.(type) {
+		case queryTag:
+			include = append(include, string(c))
+		case queryNot:
+			if t, ok := c.x.(queryTag); ok {
+				exclude = append(exclude, string(t))
+			}
+		}
+	}
+	return include, exclude
+}
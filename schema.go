@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errSchemaTooNew = errors.New("database was written by a newer version of dispel")
+
+// schemaVersion is the version of the on-disk JSON format written by this
+// version of dispel. It must equal len(migrations).
+const schemaVersion = 4
+
+// A migration upgrades a JSON database from one schema version to the next.
+// Migrations operate on generic JSON objects rather than Go types, since the
+// types only describe the current version. Each function reports whether it
+// changed the object it was given.
+type migration struct {
+	desc string
+	// db is applied to the top-level snapshot object.
+	db func(obj map[string]interface{}) (bool, error)
+	// image is applied to every image entry, queue item and journaled
+	// entry; queue items embed imageEntry, so both share a layout.
+	image func(obj map[string]interface{}) (bool, error)
+}
+
+// migrations[i] upgrades version i to version i+1.
+var migrations = []migration{
+	{desc: "add schema version"},
+	{desc: "convert DateAdded to RFC 3339 timestamps", image: migrateDateAdded},
+	{desc: "add tag categories and counts"},
+	{desc: "add parent images"},
+}
+
+// legacyDateLayout is how DateAdded was formatted before schema version 2.
+// The zone was always written as "EST", whatever the server's zone actually
+// was, so such dates are read as local time.
+const legacyDateLayout = "Mon Jan 02 15:04:05 EST 2006"
+
+func migrateDateAdded(obj map[string]interface{}) (bool, error) {
+	s, ok := obj["DateAdded"].(string)
+	if !ok {
+		return false, nil
+	} else if s == "" {
+		// decodes as the zero time
+		delete(obj, "DateAdded")
+		return true, nil
+	}
+	t, err := time.ParseInLocation(legacyDateLayout, s, time.Local)
+	if err != nil {
+		return false, fmt.Errorf("image %v: unrecognized DateAdded %q", obj["Hash"], s)
+	}
+	obj["DateAdded"] = t.Format(time.RFC3339)
+	return true, nil
+}
+
+// A migrationReport describes the changes made by a single migration.
+type migrationReport struct {
+	From, To int
+	Desc     string
+	DB       bool
+	Images   int
+	Queue    int
+	Journal  int
+}
+
+func (r migrationReport) String() string {
+	return fmt.Sprintf("version %v -> %v (%v): snapshot changed: %v, images changed: %v, queue items changed: %v, journal entries changed: %v",
+		r.From, r.To, r.Desc, r.DB, r.Images, r.Queue, r.Journal)
+}
+
+// decodeJSONObject decodes b into a generic object, preserving numbers
+// exactly.
+func decodeJSONObject(b []byte) (map[string]interface{}, error) {
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	err := dec.Decode(&obj)
+	return obj, err
+}
+
+// docVersion returns the schema version of a snapshot object. Snapshots
+// written before versioning was introduced have no version field.
+func docVersion(doc map[string]interface{}) (int, error) {
+	v, ok := doc["Version"]
+	if !ok {
+		return 0, nil
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("invalid schema version %v", v)
+	}
+	i, err := n.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version %v", v)
+	}
+	if i > schemaVersion {
+		return 0, errSchemaTooNew
+	} else if i < 0 {
+		return 0, fmt.Errorf("invalid schema version %v", v)
+	}
+	return int(i), nil
+}
+
+// applyImageMigration applies fn to obj, if obj is a JSON object.
+func applyImageMigration(fn func(map[string]interface{}) (bool, error), obj interface{}) (bool, error) {
+	m, ok := obj.(map[string]interface{})
+	if fn == nil || !ok {
+		return false, nil
+	}
+	return fn(m)
+}
+
+// migrateDB upgrades a snapshot object, along with the journal entries
+// written against it, from version 'from' to schemaVersion. It returns a
+// report for each migration performed.
+func migrateDB(doc map[string]interface{}, journal []map[string]interface{}, from int) ([]migrationReport, error) {
+	var reports []migrationReport
+	for v := from; v < schemaVersion; v++ {
+		m := migrations[v]
+		r := migrationReport{From: v, To: v + 1, Desc: m.desc}
+		var err error
+		if m.db != nil {
+			if r.DB, err = m.db(doc); err != nil {
+				return nil, err
+			}
+		}
+		if images, ok := doc["Images"].(map[string]interface{}); ok {
+			for _, img := range images {
+				if changed, err := applyImageMigration(m.image, img); err != nil {
+					return nil, err
+				} else if changed {
+					r.Images++
+				}
+			}
+		}
+		if queue, ok := doc["Queue"].([]interface{}); ok {
+			for _, item := range queue {
+				if changed, err := applyImageMigration(m.image, item); err != nil {
+					return nil, err
+				} else if changed {
+					r.Queue++
+				}
+			}
+		}
+		for _, op := range journal {
+			changed := false
+			for _, key := range []string{"Image", "Item"} {
+				c, err := applyImageMigration(m.image, op[key])
+				if err != nil {
+					return nil, err
+				}
+				changed = changed || c
+			}
+			if changed {
+				r.Journal++
+			}
+		}
+		reports = append(reports, r)
+	}
+	doc["Version"] = schemaVersion
+	return reports, nil
+}
+
+// migrateImageJSON upgrades a single image entry or queue item written at
+// version 'from', as stored by the bolt and sqlite backends. It reports
+// whether anything changed.
+func migrateImageJSON(b []byte, from int) ([]byte, bool, error) {
+	obj, err := decodeJSONObject(b)
+	if err != nil {
+		return nil, false, err
+	}
+	changed := false
+	for v := from; v < schemaVersion; v++ {
+		c, err := applyImageMigration(migrations[v].image, obj)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = changed || c
+	}
+	if !changed {
+		return b, false, nil
+	}
+	b, err = json.Marshal(obj)
+	return b, true, err
+}
+
+// migrateJournalOp upgrades a single journal entry written at version 'from'.
+func migrateJournalOp(line []byte, from int) ([]byte, error) {
+	op, err := decodeJSONObject(line)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := migrateDB(make(map[string]interface{}), []map[string]interface{}{op}, from); err != nil {
+		return nil, err
+	}
+	return json.Marshal(op)
+}
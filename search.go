@@ -0,0 +1,355 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A dateRange is a half-open interval [from, to) of times. A zero bound is
+// unbounded.
+type dateRange struct {
+	from, to time.Time
+}
+
+// contains reports whether t lies within r. Images with no recorded date
+// match no range.
+func (r dateRange) contains(t time.Time) bool {
+	if t.IsZero() {
+		return false
+	}
+	return (r.from.IsZero() || !t.Before(r.from)) && (r.to.IsZero() || t.Before(r.to))
+}
+
+// parseDateRange parses the argument of a date: search term. A bare date
+// matches the whole year, month or day it names, e.g. 2025, 2025-03 or
+// 2025-03-14; a leading >, >=, < or <= matches everything after or before
+// that period. Dates are in the server's time zone.
+func parseDateRange(s string) (dateRange, error) {
+	var op string
+	for _, prefix := range []string{">=", "<=", ">", "<"} {
+		if strings.HasPrefix(s, prefix) {
+			op, s = prefix, s[len(prefix):]
+			break
+		}
+	}
+	var start, end time.Time
+	for _, p := range []struct {
+		layout           string
+		years, months, d int
+	}{
+		{"2006-01-02", 0, 0, 1},
+		{"2006-01", 0, 1, 0},
+		{"2006", 1, 0, 0},
+	} {
+		if t, err := time.ParseInLocation(p.layout, s, time.Local); err == nil {
+			start, end = t, t.AddDate(p.years, p.months, p.d)
+			break
+		}
+	}
+	if start.IsZero() {
+		return dateRange{}, fmt.Errorf("invalid date %q: expected YYYY, YYYY-MM or YYYY-MM-DD", s)
+	}
+	switch op {
+	case ">":
+		return dateRange{from: end}, nil
+	case ">=":
+		return dateRange{from: start}, nil
+	case "<":
+		return dateRange{to: start}, nil
+	case "<=":
+		return dateRange{to: end}, nil
+	default:
+		return dateRange{start, end}, nil
+	}
+}
+
+// An imageFilter is a search term that matches on an image's metadata
+// rather than its tags.
+type imageFilter func(imageEntry) bool
+
+// numericTerms are the search terms that compare a number, e.g. width:>1000.
+var numericTerms = map[string]func(imageEntry) int64{
+	"width":    func(e imageEntry) int64 { return int64(e.Width) },
+	"height":   func(e imageEntry) int64 { return int64(e.Height) },
+	"size":     func(e imageEntry) int64 { return e.Size },
+	"frames":   func(e imageEntry) int64 { return int64(e.Frames) },
+	"tagcount": func(e imageEntry) int64 { return int64(len(e.Tags)) },
+}
+
+// sizeSuffixes are the units accepted by numeric terms, e.g. size:>2mb.
+var sizeSuffixes = []struct {
+	suffix string
+	n      int64
+}{
+	{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+	{"k", 1 << 10}, {"m", 1 << 20}, {"g", 1 << 30},
+}
+
+// parseNumericFilter parses the argument of a numeric term: a number,
+// optionally preceded by >, >=, < or <= and followed by a size unit.
+func parseNumericFilter(key, s string, field func(imageEntry) int64) (imageFilter, error) {
+	var op string
+	for _, prefix := range []string{">=", "<=", ">", "<"} {
+		if strings.HasPrefix(s, prefix) {
+			op, s = prefix, s[len(prefix):]
+			break
+		}
+	}
+	mult := int64(1)
+	for _, u := range sizeSuffixes {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSuffix(s, u.suffix), u.n
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid %v %q: expected a number, optionally preceded by >, >=, < or <=", key, s)
+	}
+	n *= mult
+	return func(e imageEntry) bool {
+		v := field(e)
+		switch op {
+		case ">":
+			return v > n
+		case ">=":
+			return v >= n
+		case "<":
+			return v < n
+		case "<=":
+			return v <= n
+		default:
+			return v == n
+		}
+	}, nil
+}
+
+// parseFilter parses a metadata search term. It returns false if term is
+// not one, in which case it is a tag.
+func parseFilter(term string) (imageFilter, bool, error) {
+	i := strings.IndexByte(term, ':')
+	if i <= 0 || i == len(term)-1 {
+		return nil, false, nil
+	}
+	key, arg := strings.ToLower(term[:i]), strings.ToLower(term[i+1:])
+	if key == "date" {
+		r, err := parseDateRange(arg)
+		if err != nil {
+			return nil, true, err
+		}
+		return func(e imageEntry) bool { return r.contains(e.DateAdded) }, true, nil
+	} else if key == "format" {
+		if arg == "jpg" {
+			arg = "jpeg"
+		}
+		return func(e imageEntry) bool { return e.Format == arg }, true, nil
+	} else if key == "ext" {
+		ext := "." + strings.TrimPrefix(arg, ".")
+		return func(e imageEntry) bool { return strings.ToLower(e.Ext) == ext }, true, nil
+	} else if key == "hash" {
+		if strings.Trim(arg, "0123456789abcdef") != "" {
+			return nil, true, fmt.Errorf("invalid hash %q: expected hexadecimal digits", arg)
+		}
+		// a prefix of either hash
+		return func(e imageEntry) bool {
+			return strings.HasPrefix(e.Hash, arg) || (e.MD5 != "" && strings.HasPrefix(e.MD5, arg))
+		}, true, nil
+	} else if field, ok := numericTerms[key]; ok {
+		f, err := parseNumericFilter(key, arg, field)
+		return f, true, err
+	}
+	return nil, false, nil
+}
+
+// A searchQuery is a parsed search query.
+type searchQuery struct {
+	expr queryExpr
+	// the order of results; if unset, they are returned in the page order
+	// of pool, if any, and otherwise newest first
+	order searchOrder
+	pool  string
+}
+
+// parseQuery parses a search query, as described by parseQueryExpr. An
+// order: term sets the order of results; it may not be negated or grouped.
+// If the query requires a pool: term and has no order: term, results are
+// ordered by that pool's pages.
+func parseQuery(query string) (searchQuery, error) {
+	x, err := parseQueryExpr(query)
+	if err != nil {
+		return searchQuery{}, err
+	}
+	var q searchQuery
+	var rest queryAnd
+	for _, c := range conjuncts(x) {
+		switch c := c.(type) {
+		case queryOrder:
+			if q.order.By != "" {
+				return searchQuery{}, errors.New("only one order: term is allowed")
+			}
+			q.order = searchOrder(c)
+			continue
+		case queryPool:
+			if q.pool == "" {
+				q.pool = string(c)
+			}
+		}
+		rest = append(rest, c)
+	}
+	if hasOrder(rest) {
+		return searchQuery{}, errors.New("order: terms cannot be negated or grouped")
+	}
+	switch len(rest) {
+	case 0:
+	case 1:
+		q.expr = rest[0]
+	default:
+		q.expr = rest
+	}
+	return q, nil
+}
+
+// parseSearchRequest parses the search query t of req. The order and seed
+// parameters, as set by the search page, give the order of results if the
+// query does not.
+func parseSearchRequest(req *http.Request) (searchQuery, error) {
+	q, err := parseQuery(req.FormValue("t"))
+	if err != nil || q.order.By != "" || req.FormValue("order") == "" {
+		return q, err
+	}
+	order := req.FormValue("order")
+	if seed := req.FormValue("seed"); seed != "" && order == orderRandom {
+		order += ":" + seed
+	}
+	q.order, err = parseOrder(order)
+	return q, err
+}
+
+// compileQuery returns a filter matching the images selected by q.
+func (db *imageDB) compileQuery(q searchQuery) (imageFilter, error) {
+	if q.expr == nil {
+		return func(imageEntry) bool { return true }, nil
+	}
+	return q.expr.compile(db)
+}
+
+// search returns the images matching q, in order. Candidates are looked up
+// by the tags q requires, then tested against the whole query.
+func (db *imageDB) search(q searchQuery) ([]imageEntry, error) {
+	match, err := db.compileQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	imgs, err := db.lookupByTags(requiredTags(q.expr))
+	if err != nil {
+		return nil, err
+	}
+	imgs = filterImages(imgs, []imageFilter{match})
+	if q.order.By == "" && q.pool != "" {
+		pool, _, err := db.store.Pool(q.pool)
+		if err != nil {
+			return nil, err
+		}
+		order := make(map[string]int, len(pool.Pages))
+		for i, page := range pool.Pages {
+			order[page.Hash] = i
+		}
+		sort.Slice(imgs, func(i, j int) bool { return order[imgs[i].Hash] < order[imgs[j].Hash] })
+		return imgs, nil
+	}
+	var views map[string]int
+	if q.order.By == orderPopular {
+		if views, err = db.viewCounts(); err != nil {
+			return nil, err
+		}
+	}
+	sortImages(imgs, q.order, views)
+	return imgs, nil
+}
+
+// the number of search results shown per page, unless the size parameter
+// asks for a different number up to maxPageSize
+const (
+	defaultPageSize = 100
+	maxPageSize     = 500
+)
+
+// A resultPage is a page of search results.
+type resultPage struct {
+	Number int // counting from 1
+	Size   int
+	Total  int // results on every page
+}
+
+// parsePage parses the page and size parameters of req, which default to
+// the first page of defaultPageSize results.
+func parsePage(req *http.Request) (resultPage, error) {
+	p := resultPage{Number: 1, Size: defaultPageSize}
+	if s := req.FormValue("page"); s != "" {
+		if _, err := fmt.Sscan(s, &p.Number); err != nil || p.Number < 1 {
+			return resultPage{}, fmt.Errorf("invalid page number %q", s)
+		}
+	}
+	if s := req.FormValue("size"); s != "" {
+		if _, err := fmt.Sscan(s, &p.Size); err != nil || p.Size < 1 || p.Size > maxPageSize {
+			return resultPage{}, fmt.Errorf("invalid page size %q: expected 1 to %v", s, maxPageSize)
+		}
+	}
+	return p, nil
+}
+
+// Pages returns the number of pages the results span.
+func (p resultPage) Pages() int {
+	return (p.Total + p.Size - 1) / p.Size
+}
+
+// DefaultSize reports whether p has the default size.
+func (p resultPage) DefaultSize() bool {
+	return p.Size == defaultPageSize
+}
+
+// slice records the number of results in imgs, returning those on page p.
+func (p *resultPage) slice(imgs []imageEntry) []imageEntry {
+	p.Total = len(imgs)
+	if p.Number > p.Pages() {
+		// checked before multiplying, which could overflow
+		return nil
+	}
+	start := (p.Number - 1) * p.Size
+	end := start + p.Size
+	if end > len(imgs) {
+		end = len(imgs)
+	}
+	return imgs[start:end]
+}
+
+// pageURL returns the URL of page n of the search made by req, keeping its
+// other parameters.
+func pageURL(req *http.Request, n int) string {
+	v := req.URL.Query()
+	v.Set("page", fmt.Sprint(n))
+	return req.URL.Path + "?" + v.Encode()
+}
+
+// filterImages returns the images in imgs that match every filter.
+func filterImages(imgs []imageEntry, filters []imageFilter) []imageEntry {
+	if len(filters) == 0 {
+		return imgs
+	}
+	var filtered []imageEntry
+outer:
+	for _, entry := range imgs {
+		for _, f := range filters {
+			if !f(entry) {
+				continue outer
+			}
+		}
+		filtered = append(filtered, entry)
+	}
+	return filtered
+}
@@ -1,26 +1,45 @@
 package main
 
 import (
+	"crypto/md5"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 var port = flag.String("port", ":3000", "port the server will listen on")
 var adminIP = flag.String("admin", "127.0.0.1", "IP of the administrator")
+var trashRetention = flag.Duration("trash-retention", 30*24*time.Hour, "how long deleted images are kept in the trash")
+var storeType = flag.String("store", "json", "storage backend (json, bolt or sqlite)")
+var dbPath = flag.String("db", "", "path of the image database (default imagedb.<store>)")
+var numBackups = flag.Int("backups", defaultBackups, "number of database backups to keep")
+var useBitmaps = flag.Bool("bitmap-index", false, "index tags with compressed bitmaps, for faster searches of large json stores")
+var blobType = flag.String("blobs", "local", "where image files are kept (local or s3)")
+var s3Endpoint = flag.String("s3-endpoint", "http://localhost:9000", "URL of the S3-compatible server")
+var s3Bucket = flag.String("s3-bucket", "dispel", "S3 bucket holding image files")
+var s3Region = flag.String("s3-region", "us-east-1", "S3 region")
 
 func indexHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	http.Redirect(w, req, "/images", http.StatusMovedPermanently)
 }
 
+// remoteHost returns the host a request came from, without its port.
+func remoteHost(req *http.Request) string {
+	host, _, _ := net.SplitHostPort(req.RemoteAddr)
+	return host
+}
+
 func ipWhitelist(fn httprouter.Handle, whitelistedHost string) httprouter.Handle {
 	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-		host, _, _ := net.SplitHostPort(req.RemoteAddr)
-		if host == whitelistedHost {
+		if remoteHost(req) == whitelistedHost {
 			fn(w, req, ps)
 		} else {
 			http.Error(w, "Access denied, buttmunch. This action has been logged.", http.StatusForbidden)
@@ -29,25 +48,119 @@ func ipWhitelist(fn httprouter.Handle, whitelistedHost string) httprouter.Handle
 	}
 }
 
+// openStore opens the storage backend selected by the -store flag.
+func openStore() (Store, error) {
+	path := *dbPath
+	if path == "" {
+		path = "imagedb." + *storeType
+	}
+	s, err := newStore(*storeType, path)
+	if err != nil {
+		return nil, err
+	}
+	if js, ok := s.(*jsonStore); ok {
+		js.keepBackups = *numBackups
+		if *useBitmaps {
+			js.indexBitmaps()
+		}
+	}
+	return s, nil
+}
+
+// openBlobStore opens the file store selected by the -blobs flag. S3
+// credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func openBlobStore() (shardedBlobStore, error) {
+	switch *blobType {
+	case "local":
+		ls, err := newLocalBlobStore(".")
+		return shardedBlobStore{ls}, err
+	case "s3":
+		return shardedBlobStore{newS3BlobStore(*s3Endpoint, *s3Bucket, *s3Region,
+			os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))}, nil
+	default:
+		return shardedBlobStore{}, fmt.Errorf("unknown blob store type %q", *blobType)
+	}
+}
+
+// staticHandler serves stored images and thumbnails from the blob store, and
+// everything else under /static from disk. Images are served at both their
+// sharded and flat URLs, regardless of where they are stored.
+func (db *imageDB) staticHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	p := path.Clean(ps.ByName("filepath"))
+	for _, v := range []blobVariant{variantImage, variantThumb} {
+		prefix := strings.TrimPrefix(v.dir, "static") + "/"
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		name := strings.TrimPrefix(p, prefix)
+		hash, ext, ok := v.parse(name)
+		if !ok {
+			hash, ext, ok = v.flat().parse(name)
+		}
+		if ok {
+			if url, moved := db.rekeyedURL(v, hash, ext); moved {
+				http.Redirect(w, req, url, http.StatusMovedPermanently)
+				return
+			}
+			serveBlob(w, req, db.blobs, v, hash, ext)
+			return
+		}
+	}
+	staticFiles.ServeHTTP(w, req)
+}
+
+// rekeyedURL returns the new URL of a file requested by the MD5 hash of an
+// image that has since been rekeyed by SHA-256.
+func (db *imageDB) rekeyedURL(v blobVariant, hash, ext string) (string, bool) {
+	if len(hash) != md5.Size*2 {
+		return "", false
+	} else if ok, err := db.blobs.Exists(v, hash, ext); ok || err != nil {
+		return "", false
+	}
+	db.mu.RLock()
+	entry, ok, err := db.store.ImageByMD5(hash)
+	db.mu.RUnlock()
+	if err != nil || !ok {
+		return "", false
+	}
+	return "/" + v.path(entry.Hash, ext), true
+}
+
+var staticFiles = http.StripPrefix("/static", http.FileServer(http.Dir("static")))
+
 func main() {
 	flag.Parse()
 
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// open image DB
-	imgDB, err := newImageDB("imagedb.json")
+	store, err := openStore()
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
-
-	// ensure we have image+thumbnail+queue directories
-	dirs := []string{"static/images", "static/thumbnails", "queue"}
-	for _, d := range dirs {
-		err = os.MkdirAll(d, 0700)
+	defer store.Close()
+	blobs, err := openBlobStore()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	imgDB := newImageDB(store, blobs)
+	go func() {
+		n, err := imgDB.migrateHashes()
 		if err != nil {
-			log.Fatal(err)
-			return
+			log.Printf("Rekeying images by SHA-256 failed after %v images: %v", n, err)
+		} else if n > 0 {
+			log.Printf("Rekeyed %v images by SHA-256", n)
 		}
-	}
+	}()
+	go imgDB.purgeTrashEvery(time.Hour, *trashRetention)
+	go imgDB.flushViewsEvery(time.Minute)
 
 	router := httprouter.New()
 	router.GET("/", indexHandler)
@@ -59,12 +172,37 @@ func main() {
 	router.POST("/images/delete/:img", imgDB.imageDeleteHandlerPOST)
 	router.GET("/images/show/:img", imgDB.imageShowHandler)
 
+	router.GET("/pools", imgDB.poolListHandler)
+	router.GET("/pools/:name", imgDB.poolHandler)
+	router.POST("/pools/:name", imgDB.poolHandlerPOST)
+	router.GET("/pools/:name/edit", imgDB.poolEditHandler)
+
+	router.GET("/api/images", imgDB.apiSearchHandler)
+	router.GET("/api/images/:img", imgDB.apiImageHandler)
+
 	router.GET("/admin", ipWhitelist(imgDB.adminHandler, *adminIP))
 	router.GET("/admin/queue", ipWhitelist(imgDB.adminQueueHandler, *adminIP))
 	router.POST("/admin/queue", ipWhitelist(imgDB.adminQueueHandlerPOST, *adminIP))
 	router.GET("/admin/queue/:path", ipWhitelist(imgDB.adminQueueImg, *adminIP))
+	router.GET("/admin/backup", ipWhitelist(imgDB.adminBackupHandler, *adminIP))
+	router.GET("/admin/tags", ipWhitelist(imgDB.adminTagsHandler, *adminIP))
+	router.POST("/admin/tags", ipWhitelist(imgDB.adminTagsHandlerPOST, *adminIP))
+	router.POST("/admin/tags/:tag", ipWhitelist(imgDB.adminTagHandlerPOST, *adminIP))
+	router.GET("/admin/aliases", ipWhitelist(imgDB.adminAliasesHandler, *adminIP))
+	router.POST("/admin/aliases", ipWhitelist(imgDB.adminAliasesHandlerPOST, *adminIP))
+	router.POST("/admin/aliases/:alias/delete", ipWhitelist(imgDB.adminAliasDeleteHandlerPOST, *adminIP))
+	router.GET("/admin/implications", ipWhitelist(imgDB.adminImplicationsHandler, *adminIP))
+	router.POST("/admin/implications", ipWhitelist(imgDB.adminImplicationsHandlerPOST, *adminIP))
+	router.POST("/admin/implications/:tag/:implied/delete", ipWhitelist(imgDB.adminImplicationDeleteHandlerPOST, *adminIP))
+	router.POST("/admin/images/:img/revert", ipWhitelist(imgDB.adminRevertHandlerPOST, *adminIP))
+	router.GET("/admin/audit", ipWhitelist(imgDB.adminAuditHandler, *adminIP))
+	router.GET("/admin/audit.jsonl", ipWhitelist(imgDB.adminAuditExportHandler, *adminIP))
+	router.GET("/admin/trash", ipWhitelist(imgDB.adminTrashHandler, *adminIP))
+	router.GET("/admin/trash/:path", ipWhitelist(imgDB.adminTrashImg, *adminIP))
+	router.POST("/admin/trash/:path/restore", ipWhitelist(imgDB.adminTrashRestoreHandlerPOST, *adminIP))
+	router.POST("/admin/trash/:path/purge", ipWhitelist(imgDB.adminTrashPurgeHandlerPOST, *adminIP))
 
-	router.ServeFiles("/static/*filepath", http.Dir("static"))
+	router.GET("/static/*filepath", imgDB.staticHandler)
 
 	log.Println("Listening...")
 	err = http.ListenAndServe(*port, router)
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// defaultBackups is the number of snapshot backups retained unless
+// overridden.
+const defaultBackups = 5
+
+var errNoBackups = errors.New("no usable backups")
+
+// atomicWriteFile writes b to a temporary file alongside path, syncs it, and
+// renames it over path. A crash at any point leaves either the old or the new
+// contents, never a mixture.
+func atomicWriteFile(path string, b []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// sync the directory so that the rename itself is durable
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// copyFile atomically replaces dst with the contents of src.
+func copyFile(dst, src string) error {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return atomicWriteFile(dst, b)
+}
+
+// backupPaths returns the backups of the snapshot at path, oldest first.
+func backupPaths(path string) ([]string, error) {
+	paths, err := filepath.Glob(path + ".*.bak")
+	if err != nil {
+		return nil, err
+	}
+	// timestamps are fixed-width, so lexical order is chronological
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// writeBackup writes b as a timestamped backup of the snapshot at path, then
+// deletes all but the newest keep backups.
+func writeBackup(path string, b []byte, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	stamp := time.Now().UTC().Format("20060102T150405.000000000")
+	if err := atomicWriteFile(path+"."+stamp+".bak", b); err != nil {
+		return err
+	}
+	paths, err := backupPaths(path)
+	if err != nil {
+		return err
+	}
+	for len(paths) > keep {
+		if err := os.Remove(paths[0]); err != nil {
+			return err
+		}
+		paths = paths[1:]
+	}
+	return nil
+}
+
+// readSnapshot decodes the snapshot at path, migrating it to the current
+// schema version if necessary. A missing or empty file yields an empty store.
+func readSnapshot(path string) (*jsonStore, error) {
+	s := &jsonStore{
+		Tags:           make(map[string]tagEntry),
+		TagMeta:        make(map[string]tagInfo),
+		Images:         make(map[string]imageEntry),
+		Aliases:        make(map[string]string),
+		Implies:        make(map[string]stringSet),
+		Pools:          make(map[string]poolEntry),
+		History:        make(map[string][]revision),
+		Trashed:        make(map[string]trashEntry),
+		ViewCounts:     make(map[string]int),
+		md5Index:       make(map[string]string),
+		childIndex:     make(map[string]stringSet),
+		Version:        schemaVersion,
+		journalVersion: schemaVersion,
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	} else if len(bytes.TrimSpace(b)) == 0 {
+		return s, nil
+	}
+
+	doc, err := decodeJSONObject(b)
+	if err != nil {
+		return nil, err
+	}
+	from, err := docVersion(doc)
+	if err != nil {
+		return nil, err
+	}
+	if from < schemaVersion {
+		if _, err := migrateDB(doc, nil, from); err != nil {
+			return nil, err
+		}
+		if b, err = json.Marshal(doc); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	s.journalVersion = from
+	s.indexImages()
+	return s, nil
+}
+
+// indexImages builds the indexes of s that are not stored in the snapshot.
+// Afterwards, insertImage and deleteImage keep them current, so that reading
+// from s never writes to it.
+func (s *jsonStore) indexImages() {
+	for hash, entry := range s.Images {
+		if entry.MD5 != "" {
+			s.md5Index[entry.MD5] = hash
+		}
+		s.indexChild(entry)
+	}
+}
+
+// restoreBackup returns the newest backup of the snapshot at path that
+// decodes successfully.
+func restoreBackup(path string) (*jsonStore, error) {
+	paths, err := backupPaths(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(paths) - 1; i >= 0; i-- {
+		s, err := readSnapshot(paths[i])
+		if err != nil {
+			log.Printf("Backup %v is unusable: %v", paths[i], err)
+			continue
+		}
+		log.Printf("Restored database from backup %v", paths[i])
+		return s, nil
+	}
+	return nil, errNoBackups
+}
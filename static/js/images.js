@@ -1,8 +1,44 @@
 window.onload = function() {
-	// submit with enter key
-	searchbar.onkeydown = function(e) {
-		if (e.keyCode == 13){
-			location.href = './images?t=' + e.target.value;
-		}
+	// re-sort as soon as a new order is picked
+	order.onchange = function(e) {
+		e.target.form.submit();
 	};
-}
\ No newline at end of file
+
+	// in infinite scroll mode, the next page is appended to the list as its
+	// end comes into view
+	infinite.checked = localStorage.getItem('infinite') == 'true';
+	infinite.onchange = function() {
+		localStorage.setItem('infinite', infinite.checked);
+		loadNext();
+	};
+	window.onscroll = loadNext;
+	loadNext();
+}
+
+var loading = false;
+
+function loadNext() {
+	var next = document.getElementById('next');
+	if (!infinite.checked || loading || !next) {
+		return;
+	}
+	if (window.innerHeight + window.scrollY < document.body.offsetHeight - 800) {
+		return;
+	}
+	loading = true;
+	fetch(next.href).then(function(resp) {
+		return resp.text();
+	}).then(function(html) {
+		var page = new DOMParser().parseFromString(html, 'text/html');
+		var list = document.querySelector('.imagelist');
+		page.querySelectorAll('.imagelist > a').forEach(function(a) {
+			list.appendChild(a);
+		});
+		// the new page's links lead on from it
+		document.querySelector('.search-nav').replaceWith(page.querySelector('.search-nav'));
+		loading = false;
+		loadNext();
+	}).catch(function() {
+		loading = false;
+	});
+}
@@ -0,0 +1,198 @@
+package main
+
+import "fmt"
+
+// A Store is a storage backend for an imageDB. Stores are not required to
+// synchronize access themselves; the imageDB's mutex guards every call.
+//
+// Apart from LookupByTags, which resolves aliases itself so that backends can
+// do so as part of the query, tags passed to a Store have already had their
+// aliases expanded.
+type Store interface {
+	// Image returns the image with the given hash.
+	Image(hash string) (imageEntry, bool, error)
+	// ImageByMD5 returns the image whose MD5 field is md5.
+	ImageByMD5(md5 string) (imageEntry, bool, error)
+	// AddImage inserts an image, adding it to the index of each of its tags.
+	AddImage(entry imageEntry) error
+	// RemoveImage deletes an image, removing it from the index of each of
+	// its tags. Tags that no longer apply to any image are deleted.
+	RemoveImage(hash string) error
+	// Children returns the images whose Parent is hash.
+	Children(hash string) ([]imageEntry, error)
+	// ForEachImage calls fn on each image in the store, stopping at the
+	// first error.
+	ForEachImage(fn func(imageEntry) error) error
+	// LookupByTags returns the images that have all of include and none of
+	// exclude, after replacing any aliases among them with the tags they
+	// refer to.
+	LookupByTags(include, exclude []string) ([]imageEntry, error)
+
+	// Tag returns the tag with the given name.
+	Tag(name string) (tagEntry, bool, error)
+	// TagInfo returns the tag with the given name, without its Images.
+	TagInfo(name string) (tagEntry, bool, error)
+	// SetTagInfo sets the category and description of a tag.
+	SetTagInfo(name string, info tagInfo) error
+	// ForEachTag calls fn on each tag in the store, stopping at the first
+	// error.
+	ForEachTag(fn func(tagEntry) error) error
+	// MergeTag applies m in a single step: it replaces m.From with m.To on
+	// every image that has it, merging m.From's metadata into m.To's, then
+	// makes the alias and implication changes of m. If it fails, none of m
+	// is applied. Merging a tag into itself is a no-op.
+	MergeTag(m tagMerge) error
+	// RebuildTagIndex discards the tag index and rebuilds it from the tags
+	// of each image.
+	RebuildTagIndex() error
+
+	// Alias returns the tag that alias refers to.
+	Alias(alias string) (string, bool, error)
+	// SetAlias makes alias refer to tag.
+	SetAlias(alias, tag string) error
+	// RemoveAlias deletes an alias.
+	RemoveAlias(alias string) error
+	// ForEachAlias calls fn on each alias in the store, stopping at the
+	// first error.
+	ForEachAlias(fn func(alias, tag string) error) error
+
+	// Implications returns the tags that tag directly implies.
+	Implications(tag string) ([]string, error)
+	// AddImplication records that tag implies implied.
+	AddImplication(tag, implied string) error
+	// RemoveImplication deletes an implication.
+	RemoveImplication(tag, implied string) error
+	// ForEachImplication calls fn on each implication in the store,
+	// stopping at the first error.
+	ForEachImplication(fn func(tag, implied string) error) error
+
+	// Trash returns the deleted image with the given hash.
+	Trash(hash string) (trashEntry, bool, error)
+	// AddTrash adds a deleted image to the trash.
+	AddTrash(e trashEntry) error
+	// RemoveTrash removes an image from the trash.
+	RemoveTrash(hash string) error
+	// ForEachTrash calls fn on each image in the trash, stopping at the
+	// first error.
+	ForEachTrash(fn func(trashEntry) error) error
+
+	// Views returns the number of times an image has been viewed.
+	Views(hash string) (int, error)
+	// AddViews adds n to the view count of an image.
+	AddViews(hash string, n int) error
+	// RemoveViews deletes the view count of an image.
+	RemoveViews(hash string) error
+	// ForEachViews calls fn on the view count of each image that has been
+	// viewed, stopping at the first error.
+	ForEachViews(fn func(hash string, views int) error) error
+
+	// Revisions returns the tag history of an image, oldest first.
+	Revisions(hash string) ([]revision, error)
+	// AddRevision appends a revision to the history of rev.Hash.
+	AddRevision(rev revision) error
+	// RemoveRevisions deletes the history of an image.
+	RemoveRevisions(hash string) error
+	// ForEachRevision calls fn on each revision in the store, oldest first
+	// for each image, stopping at the first error.
+	ForEachRevision(fn func(revision) error) error
+
+	// AddAudit appends an entry to the audit log.
+	AddAudit(e auditEntry) error
+	// ForEachAudit calls fn on each entry in the audit log, oldest first,
+	// stopping at the first error.
+	ForEachAudit(fn func(auditEntry) error) error
+
+	// Pool returns the pool with the given name.
+	Pool(name string) (poolEntry, bool, error)
+	// SetPool creates or replaces a pool.
+	SetPool(pool poolEntry) error
+	// RemovePool deletes a pool.
+	RemovePool(name string) error
+	// ForEachPool calls fn on each pool in the store, stopping at the first
+	// error.
+	ForEachPool(fn func(poolEntry) error) error
+
+	// QueueItems returns the moderation queue, oldest first.
+	QueueItems() ([]queueItem, error)
+	// PushQueue appends an item to the queue.
+	PushQueue(item queueItem) error
+	// PopQueue removes the item at index from the queue.
+	PopQueue(index int) error
+
+	// Close flushes and releases the store.
+	Close() error
+}
+
+// copyStore copies the images, trash, view counts, tag metadata, aliases,
+// implications, pools, revisions, audit log and queue of src into dst. If dst
+// can import in bulk, it is left to do so.
+func copyStore(dst, src Store) error {
+	if im, ok := dst.(interface{ Import(Store) error }); ok {
+		return im.Import(src)
+	}
+	err := src.ForEachImage(dst.AddImage)
+	if err != nil {
+		return err
+	}
+	err = src.ForEachTag(func(tag tagEntry) error {
+		if tag.info() == (tagInfo{}) {
+			return nil
+		}
+		return dst.SetTagInfo(tag.Name, tag.info())
+	})
+	if err != nil {
+		return err
+	}
+	err = src.ForEachAlias(dst.SetAlias)
+	if err != nil {
+		return err
+	}
+	err = src.ForEachImplication(dst.AddImplication)
+	if err != nil {
+		return err
+	}
+	err = src.ForEachPool(dst.SetPool)
+	if err != nil {
+		return err
+	}
+	err = src.ForEachTrash(dst.AddTrash)
+	if err != nil {
+		return err
+	}
+	err = src.ForEachViews(dst.AddViews)
+	if err != nil {
+		return err
+	}
+	err = src.ForEachRevision(dst.AddRevision)
+	if err != nil {
+		return err
+	}
+	err = src.ForEachAudit(dst.AddAudit)
+	if err != nil {
+		return err
+	}
+	items, err := src.QueueItems()
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := dst.PushQueue(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newStore opens a Store of the given kind at path.
+func newStore(kind, path string) (Store, error) {
+	switch kind {
+	case "json":
+		return newJSONStore(path)
+	case "bolt":
+		return newBoltStore(path)
+	case "sqlite":
+		return newSQLiteStore(path)
+	default:
+		return nil, fmt.Errorf("unknown store type %q", kind)
+	}
+}
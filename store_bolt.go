@@ -0,0 +1,979 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketImages  = []byte("images")
+	bucketMD5     = []byte("md5")
+	bucketTags    = []byte("tags")
+	bucketTagInfo = []byte("taginfo")
+	bucketImplies = []byte("implications")
+	bucketParents = []byte("parents")
+	bucketPools   = []byte("pools")
+	bucketHistory = []byte("revisions")
+	bucketAudit   = []byte("audit")
+	bucketTrash   = []byte("trash")
+	bucketViews   = []byte("views")
+	bucketAliases = []byte("aliases")
+	bucketQueue   = []byte("queue")
+	bucketMeta    = []byte("meta")
+
+	// key in bucketMeta holding the schema version of stored entries
+	keyVersion = []byte("version")
+)
+
+// boltStore is a Store backed by an embedded bolt key-value database. Only
+// the data touched by a given call is held in memory.
+//
+// Images, pools and queue items are stored as JSON. Each tag is a nested bucket
+// within the tags bucket, whose keys are the hashes of its images. The md5
+// bucket maps the MD5 hash of each image that has one to its key. The taginfo
+// bucket holds each tag's metadata and image count, as a boltTagInfo. The
+// implications bucket, like the tags bucket, has a nested bucket per tag,
+// whose keys are the tags it implies, and the parents bucket has a nested
+// bucket per parent image, whose keys are the hashes of its children.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// boltTagInfo is the value stored for a tag in the taginfo bucket.
+type boltTagInfo struct {
+	tagInfo
+	Count int
+}
+
+func getTagInfo(tx *bolt.Tx, name []byte) (info boltTagInfo, err error) {
+	if b := tx.Bucket(bucketTagInfo).Get(name); b != nil {
+		err = json.Unmarshal(b, &info)
+	}
+	return
+}
+
+// putTagInfo stores info for a tag, or deletes it if it is empty.
+func putTagInfo(tx *bolt.Tx, name []byte, info boltTagInfo) error {
+	if info == (boltTagInfo{}) {
+		return tx.Bucket(bucketTagInfo).Delete(name)
+	}
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketTagInfo).Put(name, b)
+}
+
+// addTagCount adjusts the cached image count of a tag by delta.
+func addTagCount(tx *bolt.Tx, name []byte, delta int) error {
+	info, err := getTagInfo(tx, name)
+	if err != nil {
+		return err
+	}
+	info.Count += delta
+	return putTagInfo(tx, name, info)
+}
+
+// recountTags recomputes the cached image count of every tag from the tag
+// index.
+func recountTags(tx *bolt.Tx) error {
+	infos := tx.Bucket(bucketTagInfo)
+	var names [][]byte
+	if err := infos.ForEach(func(name, _ []byte) error {
+		names = append(names, append([]byte(nil), name...))
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, name := range names {
+		info, err := getTagInfo(tx, name)
+		if err != nil {
+			return err
+		}
+		info.Count = 0
+		if err := putTagInfo(tx, name, info); err != nil {
+			return err
+		}
+	}
+	tags := tx.Bucket(bucketTags)
+	return tags.ForEach(func(name, _ []byte) error {
+		info, err := getTagInfo(tx, name)
+		if err != nil {
+			return err
+		}
+		// Stats is unreliable for buckets created in this transaction
+		info.Count = 0
+		tags.Bucket(name).ForEach(func(_, _ []byte) error {
+			info.Count++
+			return nil
+		})
+		return putTagInfo(tx, name, info)
+	})
+}
+
+func getImage(tx *bolt.Tx, hash string) (entry imageEntry, ok bool, err error) {
+	b := tx.Bucket(bucketImages).Get([]byte(hash))
+	if b == nil {
+		return imageEntry{}, false, nil
+	}
+	err = json.Unmarshal(b, &entry)
+	return entry, err == nil, err
+}
+
+// Image implements Store.
+func (s *boltStore) Image(hash string) (entry imageEntry, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		entry, ok, err = getImage(tx, hash)
+		return err
+	})
+	return
+}
+
+// ImageByMD5 implements Store.
+func (s *boltStore) ImageByMD5(md5 string) (entry imageEntry, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		hash := tx.Bucket(bucketMD5).Get([]byte(md5))
+		if hash == nil {
+			return nil
+		}
+		entry, ok, err = getImage(tx, string(hash))
+		return err
+	})
+	return
+}
+
+// putChild records entry as a child of its parent, if it has one.
+func putChild(tx *bolt.Tx, entry imageEntry) error {
+	if entry.Parent == "" {
+		return nil
+	}
+	pb, err := tx.Bucket(bucketParents).CreateBucketIfNotExists([]byte(entry.Parent))
+	if err != nil {
+		return err
+	}
+	return pb.Put([]byte(entry.Hash), []byte{})
+}
+
+// Children implements Store.
+func (s *boltStore) Children(hash string) (imgs []imageEntry, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		pb := tx.Bucket(bucketParents).Bucket([]byte(hash))
+		if pb == nil {
+			return nil
+		}
+		return pb.ForEach(func(child, _ []byte) error {
+			entry, ok, err := getImage(tx, string(child))
+			if ok {
+				imgs = append(imgs, entry)
+			}
+			return err
+		})
+	})
+	return
+}
+
+// AddImage implements Store.
+func (s *boltStore) AddImage(entry imageEntry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		images := tx.Bucket(bucketImages)
+		if images.Get([]byte(entry.Hash)) != nil {
+			return errImageExists
+		}
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if err := images.Put([]byte(entry.Hash), b); err != nil {
+			return err
+		}
+		if entry.MD5 != "" {
+			if err := tx.Bucket(bucketMD5).Put([]byte(entry.MD5), []byte(entry.Hash)); err != nil {
+				return err
+			}
+		}
+		if err := putChild(tx, entry); err != nil {
+			return err
+		}
+		for tag := range entry.Tags {
+			// create tag if it does not already exist
+			tb, err := tx.Bucket(bucketTags).CreateBucketIfNotExists([]byte(tag))
+			if err != nil {
+				return err
+			}
+			// add image to tag
+			if err := tb.Put([]byte(entry.Hash), []byte{}); err != nil {
+				return err
+			}
+			if err := addTagCount(tx, []byte(tag), 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RemoveImage implements Store.
+func (s *boltStore) RemoveImage(hash string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		entry, ok, err := getImage(tx, hash)
+		if err != nil {
+			return err
+		} else if !ok {
+			return errImageNotExists
+		}
+		// delete tags
+		tags := tx.Bucket(bucketTags)
+		for tag := range entry.Tags {
+			tb := tags.Bucket([]byte(tag))
+			if tb == nil {
+				continue
+			}
+			if err := tb.Delete([]byte(hash)); err != nil {
+				return err
+			}
+			if err := addTagCount(tx, []byte(tag), -1); err != nil {
+				return err
+			}
+			if k, _ := tb.Cursor().First(); k == nil {
+				if err := tags.DeleteBucket([]byte(tag)); err != nil {
+					return err
+				}
+			}
+		}
+		// delete image entry
+		if entry.MD5 != "" {
+			if err := tx.Bucket(bucketMD5).Delete([]byte(entry.MD5)); err != nil {
+				return err
+			}
+		}
+		if pb := tx.Bucket(bucketParents).Bucket([]byte(entry.Parent)); pb != nil {
+			if err := pb.Delete([]byte(hash)); err != nil {
+				return err
+			}
+			if k, _ := pb.Cursor().First(); k == nil {
+				if err := tx.Bucket(bucketParents).DeleteBucket([]byte(entry.Parent)); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Bucket(bucketImages).Delete([]byte(hash))
+	})
+}
+
+// ForEachImage implements Store.
+func (s *boltStore) ForEachImage(fn func(imageEntry) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketImages).ForEach(func(_, v []byte) error {
+			var entry imageEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			return fn(entry)
+		})
+	})
+}
+
+// LookupByTags implements Store.
+func (s *boltStore) LookupByTags(include, exclude []string) (imgs []imageEntry, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		// expand tag aliases
+		aliases := tx.Bucket(bucketAliases)
+		for _, tags := range [][]string{include, exclude} {
+			for i, tag := range tags {
+				if alias := aliases.Get([]byte(tag)); alias != nil {
+					tags[i] = string(alias)
+				}
+			}
+		}
+
+		// if no include tags are supplied, filter the entire database
+		if len(include) == 0 {
+			return tx.Bucket(bucketImages).ForEach(func(_, v []byte) error {
+				var entry imageEntry
+				if err := json.Unmarshal(v, &entry); err != nil {
+					return err
+				}
+				if entry.missingTags(exclude) {
+					imgs = append(imgs, entry)
+				}
+				return nil
+			})
+		}
+
+		// Get initial set by querying the rarest tag, so that as few images
+		// as possible are read. Then, of these, filter out those that do
+		// not contain all of include and none of exclude.
+		rarest, fewest := include[0], -1
+		for _, tag := range include {
+			info, err := getTagInfo(tx, []byte(tag))
+			if err != nil {
+				return err
+			}
+			if fewest < 0 || info.Count < fewest {
+				rarest, fewest = tag, info.Count
+			}
+		}
+		tb := tx.Bucket(bucketTags).Bucket([]byte(rarest))
+		if tb == nil {
+			return nil
+		}
+		return tb.ForEach(func(hash, _ []byte) error {
+			entry, _, err := getImage(tx, string(hash))
+			if err != nil {
+				return err
+			}
+			if entry.hasTags(include) && entry.missingTags(exclude) {
+				imgs = append(imgs, entry)
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// readTag reads a tag, including its images if withImages is set. It returns
+// false if the tag does not exist.
+func readTag(tx *bolt.Tx, name []byte, withImages bool) (tagEntry, bool, error) {
+	info, err := getTagInfo(tx, name)
+	if err != nil {
+		return tagEntry{}, false, err
+	}
+	tag := tagEntry{
+		Name:        string(name),
+		Category:    info.Category,
+		Description: info.Description,
+		Count:       info.Count,
+	}
+	if withImages {
+		tag.Images = make(stringSet)
+		if tb := tx.Bucket(bucketTags).Bucket(name); tb != nil {
+			tb.ForEach(func(hash, _ []byte) error {
+				tag.Images[string(hash)] = struct{}{}
+				return nil
+			})
+		}
+	}
+	return tag, info != (boltTagInfo{}), nil
+}
+
+// Tag implements Store.
+func (s *boltStore) Tag(name string) (tag tagEntry, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		tag, ok, err = readTag(tx, []byte(name), true)
+		return err
+	})
+	return
+}
+
+// TagInfo implements Store.
+func (s *boltStore) TagInfo(name string) (tag tagEntry, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		tag, ok, err = readTag(tx, []byte(name), false)
+		return err
+	})
+	return
+}
+
+// SetTagInfo implements Store.
+func (s *boltStore) SetTagInfo(name string, info tagInfo) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		cur, err := getTagInfo(tx, []byte(name))
+		if err != nil {
+			return err
+		}
+		cur.tagInfo = info
+		return putTagInfo(tx, []byte(name), cur)
+	})
+}
+
+// ForEachTag implements Store. Every tag with images has a taginfo entry,
+// since it holds the tag's count.
+func (s *boltStore) ForEachTag(fn func(tagEntry) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTagInfo).ForEach(func(name, _ []byte) error {
+			tag, _, err := readTag(tx, name, true)
+			if err != nil {
+				return err
+			}
+			return fn(tag)
+		})
+	})
+}
+
+// MergeTag implements Store.
+func (s *boltStore) MergeTag(m tagMerge) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := renameTag(tx, m.From, m.To); err != nil {
+			return err
+		}
+		for alias, tag := range m.Aliases {
+			if err := tx.Bucket(bucketAliases).Put([]byte(alias), []byte(tag)); err != nil {
+				return err
+			}
+		}
+		for _, imp := range m.RemoveImplications {
+			if err := removeImplication(tx, imp.Tag, imp.Implied); err != nil {
+				return err
+			}
+		}
+		for _, imp := range m.AddImplications {
+			if err := addImplication(tx, imp.Tag, imp.Implied); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// renameTag replaces the tag from with to within tx, merging from's metadata
+// into to's. Renaming a tag to itself does nothing.
+func renameTag(tx *bolt.Tx, from, to string) error {
+	if from == to {
+		return nil
+	}
+	tags := tx.Bucket(bucketTags)
+	if fb := tags.Bucket([]byte(from)); fb != nil {
+		tb, err := tags.CreateBucketIfNotExists([]byte(to))
+		if err != nil {
+			return err
+		}
+		var hashes []string
+		fb.ForEach(func(hash, _ []byte) error {
+			hashes = append(hashes, string(hash))
+			return nil
+		})
+		for _, hash := range hashes {
+			entry, _, err := getImage(tx, hash)
+			if err != nil {
+				return err
+			}
+			b, err := json.Marshal(entry.renameTag(from, to))
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketImages).Put([]byte(hash), b); err != nil {
+				return err
+			}
+			if tb.Get([]byte(hash)) == nil {
+				if err := tb.Put([]byte(hash), []byte{}); err != nil {
+					return err
+				}
+				if err := addTagCount(tx, []byte(to), 1); err != nil {
+					return err
+				}
+			}
+		}
+		if err := tags.DeleteBucket([]byte(from)); err != nil {
+			return err
+		}
+	}
+	old, err := getTagInfo(tx, []byte(from))
+	if err != nil {
+		return err
+	}
+	cur, err := getTagInfo(tx, []byte(to))
+	if err != nil {
+		return err
+	}
+	cur.tagInfo = mergeTagInfo(cur.tagInfo, old.tagInfo)
+	if err := putTagInfo(tx, []byte(to), cur); err != nil {
+		return err
+	}
+	return putTagInfo(tx, []byte(from), boltTagInfo{})
+}
+
+// RebuildTagIndex implements Store.
+func (s *boltStore) RebuildTagIndex() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(bucketTags); err != nil {
+			return err
+		}
+		tags, err := tx.CreateBucket(bucketTags)
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(bucketImages).ForEach(func(hash, v []byte) error {
+			var entry imageEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			for tag := range entry.Tags {
+				tb, err := tags.CreateBucketIfNotExists([]byte(tag))
+				if err != nil {
+					return err
+				}
+				if err := tb.Put(hash, []byte{}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return recountTags(tx)
+	})
+}
+
+// Alias implements Store.
+func (s *boltStore) Alias(alias string) (tag string, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucketAliases).Get([]byte(alias)); b != nil {
+			tag, ok = string(b), true
+		}
+		return nil
+	})
+	return
+}
+
+// SetAlias implements Store.
+func (s *boltStore) SetAlias(alias, tag string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAliases).Put([]byte(alias), []byte(tag))
+	})
+}
+
+// RemoveAlias implements Store.
+func (s *boltStore) RemoveAlias(alias string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAliases).Delete([]byte(alias))
+	})
+}
+
+// ForEachAlias implements Store.
+func (s *boltStore) ForEachAlias(fn func(alias, tag string) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAliases).ForEach(func(k, v []byte) error {
+			return fn(string(k), string(v))
+		})
+	})
+}
+
+// Implications implements Store.
+func (s *boltStore) Implications(tag string) (implied []string, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		ib := tx.Bucket(bucketImplies).Bucket([]byte(tag))
+		if ib == nil {
+			return nil
+		}
+		return ib.ForEach(func(k, _ []byte) error {
+			implied = append(implied, string(k))
+			return nil
+		})
+	})
+	return
+}
+
+// AddImplication implements Store.
+func (s *boltStore) AddImplication(tag, implied string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return addImplication(tx, tag, implied)
+	})
+}
+
+// RemoveImplication implements Store.
+func (s *boltStore) RemoveImplication(tag, implied string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return removeImplication(tx, tag, implied)
+	})
+}
+
+// addImplication records that tag implies implied.
+func addImplication(tx *bolt.Tx, tag, implied string) error {
+	ib, err := tx.Bucket(bucketImplies).CreateBucketIfNotExists([]byte(tag))
+	if err != nil {
+		return err
+	}
+	return ib.Put([]byte(implied), []byte{})
+}
+
+// removeImplication deletes an implication, and the bucket of tag's
+// implications if it is left empty.
+func removeImplication(tx *bolt.Tx, tag, implied string) error {
+	implies := tx.Bucket(bucketImplies)
+	ib := implies.Bucket([]byte(tag))
+	if ib == nil {
+		return nil
+	}
+	if err := ib.Delete([]byte(implied)); err != nil {
+		return err
+	}
+	if k, _ := ib.Cursor().First(); k == nil {
+		return implies.DeleteBucket([]byte(tag))
+	}
+	return nil
+}
+
+// ForEachImplication implements Store.
+func (s *boltStore) ForEachImplication(fn func(tag, implied string) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		implies := tx.Bucket(bucketImplies)
+		return implies.ForEach(func(tag, _ []byte) error {
+			return implies.Bucket(tag).ForEach(func(implied, _ []byte) error {
+				return fn(string(tag), string(implied))
+			})
+		})
+	})
+}
+
+// Trash implements Store.
+func (s *boltStore) Trash(hash string) (e trashEntry, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketTrash).Get([]byte(hash))
+		if b == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(b, &e)
+	})
+	return
+}
+
+// AddTrash implements Store.
+func (s *boltStore) AddTrash(e trashEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTrash).Put([]byte(e.Hash), b)
+	})
+}
+
+// RemoveTrash implements Store.
+func (s *boltStore) RemoveTrash(hash string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTrash).Delete([]byte(hash))
+	})
+}
+
+// ForEachTrash implements Store.
+func (s *boltStore) ForEachTrash(fn func(trashEntry) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTrash).ForEach(func(_, v []byte) error {
+			var e trashEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			return fn(e)
+		})
+	})
+}
+
+// Views implements Store.
+func (s *boltStore) Views(hash string) (n int, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucketViews).Get([]byte(hash)); b != nil {
+			n = int(binary.BigEndian.Uint64(b))
+		}
+		return nil
+	})
+	return
+}
+
+// AddViews implements Store.
+func (s *boltStore) AddViews(hash string, n int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		views := tx.Bucket(bucketViews)
+		var total uint64
+		if b := views.Get([]byte(hash)); b != nil {
+			total = binary.BigEndian.Uint64(b)
+		}
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, total+uint64(n))
+		return views.Put([]byte(hash), b)
+	})
+}
+
+// RemoveViews implements Store.
+func (s *boltStore) RemoveViews(hash string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketViews).Delete([]byte(hash))
+	})
+}
+
+// ForEachViews implements Store.
+func (s *boltStore) ForEachViews(fn func(hash string, views int) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketViews).ForEach(func(k, v []byte) error {
+			return fn(string(k), int(binary.BigEndian.Uint64(v)))
+		})
+	})
+}
+
+// Revisions implements Store.
+func (s *boltStore) Revisions(hash string) (revs []revision, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		rb := tx.Bucket(bucketHistory).Bucket([]byte(hash))
+		if rb == nil {
+			return nil
+		}
+		return rb.ForEach(func(_, v []byte) error {
+			var rev revision
+			if err := json.Unmarshal(v, &rev); err != nil {
+				return err
+			}
+			revs = append(revs, rev)
+			return nil
+		})
+	})
+	return
+}
+
+// AddRevision implements Store.
+func (s *boltStore) AddRevision(rev revision) error {
+	b, err := json.Marshal(rev)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		rb, err := tx.Bucket(bucketHistory).CreateBucketIfNotExists([]byte(rev.Hash))
+		if err != nil {
+			return err
+		}
+		// as in the queue, keys are big-endian sequence numbers
+		seq, err := rb.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return rb.Put(key, b)
+	})
+}
+
+// RemoveRevisions implements Store.
+func (s *boltStore) RemoveRevisions(hash string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(bucketHistory).DeleteBucket([]byte(hash))
+		if err == bolt.ErrBucketNotFound {
+			err = nil
+		}
+		return err
+	})
+}
+
+// ForEachRevision implements Store.
+func (s *boltStore) ForEachRevision(fn func(revision) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		history := tx.Bucket(bucketHistory)
+		return history.ForEach(func(hash, _ []byte) error {
+			return history.Bucket(hash).ForEach(func(_, v []byte) error {
+				var rev revision
+				if err := json.Unmarshal(v, &rev); err != nil {
+					return err
+				}
+				return fn(rev)
+			})
+		})
+	})
+}
+
+// AddAudit implements Store.
+func (s *boltStore) AddAudit(e auditEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		audit := tx.Bucket(bucketAudit)
+		seq, err := audit.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return audit.Put(key, b)
+	})
+}
+
+// ForEachAudit implements Store.
+func (s *boltStore) ForEachAudit(fn func(auditEntry) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAudit).ForEach(func(_, v []byte) error {
+			var e auditEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			return fn(e)
+		})
+	})
+}
+
+// Pool implements Store.
+func (s *boltStore) Pool(name string) (pool poolEntry, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketPools).Get([]byte(name))
+		if b == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(b, &pool)
+	})
+	return
+}
+
+// SetPool implements Store.
+func (s *boltStore) SetPool(pool poolEntry) error {
+	b, err := json.Marshal(pool)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketPools).Put([]byte(pool.Name), b)
+	})
+}
+
+// RemovePool implements Store.
+func (s *boltStore) RemovePool(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketPools).Delete([]byte(name))
+	})
+}
+
+// ForEachPool implements Store.
+func (s *boltStore) ForEachPool(fn func(poolEntry) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketPools).ForEach(func(_, v []byte) error {
+			var pool poolEntry
+			if err := json.Unmarshal(v, &pool); err != nil {
+				return err
+			}
+			return fn(pool)
+		})
+	})
+}
+
+// QueueItems implements Store.
+func (s *boltStore) QueueItems() (items []queueItem, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketQueue).ForEach(func(_, v []byte) error {
+			var item queueItem
+			if err := json.Unmarshal(v, &item); err != nil {
+				return err
+			}
+			items = append(items, item)
+			return nil
+		})
+	})
+	return
+}
+
+// PushQueue implements Store.
+func (s *boltStore) PushQueue(item queueItem) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		queue := tx.Bucket(bucketQueue)
+		// keys are big-endian sequence numbers, so iteration order is
+		// insertion order
+		seq, err := queue.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		b, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		return queue.Put(key, b)
+	})
+}
+
+// PopQueue implements Store.
+func (s *boltStore) PopQueue(index int) error {
+	if index < 0 {
+		return errBadQueueIndex
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketQueue).Cursor()
+		k, _ := c.First()
+		for i := 0; i < index && k != nil; i++ {
+			k, _ = c.Next()
+		}
+		if k == nil {
+			return errBadQueueIndex
+		}
+		return c.Delete()
+	})
+}
+
+// Close implements Store.
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// migrateBolt upgrades the stored images and queue items to the current
+// schema version. Databases that predate versioning are at version 0.
+func migrateBolt(tx *bolt.Tx) error {
+	meta := tx.Bucket(bucketMeta)
+	var from int
+	if b := meta.Get(keyVersion); b != nil {
+		from = int(binary.BigEndian.Uint64(b))
+	}
+	if from > schemaVersion {
+		return errSchemaTooNew
+	} else if from == schemaVersion {
+		return nil
+	}
+	for _, name := range [][]byte{bucketImages, bucketQueue} {
+		bucket := tx.Bucket(name)
+		// collect first; a bucket must not be modified while iterating
+		updates := make(map[string][]byte)
+		err := bucket.ForEach(func(k, v []byte) error {
+			b, changed, err := migrateImageJSON(v, from)
+			if changed {
+				updates[string(k)] = b
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for k, b := range updates {
+			if err := bucket.Put([]byte(k), b); err != nil {
+				return err
+			}
+		}
+	}
+	// counts were not kept before version 3
+	if err := recountTags(tx); err != nil {
+		return err
+	}
+	// nor parents before version 4
+	err := tx.Bucket(bucketImages).ForEach(func(_, v []byte) error {
+		var entry imageEntry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			return err
+		}
+		return putChild(tx, entry)
+	})
+	if err != nil {
+		return err
+	}
+	version := make([]byte, 8)
+	binary.BigEndian.PutUint64(version, schemaVersion)
+	return meta.Put(keyVersion, version)
+}
+
+func newBoltStore(dbpath string) (*boltStore, error) {
+	db, err := bolt.Open(dbpath, 0666, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketImages, bucketMD5, bucketTags, bucketTagInfo, bucketAliases, bucketImplies, bucketParents, bucketPools, bucketHistory, bucketAudit, bucketTrash, bucketViews, bucketQueue, bucketMeta} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return migrateBolt(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+// jsonStore is a Store held entirely in memory. It is persisted as a JSON
+// snapshot plus an append-only journal of mutations since that snapshot.
+type jsonStore struct {
+	Tags    map[string]tagEntry
+	TagMeta map[string]tagInfo `json:",omitempty"`
+	Images  map[string]imageEntry
+	Aliases map[string]string
+	// tag -> tags it implies
+	Implies map[string]stringSet `json:",omitempty"`
+	Pools   map[string]poolEntry `json:",omitempty"`
+	// image hash -> revisions, oldest first
+	History map[string][]revision `json:",omitempty"`
+	Audit   []auditEntry          `json:",omitempty"`
+	Trashed map[string]trashEntry `json:",omitempty"`
+	// image hash -> number of views
+	ViewCounts map[string]int `json:",omitempty"`
+
+	Queue []queueItem
+
+	// sequence number of the last applied journal op
+	Seq uint64
+	// schema version of the snapshot format
+	Version int
+
+	// MD5 hash -> image hash, built when the snapshot is read
+	md5Index map[string]string
+	// parent hash -> child hashes, built when the snapshot is read
+	childIndex map[string]stringSet
+	// tags as bitmaps, if built by indexBitmaps
+	bitmaps *bitmapIndex
+
+	path        string
+	keepBackups int
+	journal     *os.File
+	journalLen  int
+	// schema version the journal's entries were written at
+	journalVersion int
+}
+
+// Image implements Store.
+func (s *jsonStore) Image(hash string) (imageEntry, bool, error) {
+	entry, ok := s.Images[hash]
+	return entry, ok, nil
+}
+
+// ImageByMD5 implements Store.
+func (s *jsonStore) ImageByMD5(md5 string) (imageEntry, bool, error) {
+	hash, ok := s.md5Index[md5]
+	if !ok {
+		return imageEntry{}, false, nil
+	}
+	return s.Image(hash)
+}
+
+// Children implements Store.
+func (s *jsonStore) Children(hash string) (imgs []imageEntry, err error) {
+	for child := range s.childIndex[hash] {
+		imgs = append(imgs, s.Images[child])
+	}
+	sort.Slice(imgs, func(i, j int) bool { return imgs[i].Hash < imgs[j].Hash })
+	return imgs, nil
+}
+
+// indexBitmaps builds a bitmap index of the images' tags, which LookupByTags
+// uses from then on. It must be called before s is shared, since lookups only
+// take db.mu for reading.
+func (s *jsonStore) indexBitmaps() {
+	s.bitmaps = newBitmapIndex()
+	for hash, entry := range s.Images {
+		s.bitmaps.add(hash, entry.Tags)
+	}
+}
+
+func (s *jsonStore) indexChild(entry imageEntry) {
+	if entry.Parent == "" {
+		return
+	}
+	if s.childIndex[entry.Parent] == nil {
+		s.childIndex[entry.Parent] = make(stringSet)
+	}
+	s.childIndex[entry.Parent][entry.Hash] = struct{}{}
+}
+
+// AddImage implements Store.
+func (s *jsonStore) AddImage(entry imageEntry) error {
+	if _, ok := s.Images[entry.Hash]; ok {
+		return errImageExists
+	}
+	return s.commit(journalOp{Op: opAddImage, Image: &entry})
+}
+
+// RemoveImage implements Store.
+func (s *jsonStore) RemoveImage(hash string) error {
+	return s.commit(journalOp{Op: opRemoveImage, Hash: hash})
+}
+
+// ForEachImage implements Store.
+func (s *jsonStore) ForEachImage(fn func(imageEntry) error) error {
+	for _, entry := range s.Images {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LookupByTags implements Store.
+func (s *jsonStore) LookupByTags(include, exclude []string) (imgs []imageEntry, err error) {
+	// expand tag aliases
+	for _, tags := range [][]string{include, exclude} {
+		for i, tag := range tags {
+			if alias, ok := s.Aliases[tag]; ok {
+				tags[i] = alias
+			}
+		}
+	}
+
+	if s.bitmaps != nil {
+		hashes := s.bitmaps.lookup(include, exclude)
+		imgs = make([]imageEntry, len(hashes))
+		for i, hash := range hashes {
+			imgs[i] = s.Images[hash]
+		}
+		return
+	}
+
+	// if no include tags are supplied, filter the entire database
+	if len(include) == 0 {
+		for _, entry := range s.Images {
+			if entry.missingTags(exclude) {
+				imgs = append(imgs, entry)
+			}
+		}
+		return
+	}
+
+	// Get initial set by querying the rarest tag, so that as few images as
+	// possible are checked. Then, of these, filter out those that do not
+	// contain all of include and none of exclude.
+	rarest := include[0]
+	for _, tag := range include[1:] {
+		if len(s.Tags[tag].Images) < len(s.Tags[rarest].Images) {
+			rarest = tag
+		}
+	}
+	for url := range s.Tags[rarest].Images {
+		entry := s.Images[url]
+		if entry.hasTags(include) && entry.missingTags(exclude) {
+			imgs = append(imgs, entry)
+		}
+	}
+	return
+}
+
+// Tag implements Store.
+func (s *jsonStore) Tag(name string) (tagEntry, bool, error) {
+	tag, ok := s.Tags[name]
+	info, hasInfo := s.TagMeta[name]
+	tag.Name = name
+	tag.Category, tag.Description = info.Category, info.Description
+	tag.Count = len(tag.Images)
+	if tag.Images == nil {
+		tag.Images = make(stringSet)
+	}
+	return tag, ok || hasInfo, nil
+}
+
+// TagInfo implements Store.
+func (s *jsonStore) TagInfo(name string) (tagEntry, bool, error) {
+	tag, ok, err := s.Tag(name)
+	tag.Images = nil
+	return tag, ok, err
+}
+
+// SetTagInfo implements Store.
+func (s *jsonStore) SetTagInfo(name string, info tagInfo) error {
+	return s.commit(journalOp{Op: opSetTagInfo, Tag: name, Info: &info})
+}
+
+// ForEachTag implements Store.
+func (s *jsonStore) ForEachTag(fn func(tagEntry) error) error {
+	for name := range s.Tags {
+		tag, _, _ := s.Tag(name)
+		if err := fn(tag); err != nil {
+			return err
+		}
+	}
+	// tags with no images
+	for name := range s.TagMeta {
+		if _, ok := s.Tags[name]; ok {
+			continue
+		}
+		tag, _, _ := s.Tag(name)
+		if err := fn(tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MergeTag implements Store.
+func (s *jsonStore) MergeTag(m tagMerge) error {
+	return s.commit(journalOp{Op: opMergeTag, Merge: &m})
+}
+
+// RebuildTagIndex implements Store.
+func (s *jsonStore) RebuildTagIndex() error {
+	return s.commit(journalOp{Op: opRebuildTags})
+}
+
+// Alias implements Store.
+func (s *jsonStore) Alias(alias string) (string, bool, error) {
+	tag, ok := s.Aliases[alias]
+	return tag, ok, nil
+}
+
+// SetAlias implements Store.
+func (s *jsonStore) SetAlias(alias, tag string) error {
+	return s.commit(journalOp{Op: opSetAlias, Alias: alias, Tag: tag})
+}
+
+// RemoveAlias implements Store.
+func (s *jsonStore) RemoveAlias(alias string) error {
+	return s.commit(journalOp{Op: opRemoveAlias, Alias: alias})
+}
+
+// ForEachAlias implements Store.
+func (s *jsonStore) ForEachAlias(fn func(alias, tag string) error) error {
+	for alias, tag := range s.Aliases {
+		if err := fn(alias, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Implications implements Store.
+func (s *jsonStore) Implications(tag string) ([]string, error) {
+	return fromStringSet(s.Implies[tag]), nil
+}
+
+// AddImplication implements Store.
+func (s *jsonStore) AddImplication(tag, implied string) error {
+	return s.commit(journalOp{Op: opAddImplication, Tag: tag, Implied: implied})
+}
+
+// RemoveImplication implements Store.
+func (s *jsonStore) RemoveImplication(tag, implied string) error {
+	return s.commit(journalOp{Op: opRemoveImplication, Tag: tag, Implied: implied})
+}
+
+// ForEachImplication implements Store.
+func (s *jsonStore) ForEachImplication(fn func(tag, implied string) error) error {
+	for tag, implied := range s.Implies {
+		for t := range implied {
+			if err := fn(tag, t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Trash implements Store.
+func (s *jsonStore) Trash(hash string) (trashEntry, bool, error) {
+	e, ok := s.Trashed[hash]
+	return e, ok, nil
+}
+
+// AddTrash implements Store.
+func (s *jsonStore) AddTrash(e trashEntry) error {
+	return s.commit(journalOp{Op: opAddTrash, Trash: &e})
+}
+
+// RemoveTrash implements Store.
+func (s *jsonStore) RemoveTrash(hash string) error {
+	return s.commit(journalOp{Op: opRemoveTrash, Hash: hash})
+}
+
+// ForEachTrash implements Store.
+func (s *jsonStore) ForEachTrash(fn func(trashEntry) error) error {
+	for _, e := range s.Trashed {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Views implements Store.
+func (s *jsonStore) Views(hash string) (int, error) {
+	return s.ViewCounts[hash], nil
+}
+
+// AddViews implements Store.
+func (s *jsonStore) AddViews(hash string, n int) error {
+	return s.commit(journalOp{Op: opAddViews, Hash: hash, Views: n})
+}
+
+// RemoveViews implements Store.
+func (s *jsonStore) RemoveViews(hash string) error {
+	return s.commit(journalOp{Op: opRemoveViews, Hash: hash})
+}
+
+// ForEachViews implements Store.
+func (s *jsonStore) ForEachViews(fn func(hash string, views int) error) error {
+	for hash, n := range s.ViewCounts {
+		if err := fn(hash, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Revisions implements Store.
+func (s *jsonStore) Revisions(hash string) ([]revision, error) {
+	return append([]revision(nil), s.History[hash]...), nil
+}
+
+// AddRevision implements Store.
+func (s *jsonStore) AddRevision(rev revision) error {
+	return s.commit(journalOp{Op: opAddRevision, Revision: &rev})
+}
+
+// RemoveRevisions implements Store.
+func (s *jsonStore) RemoveRevisions(hash string) error {
+	return s.commit(journalOp{Op: opRemoveRevisions, Hash: hash})
+}
+
+// ForEachRevision implements Store.
+func (s *jsonStore) ForEachRevision(fn func(revision) error) error {
+	for _, revs := range s.History {
+		for _, rev := range revs {
+			if err := fn(rev); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AddAudit implements Store.
+func (s *jsonStore) AddAudit(e auditEntry) error {
+	return s.commit(journalOp{Op: opAddAudit, Audit: &e})
+}
+
+// ForEachAudit implements Store.
+func (s *jsonStore) ForEachAudit(fn func(auditEntry) error) error {
+	for _, e := range s.Audit {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pool implements Store.
+func (s *jsonStore) Pool(name string) (poolEntry, bool, error) {
+	pool, ok := s.Pools[name]
+	return pool, ok, nil
+}
+
+// SetPool implements Store.
+func (s *jsonStore) SetPool(pool poolEntry) error {
+	return s.commit(journalOp{Op: opSetPool, Pool: &pool})
+}
+
+// RemovePool implements Store.
+func (s *jsonStore) RemovePool(name string) error {
+	return s.commit(journalOp{Op: opRemovePool, Pool: &poolEntry{Name: name}})
+}
+
+// ForEachPool implements Store.
+func (s *jsonStore) ForEachPool(fn func(poolEntry) error) error {
+	for _, pool := range s.Pools {
+		if err := fn(pool); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueueItems implements Store.
+func (s *jsonStore) QueueItems() ([]queueItem, error) {
+	return append([]queueItem(nil), s.Queue...), nil
+}
+
+// PushQueue implements Store.
+func (s *jsonStore) PushQueue(item queueItem) error {
+	return s.commit(journalOp{Op: opPushQueue, Item: &item})
+}
+
+// PopQueue implements Store.
+func (s *jsonStore) PopQueue(index int) error {
+	return s.commit(journalOp{Op: opPopQueue, Index: index})
+}
+
+// Close implements Store.
+func (s *jsonStore) Close() error {
+	if s.journal == nil {
+		return nil
+	}
+	return s.journal.Close()
+}
+
+// insertImage adds entry to Images and indexes its tags.
+func (s *jsonStore) insertImage(entry imageEntry) {
+	s.Images[entry.Hash] = entry
+	if entry.MD5 != "" {
+		s.md5Index[entry.MD5] = entry.Hash
+	}
+	s.indexChild(entry)
+	if s.bitmaps != nil {
+		s.bitmaps.add(entry.Hash, entry.Tags)
+	}
+	for tag := range entry.Tags {
+		// create tag if it does not already exist
+		if _, ok := s.Tags[tag]; !ok {
+			s.Tags[tag] = tagEntry{
+				Name:   tag,
+				Images: make(stringSet),
+			}
+		}
+		// add image to tag
+		s.Tags[tag].Images[entry.Hash] = struct{}{}
+	}
+}
+
+// deleteImage removes an image from Images and from the index of each of
+// its tags.
+func (s *jsonStore) deleteImage(hash string) {
+	// delete tags
+	for t := range s.Images[hash].Tags {
+		tag, ok := s.Tags[t]
+		if !ok {
+			continue
+		}
+		delete(tag.Images, hash)
+		if len(tag.Images) == 0 {
+			delete(s.Tags, t)
+		}
+	}
+	// delete image entry
+	if md5 := s.Images[hash].MD5; s.md5Index[md5] == hash {
+		// when rekeying, the new entry is added before the old is removed
+		delete(s.md5Index, md5)
+	}
+	if parent := s.Images[hash].Parent; parent != "" {
+		delete(s.childIndex[parent], hash)
+		if len(s.childIndex[parent]) == 0 {
+			delete(s.childIndex, parent)
+		}
+	}
+	if s.bitmaps != nil {
+		s.bitmaps.remove(hash, s.Images[hash].Tags)
+	}
+	delete(s.Images, hash)
+}
+
+// save writes a snapshot of the store to its path, along with a timestamped
+// backup.
+func (s *jsonStore) save() error {
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := atomicWriteFile(s.path, b); err != nil {
+		return err
+	}
+	return writeBackup(s.path, b, s.keepBackups)
+}
+
+// newJSONStore loads the store saved at dbpath, replaying any journaled
+// mutations. If the snapshot cannot be decoded, the newest usable backup is
+// used in its place.
+func newJSONStore(dbpath string) (*jsonStore, error) {
+	s, err := readSnapshot(dbpath)
+	restored := false
+	if err == errSchemaTooNew {
+		// not corrupt; restoring an older backup would lose data
+		return nil, err
+	} else if err != nil {
+		log.Printf("Failed to load %v: %v; trying backups", dbpath, err)
+		s, err = restoreBackup(dbpath)
+		if err != nil {
+			return nil, err
+		}
+		restored = true
+	}
+	s.path = dbpath
+	s.keepBackups = defaultBackups
+
+	// bring the snapshot up to date
+	s.journal, err = openJournal(dbpath)
+	if err != nil {
+		return nil, err
+	}
+	err = s.replay()
+	if err == errJournalGap && restored {
+		// the journal continues from a newer snapshot than the backup;
+		// its remaining ops cannot be applied safely
+		log.Printf("Discarding journal entries after seq %v", s.Seq)
+		s.journalLen = 0
+		err = s.journal.Truncate(0)
+	}
+	if err != nil {
+		s.journal.Close()
+		return nil, err
+	}
+	if s.journalVersion < schemaVersion {
+		// keep the old snapshot around, in case the upgrade goes wrong
+		old := fmt.Sprintf("%v.v%v", dbpath, s.journalVersion)
+		if err := copyFile(old, dbpath); err != nil && !os.IsNotExist(err) {
+			s.journal.Close()
+			return nil, err
+		}
+		log.Printf("Upgrading %v from schema version %v to %v; previous version saved as %v", dbpath, s.journalVersion, schemaVersion, old)
+	}
+	if restored || s.journalVersion < schemaVersion {
+		// replace the corrupt or outdated snapshot
+		if err := s.compact(); err != nil {
+			s.journal.Close()
+			return nil, err
+		}
+		s.journalVersion = schemaVersion
+	}
+	return s, nil
+}
+
+// readJSONStore loads the store saved at dbpath, replaying any journaled
+// mutations in memory. Unlike newJSONStore, it never writes to dbpath or its
+// journal: nothing is migrated, restored or compacted on disk, and the
+// returned store has no journal of its own.
+func readJSONStore(dbpath string) (*jsonStore, error) {
+	s, err := readSnapshot(dbpath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(dbpath + ".journal")
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := s.replayFrom(f); err != nil && err != errTornJournal {
+		return nil, err
+	}
+	return s, nil
+}
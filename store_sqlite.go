@@ -0,0 +1,1072 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3" // register the sqlite3 driver
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS images (
+	hash TEXT PRIMARY KEY,
+	data TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS images_md5 ON images (json_extract(data, '$.MD5'));
+CREATE INDEX IF NOT EXISTS images_parent ON images (json_extract(data, '$.Parent'));
+CREATE TABLE IF NOT EXISTS image_tags (
+	tag  TEXT NOT NULL,
+	hash TEXT NOT NULL,
+	PRIMARY KEY (tag, hash)
+) WITHOUT ROWID;
+CREATE INDEX IF NOT EXISTS image_tags_hash ON image_tags (hash);
+CREATE TABLE IF NOT EXISTS tags (
+	name        TEXT PRIMARY KEY,
+	category    TEXT NOT NULL DEFAULT '',
+	description TEXT NOT NULL DEFAULT '',
+	count       INTEGER NOT NULL DEFAULT 0
+);
+CREATE TRIGGER IF NOT EXISTS image_tags_insert AFTER INSERT ON image_tags BEGIN
+	INSERT INTO tags (name, count) VALUES (NEW.tag, 1)
+		ON CONFLICT (name) DO UPDATE SET count = count + 1;
+END;
+CREATE TRIGGER IF NOT EXISTS image_tags_delete AFTER DELETE ON image_tags BEGIN
+	UPDATE tags SET count = count - 1 WHERE name = OLD.tag;
+	DELETE FROM tags WHERE name = OLD.tag AND count <= 0 AND category = '' AND description = '';
+END;
+CREATE TABLE IF NOT EXISTS aliases (
+	alias TEXT PRIMARY KEY,
+	tag   TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS implications (
+	tag     TEXT NOT NULL,
+	implied TEXT NOT NULL,
+	PRIMARY KEY (tag, implied)
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS pools (
+	name TEXT PRIMARY KEY,
+	data TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS revisions (
+	id   INTEGER PRIMARY KEY AUTOINCREMENT,
+	hash TEXT NOT NULL,
+	data TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS revisions_hash ON revisions (hash);
+CREATE TABLE IF NOT EXISTS trash (
+	hash TEXT PRIMARY KEY,
+	data TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS views (
+	hash  TEXT PRIMARY KEY,
+	count INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS audit (
+	id   INTEGER PRIMARY KEY AUTOINCREMENT,
+	data TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS queue (
+	id   INTEGER PRIMARY KEY AUTOINCREMENT,
+	data TEXT NOT NULL
+);
+`
+
+// recountTagsSQL recomputes the count column of the tags table from
+// image_tags.
+const recountTagsSQL = `
+INSERT OR IGNORE INTO tags (name) SELECT DISTINCT tag FROM image_tags;
+UPDATE tags SET count = (SELECT COUNT(*) FROM image_tags WHERE tag = tags.name);
+DELETE FROM tags WHERE count = 0 AND category = '' AND description = '';
+`
+
+// resolveTagSQL evaluates to its argument, or to the tag it is an alias of.
+// It consumes two query arguments, both of which should be the tag.
+const resolveTagSQL = `COALESCE((SELECT tag FROM aliases WHERE alias = ?), ?)`
+
+// sqliteStore is a Store backed by an SQLite database. Images, pools and queue
+// items are stored as JSON, while tag membership lives in the image_tags table so
+// that tag queries can be answered by indexed joins. The tags table holds each
+// tag's metadata and a count of its images, kept current by triggers on
+// image_tags.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx.
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertImageSQL(ex sqlExecer, entry imageEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := ex.Exec(`INSERT INTO images (hash, data) VALUES (?, ?)`, entry.Hash, b); err != nil {
+		return err
+	}
+	for tag := range entry.Tags {
+		if _, err := ex.Exec(`INSERT INTO image_tags (tag, hash) VALUES (?, ?)`, tag, entry.Hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanImages(rows *sql.Rows) (imgs []imageEntry, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		var entry imageEntry
+		if err := json.Unmarshal(b, &entry); err != nil {
+			return nil, err
+		}
+		imgs = append(imgs, entry)
+	}
+	return imgs, rows.Err()
+}
+
+// Image implements Store.
+func (s *sqliteStore) Image(hash string) (imageEntry, bool, error) {
+	var b []byte
+	err := s.db.QueryRow(`SELECT data FROM images WHERE hash = ?`, hash).Scan(&b)
+	if err == sql.ErrNoRows {
+		return imageEntry{}, false, nil
+	} else if err != nil {
+		return imageEntry{}, false, err
+	}
+	var entry imageEntry
+	err = json.Unmarshal(b, &entry)
+	return entry, err == nil, err
+}
+
+// ImageByMD5 implements Store.
+func (s *sqliteStore) ImageByMD5(md5 string) (imageEntry, bool, error) {
+	rows, err := s.db.Query(`SELECT data FROM images WHERE json_extract(data, '$.MD5') = ?`, md5)
+	if err != nil {
+		return imageEntry{}, false, err
+	}
+	imgs, err := scanImages(rows)
+	if err != nil || len(imgs) == 0 {
+		return imageEntry{}, false, err
+	}
+	return imgs[0], true, nil
+}
+
+// Children implements Store.
+func (s *sqliteStore) Children(hash string) ([]imageEntry, error) {
+	rows, err := s.db.Query(`SELECT data FROM images WHERE json_extract(data, '$.Parent') = ? ORDER BY hash`, hash)
+	if err != nil {
+		return nil, err
+	}
+	return scanImages(rows)
+}
+
+// AddImage implements Store.
+func (s *sqliteStore) AddImage(entry imageEntry) error {
+	if _, ok, err := s.Image(entry.Hash); err != nil {
+		return err
+	} else if ok {
+		return errImageExists
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := insertImageSQL(tx, entry); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveImage implements Store.
+func (s *sqliteStore) RemoveImage(hash string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(`DELETE FROM images WHERE hash = ?`, hash)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return errImageNotExists
+	}
+	// the delete trigger drops tags left with no images or metadata
+	if _, err := tx.Exec(`DELETE FROM image_tags WHERE hash = ?`, hash); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// ForEachImage implements Store.
+func (s *sqliteStore) ForEachImage(fn func(imageEntry) error) error {
+	rows, err := s.db.Query(`SELECT data FROM images`)
+	if err != nil {
+		return err
+	}
+	imgs, err := scanImages(rows)
+	if err != nil {
+		return err
+	}
+	for _, entry := range imgs {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LookupByTags implements Store. Each include tag adds a join against the
+// (tag, hash) primary key of image_tags, starting from the rarest tag's rows;
+// exclude tags become a single anti-join. Aliases are resolved inline.
+func (s *sqliteStore) LookupByTags(include, exclude []string) ([]imageEntry, error) {
+	if len(include) > 1 {
+		counts := make(map[string]int, len(include))
+		for _, tag := range include {
+			var n int
+			err := s.db.QueryRow(`SELECT count FROM tags WHERE name = `+resolveTagSQL, tag, tag).Scan(&n)
+			if err == sql.ErrNoRows {
+				// no image has the tag
+				return nil, nil
+			} else if err != nil {
+				return nil, err
+			}
+			counts[tag] = n
+		}
+		sort.SliceStable(include, func(i, j int) bool { return counts[include[i]] < counts[include[j]] })
+	}
+	var q strings.Builder
+	var args []interface{}
+	if len(include) == 0 {
+		q.WriteString(`SELECT i.data FROM images i`)
+	} else {
+		q.WriteString(`SELECT i.data FROM image_tags t0 JOIN images i ON i.hash = t0.hash`)
+		for n, tag := range include[1:] {
+			fmt.Fprintf(&q, ` JOIN image_tags t%[1]d ON t%[1]d.hash = t0.hash AND t%[1]d.tag = %[2]s`, n+1, resolveTagSQL)
+			args = append(args, tag, tag)
+		}
+		q.WriteString(` WHERE t0.tag = ` + resolveTagSQL)
+		args = append(args, include[0], include[0])
+	}
+	if len(exclude) != 0 {
+		if len(include) == 0 {
+			q.WriteString(` WHERE`)
+		} else {
+			q.WriteString(` AND`)
+		}
+		q.WriteString(` NOT EXISTS (SELECT 1 FROM image_tags x WHERE x.hash = i.hash AND x.tag IN (`)
+		for n, tag := range exclude {
+			if n > 0 {
+				q.WriteString(`, `)
+			}
+			q.WriteString(resolveTagSQL)
+			args = append(args, tag, tag)
+		}
+		q.WriteString(`))`)
+	}
+
+	rows, err := s.db.Query(q.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanImages(rows)
+}
+
+// Tag implements Store.
+func (s *sqliteStore) Tag(name string) (tagEntry, bool, error) {
+	tag, ok, err := s.TagInfo(name)
+	if err != nil || !ok {
+		return tag, ok, err
+	}
+	rows, err := s.db.Query(`SELECT hash FROM image_tags WHERE tag = ?`, name)
+	if err != nil {
+		return tagEntry{}, false, err
+	}
+	defer rows.Close()
+	tag.Images = make(stringSet)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return tagEntry{}, false, err
+		}
+		tag.Images[hash] = struct{}{}
+	}
+	return tag, true, rows.Err()
+}
+
+// TagInfo implements Store.
+func (s *sqliteStore) TagInfo(name string) (tagEntry, bool, error) {
+	tag := tagEntry{Name: name}
+	err := s.db.QueryRow(`SELECT category, description, count FROM tags WHERE name = ?`, name).
+		Scan(&tag.Category, &tag.Description, &tag.Count)
+	if err == sql.ErrNoRows {
+		return tagEntry{}, false, nil
+	}
+	return tag, err == nil, err
+}
+
+// SetTagInfo implements Store.
+func (s *sqliteStore) SetTagInfo(name string, info tagInfo) error {
+	_, err := s.db.Exec(`INSERT INTO tags (name, category, description) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET category = excluded.category, description = excluded.description`,
+		name, info.Category, info.Description)
+	if err == nil {
+		_, err = s.db.Exec(`DELETE FROM tags WHERE name = ? AND count = 0 AND category = '' AND description = ''`, name)
+	}
+	return err
+}
+
+// ForEachTag implements Store.
+func (s *sqliteStore) ForEachTag(fn func(tagEntry) error) error {
+	rows, err := s.db.Query(`SELECT t.name, t.category, t.description, t.count, it.hash
+		FROM tags t LEFT JOIN image_tags it ON it.tag = t.name ORDER BY t.name`)
+	if err != nil {
+		return err
+	}
+	var tags []tagEntry
+	for rows.Next() {
+		var tag tagEntry
+		var hash sql.NullString
+		if err := rows.Scan(&tag.Name, &tag.Category, &tag.Description, &tag.Count, &hash); err != nil {
+			rows.Close()
+			return err
+		}
+		if len(tags) == 0 || tags[len(tags)-1].Name != tag.Name {
+			tag.Images = make(stringSet)
+			tags = append(tags, tag)
+		}
+		if hash.Valid {
+			tags[len(tags)-1].Images[hash.String] = struct{}{}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := fn(tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MergeTag implements Store.
+func (s *sqliteStore) MergeTag(m tagMerge) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := renameTagSQL(tx, m.From, m.To); err != nil {
+		return err
+	}
+	for alias, tag := range m.Aliases {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO aliases (alias, tag) VALUES (?, ?)`, alias, tag); err != nil {
+			return err
+		}
+	}
+	for _, imp := range m.RemoveImplications {
+		if _, err := tx.Exec(`DELETE FROM implications WHERE tag = ? AND implied = ?`, imp.Tag, imp.Implied); err != nil {
+			return err
+		}
+	}
+	for _, imp := range m.AddImplications {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO implications (tag, implied) VALUES (?, ?)`, imp.Tag, imp.Implied); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// renameTagSQL replaces the tag from with to within tx, merging from's
+// metadata into to's. Renaming a tag to itself does nothing; otherwise from's
+// index would be deleted out from under it.
+func renameTagSQL(tx *sql.Tx, from, to string) error {
+	if from == to {
+		return nil
+	}
+	rows, err := tx.Query(`SELECT i.data FROM image_tags t JOIN images i ON i.hash = t.hash WHERE t.tag = ?`, from)
+	if err != nil {
+		return err
+	}
+	imgs, err := scanImages(rows)
+	if err != nil {
+		return err
+	}
+	for _, entry := range imgs {
+		b, err := json.Marshal(entry.renameTag(from, to))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE images SET data = ? WHERE hash = ?`, b, entry.Hash); err != nil {
+			return err
+		}
+	}
+	for _, q := range []string{
+		`INSERT OR IGNORE INTO image_tags (tag, hash) SELECT ?2, hash FROM image_tags WHERE tag = ?1`,
+		`INSERT OR IGNORE INTO tags (name) VALUES (?2)`,
+		`UPDATE tags SET
+			category = CASE WHEN category = '' THEN (SELECT category FROM tags WHERE name = ?1) ELSE category END,
+			description = CASE WHEN description = '' THEN (SELECT description FROM tags WHERE name = ?1) ELSE description END
+			WHERE name = ?2 AND EXISTS (SELECT 1 FROM tags WHERE name = ?1)`,
+		`DELETE FROM image_tags WHERE tag = ?1`,
+		`DELETE FROM tags WHERE name = ?1 OR (name = ?2 AND count = 0 AND category = '' AND description = '')`,
+	} {
+		if _, err := tx.Exec(q, from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RebuildTagIndex implements Store.
+func (s *sqliteStore) RebuildTagIndex() error {
+	rows, err := s.db.Query(`SELECT data FROM images`)
+	if err != nil {
+		return err
+	}
+	imgs, err := scanImages(rows)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM image_tags`); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, entry := range imgs {
+		for tag := range entry.Tags {
+			if _, err := tx.Exec(`INSERT INTO image_tags (tag, hash) VALUES (?, ?)`, tag, entry.Hash); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Alias implements Store.
+func (s *sqliteStore) Alias(alias string) (string, bool, error) {
+	var tag string
+	err := s.db.QueryRow(`SELECT tag FROM aliases WHERE alias = ?`, alias).Scan(&tag)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return tag, err == nil, err
+}
+
+// SetAlias implements Store.
+func (s *sqliteStore) SetAlias(alias, tag string) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO aliases (alias, tag) VALUES (?, ?)`, alias, tag)
+	return err
+}
+
+// RemoveAlias implements Store.
+func (s *sqliteStore) RemoveAlias(alias string) error {
+	_, err := s.db.Exec(`DELETE FROM aliases WHERE alias = ?`, alias)
+	return err
+}
+
+// ForEachAlias implements Store.
+func (s *sqliteStore) ForEachAlias(fn func(alias, tag string) error) error {
+	rows, err := s.db.Query(`SELECT alias, tag FROM aliases`)
+	if err != nil {
+		return err
+	}
+	aliases := make(map[string]string)
+	for rows.Next() {
+		var alias, tag string
+		if err := rows.Scan(&alias, &tag); err != nil {
+			rows.Close()
+			return err
+		}
+		aliases[alias] = tag
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for alias, tag := range aliases {
+		if err := fn(alias, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Implications implements Store.
+func (s *sqliteStore) Implications(tag string) ([]string, error) {
+	rows, err := s.db.Query(`SELECT implied FROM implications WHERE tag = ?`, tag)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var implied []string
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			return nil, err
+		}
+		implied = append(implied, t)
+	}
+	return implied, rows.Err()
+}
+
+// AddImplication implements Store.
+func (s *sqliteStore) AddImplication(tag, implied string) error {
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO implications (tag, implied) VALUES (?, ?)`, tag, implied)
+	return err
+}
+
+// RemoveImplication implements Store.
+func (s *sqliteStore) RemoveImplication(tag, implied string) error {
+	_, err := s.db.Exec(`DELETE FROM implications WHERE tag = ? AND implied = ?`, tag, implied)
+	return err
+}
+
+// ForEachImplication implements Store.
+func (s *sqliteStore) ForEachImplication(fn func(tag, implied string) error) error {
+	rows, err := s.db.Query(`SELECT tag, implied FROM implications`)
+	if err != nil {
+		return err
+	}
+	var pairs [][2]string
+	for rows.Next() {
+		var tag, implied string
+		if err := rows.Scan(&tag, &implied); err != nil {
+			rows.Close()
+			return err
+		}
+		pairs = append(pairs, [2]string{tag, implied})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, p := range pairs {
+		if err := fn(p[0], p[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addTrashSQL(ex sqlExecer, e trashEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = ex.Exec(`INSERT OR REPLACE INTO trash (hash, data) VALUES (?, ?)`, e.Hash, b)
+	return err
+}
+
+// Trash implements Store.
+func (s *sqliteStore) Trash(hash string) (trashEntry, bool, error) {
+	var b []byte
+	err := s.db.QueryRow(`SELECT data FROM trash WHERE hash = ?`, hash).Scan(&b)
+	if err == sql.ErrNoRows {
+		return trashEntry{}, false, nil
+	} else if err != nil {
+		return trashEntry{}, false, err
+	}
+	var e trashEntry
+	err = json.Unmarshal(b, &e)
+	return e, err == nil, err
+}
+
+// AddTrash implements Store.
+func (s *sqliteStore) AddTrash(e trashEntry) error {
+	return addTrashSQL(s.db, e)
+}
+
+// RemoveTrash implements Store.
+func (s *sqliteStore) RemoveTrash(hash string) error {
+	_, err := s.db.Exec(`DELETE FROM trash WHERE hash = ?`, hash)
+	return err
+}
+
+// ForEachTrash implements Store.
+func (s *sqliteStore) ForEachTrash(fn func(trashEntry) error) error {
+	rows, err := s.db.Query(`SELECT data FROM trash ORDER BY hash`)
+	if err != nil {
+		return err
+	}
+	var entries []trashEntry
+	for rows.Next() {
+		var b []byte
+		var e trashEntry
+		if err := rows.Scan(&b); err != nil {
+			rows.Close()
+			return err
+		}
+		if err := json.Unmarshal(b, &e); err != nil {
+			rows.Close()
+			return err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addViewsSQL(ex sqlExecer, hash string, n int) error {
+	_, err := ex.Exec(`INSERT INTO views (hash, count) VALUES (?, ?)
+		ON CONFLICT (hash) DO UPDATE SET count = count + excluded.count`, hash, n)
+	return err
+}
+
+// Views implements Store.
+func (s *sqliteStore) Views(hash string) (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT count FROM views WHERE hash = ?`, hash).Scan(&n)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return n, err
+}
+
+// AddViews implements Store.
+func (s *sqliteStore) AddViews(hash string, n int) error {
+	return addViewsSQL(s.db, hash, n)
+}
+
+// RemoveViews implements Store.
+func (s *sqliteStore) RemoveViews(hash string) error {
+	_, err := s.db.Exec(`DELETE FROM views WHERE hash = ?`, hash)
+	return err
+}
+
+// ForEachViews implements Store.
+func (s *sqliteStore) ForEachViews(fn func(hash string, views int) error) error {
+	rows, err := s.db.Query(`SELECT hash, count FROM views ORDER BY hash`)
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]int)
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		var n int
+		if err := rows.Scan(&hash, &n); err != nil {
+			rows.Close()
+			return err
+		}
+		counts[hash] = n
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if err := fn(hash, counts[hash]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addRevisionSQL(ex sqlExecer, rev revision) error {
+	b, err := json.Marshal(rev)
+	if err != nil {
+		return err
+	}
+	_, err = ex.Exec(`INSERT INTO revisions (hash, data) VALUES (?, ?)`, rev.Hash, b)
+	return err
+}
+
+// scanRevisions decodes rows of revision data.
+func scanRevisions(rows *sql.Rows) (revs []revision, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		var rev revision
+		if err := json.Unmarshal(b, &rev); err != nil {
+			return nil, err
+		}
+		revs = append(revs, rev)
+	}
+	return revs, rows.Err()
+}
+
+// Revisions implements Store.
+func (s *sqliteStore) Revisions(hash string) ([]revision, error) {
+	rows, err := s.db.Query(`SELECT data FROM revisions WHERE hash = ? ORDER BY id`, hash)
+	if err != nil {
+		return nil, err
+	}
+	return scanRevisions(rows)
+}
+
+// AddRevision implements Store.
+func (s *sqliteStore) AddRevision(rev revision) error {
+	return addRevisionSQL(s.db, rev)
+}
+
+// RemoveRevisions implements Store.
+func (s *sqliteStore) RemoveRevisions(hash string) error {
+	_, err := s.db.Exec(`DELETE FROM revisions WHERE hash = ?`, hash)
+	return err
+}
+
+// ForEachRevision implements Store.
+func (s *sqliteStore) ForEachRevision(fn func(revision) error) error {
+	rows, err := s.db.Query(`SELECT data FROM revisions ORDER BY hash, id`)
+	if err != nil {
+		return err
+	}
+	revs, err := scanRevisions(rows)
+	if err != nil {
+		return err
+	}
+	for _, rev := range revs {
+		if err := fn(rev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addAuditSQL(ex sqlExecer, e auditEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = ex.Exec(`INSERT INTO audit (data) VALUES (?)`, b)
+	return err
+}
+
+// AddAudit implements Store.
+func (s *sqliteStore) AddAudit(e auditEntry) error {
+	return addAuditSQL(s.db, e)
+}
+
+// ForEachAudit implements Store.
+func (s *sqliteStore) ForEachAudit(fn func(auditEntry) error) error {
+	rows, err := s.db.Query(`SELECT data FROM audit ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	var entries []auditEntry
+	for rows.Next() {
+		var b []byte
+		var e auditEntry
+		if err := rows.Scan(&b); err != nil {
+			rows.Close()
+			return err
+		}
+		if err := json.Unmarshal(b, &e); err != nil {
+			rows.Close()
+			return err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setPoolSQL(ex sqlExecer, pool poolEntry) error {
+	b, err := json.Marshal(pool)
+	if err != nil {
+		return err
+	}
+	_, err = ex.Exec(`INSERT OR REPLACE INTO pools (name, data) VALUES (?, ?)`, pool.Name, b)
+	return err
+}
+
+// Pool implements Store.
+func (s *sqliteStore) Pool(name string) (poolEntry, bool, error) {
+	var b []byte
+	err := s.db.QueryRow(`SELECT data FROM pools WHERE name = ?`, name).Scan(&b)
+	if err == sql.ErrNoRows {
+		return poolEntry{}, false, nil
+	} else if err != nil {
+		return poolEntry{}, false, err
+	}
+	var pool poolEntry
+	err = json.Unmarshal(b, &pool)
+	return pool, err == nil, err
+}
+
+// SetPool implements Store.
+func (s *sqliteStore) SetPool(pool poolEntry) error {
+	return setPoolSQL(s.db, pool)
+}
+
+// RemovePool implements Store.
+func (s *sqliteStore) RemovePool(name string) error {
+	_, err := s.db.Exec(`DELETE FROM pools WHERE name = ?`, name)
+	return err
+}
+
+// ForEachPool implements Store.
+func (s *sqliteStore) ForEachPool(fn func(poolEntry) error) error {
+	rows, err := s.db.Query(`SELECT data FROM pools ORDER BY name`)
+	if err != nil {
+		return err
+	}
+	var pools []poolEntry
+	for rows.Next() {
+		var b []byte
+		var pool poolEntry
+		if err := rows.Scan(&b); err != nil {
+			rows.Close()
+			return err
+		}
+		if err := json.Unmarshal(b, &pool); err != nil {
+			rows.Close()
+			return err
+		}
+		pools = append(pools, pool)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, pool := range pools {
+		if err := fn(pool); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueueItems implements Store.
+func (s *sqliteStore) QueueItems() (items []queueItem, err error) {
+	rows, err := s.db.Query(`SELECT data FROM queue ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		var item queueItem
+		if err := json.Unmarshal(b, &item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func pushQueueSQL(ex sqlExecer, item queueItem) error {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	_, err = ex.Exec(`INSERT INTO queue (data) VALUES (?)`, b)
+	return err
+}
+
+// PushQueue implements Store.
+func (s *sqliteStore) PushQueue(item queueItem) error {
+	return pushQueueSQL(s.db, item)
+}
+
+// PopQueue implements Store.
+func (s *sqliteStore) PopQueue(index int) error {
+	if index < 0 {
+		return errBadQueueIndex
+	}
+	res, err := s.db.Exec(`DELETE FROM queue WHERE id = (SELECT id FROM queue ORDER BY id LIMIT 1 OFFSET ?)`, index)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errBadQueueIndex
+	}
+	return nil
+}
+
+// Close implements Store.
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+// Import copies the images, trash, view counts, tag metadata, aliases,
+// implications, pools, revisions, audit log and queue of src into the store
+// within a single transaction. It is intended for migrating an existing
+// database into a new, empty SQLite file.
+func (s *sqliteStore) Import(src Store) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = src.ForEachImage(func(entry imageEntry) error {
+		return insertImageSQL(tx, entry)
+	})
+	if err == nil {
+		err = src.ForEachTag(func(tag tagEntry) error {
+			if tag.Category == "" && tag.Description == "" {
+				return nil
+			}
+			_, err := tx.Exec(`UPDATE tags SET category = ?, description = ? WHERE name = ?`, tag.Category, tag.Description, tag.Name)
+			if err == nil {
+				_, err = tx.Exec(`INSERT OR IGNORE INTO tags (name, category, description) VALUES (?, ?, ?)`, tag.Name, tag.Category, tag.Description)
+			}
+			return err
+		})
+	}
+	if err == nil {
+		err = src.ForEachAlias(func(alias, tag string) error {
+			_, err := tx.Exec(`INSERT OR REPLACE INTO aliases (alias, tag) VALUES (?, ?)`, alias, tag)
+			return err
+		})
+	}
+	if err == nil {
+		err = src.ForEachImplication(func(tag, implied string) error {
+			_, err := tx.Exec(`INSERT OR IGNORE INTO implications (tag, implied) VALUES (?, ?)`, tag, implied)
+			return err
+		})
+	}
+	if err == nil {
+		err = src.ForEachPool(func(pool poolEntry) error {
+			return setPoolSQL(tx, pool)
+		})
+	}
+	if err == nil {
+		err = src.ForEachTrash(func(e trashEntry) error {
+			return addTrashSQL(tx, e)
+		})
+	}
+	if err == nil {
+		err = src.ForEachViews(func(hash string, n int) error {
+			return addViewsSQL(tx, hash, n)
+		})
+	}
+	if err == nil {
+		err = src.ForEachRevision(func(rev revision) error {
+			return addRevisionSQL(tx, rev)
+		})
+	}
+	if err == nil {
+		err = src.ForEachAudit(func(e auditEntry) error {
+			return addAuditSQL(tx, e)
+		})
+	}
+	if err == nil {
+		var items []queueItem
+		items, err = src.QueueItems()
+		for i := 0; i < len(items) && err == nil; i++ {
+			err = pushQueueSQL(tx, items[i])
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateSQLite upgrades the stored images and queue items to the current
+// schema version, which is kept in the user_version pragma.
+func migrateSQLite(db *sql.DB) error {
+	var from int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&from); err != nil {
+		return err
+	}
+	if from > schemaVersion {
+		return errSchemaTooNew
+	} else if from == schemaVersion {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"images", "queue"} {
+		// the key column is hash for images and id for the queue, but
+		// rowid identifies a row in either
+		rows, err := tx.Query(`SELECT rowid, data FROM ` + table)
+		if err != nil {
+			return err
+		}
+		updates := make(map[int64][]byte)
+		for rows.Next() {
+			var id int64
+			var b []byte
+			if err := rows.Scan(&id, &b); err != nil {
+				rows.Close()
+				return err
+			}
+			b, changed, err := migrateImageJSON(b, from)
+			if err != nil {
+				rows.Close()
+				return err
+			} else if changed {
+				updates[id] = b
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for id, b := range updates {
+			if _, err := tx.Exec(`UPDATE `+table+` SET data = ? WHERE rowid = ?`, b, id); err != nil {
+				return err
+			}
+		}
+	}
+	// counts were not kept before version 3
+	if _, err := tx.Exec(recountTagsSQL); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, schemaVersion)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func newSQLiteStore(dbpath string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", dbpath+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db}, nil
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+// testStores returns one empty instance of each Store implementation.
+func testStores(t *testing.T) map[string]Store {
+	dir, err := ioutil.TempDir("", "dispel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := newJSONStore(filepath.Join(dir, "imagedb.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := newBoltStore(filepath.Join(dir, "imagedb.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := newSQLiteStore(filepath.Join(dir, "imagedb.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a jsonStore that answers lookups from its bitmap index
+	ms, err := newJSONStore(filepath.Join(dir, "imagedb-bitmap.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.indexBitmaps()
+	return map[string]Store{
+		"json":   js,
+		"bolt":   bs,
+		"sqlite": ss,
+		"bitmap": ms,
+	}
+}
+
+func TestStores(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			assert, require := assert.New(t), require.New(t)
+			defer s.Close()
+
+			require.Nil(s.AddImage(testEntry("foo", "bar", "baz")))
+			require.Nil(s.AddImage(testEntry("qux", "bar")))
+			assert.Equal(errImageExists, s.AddImage(testEntry("foo")))
+
+			entry, ok, err := s.Image("foo")
+			require.Nil(err)
+			assert.True(ok)
+			assert.Equal(testEntry("foo", "bar", "baz"), entry)
+
+			imgs, err := s.LookupByTags([]string{"bar"}, []string{"baz"})
+			require.Nil(err)
+			assert.Equal([]imageEntry{testEntry("qux", "bar")}, imgs)
+			imgs, err = s.LookupByTags([]string{"bar", "baz"}, nil)
+			require.Nil(err)
+			assert.Equal([]imageEntry{testEntry("foo", "bar", "baz")}, imgs)
+			imgs, err = s.LookupByTags(nil, []string{"bar"})
+			require.Nil(err)
+			assert.Empty(imgs)
+
+			// aliases are resolved in both include and exclude
+			require.Nil(s.SetAlias("b", "baz"))
+			imgs, err = s.LookupByTags([]string{"bar", "b"}, nil)
+			require.Nil(err)
+			assert.Equal([]imageEntry{testEntry("foo", "bar", "baz")}, imgs)
+			imgs, err = s.LookupByTags(nil, []string{"b"})
+			require.Nil(err)
+			assert.Equal([]imageEntry{testEntry("qux", "bar")}, imgs)
+			require.Nil(s.RemoveAlias("b"))
+
+			// and by their parent
+			child := testEntry("child", "bar")
+			child.Parent = "foo"
+			require.Nil(s.AddImage(child))
+			imgs, err = s.Children("foo")
+			require.Nil(err)
+			assert.Equal([]imageEntry{child}, imgs)
+			require.Nil(s.RemoveImage("child"))
+			imgs, err = s.Children("foo")
+			require.Nil(err)
+			assert.Empty(imgs)
+
+			// images can be found by their MD5 hash
+			rekeyed := testEntry("sha", "bar")
+			rekeyed.MD5 = "md5"
+			require.Nil(s.AddImage(rekeyed))
+			entry, ok, err = s.ImageByMD5("md5")
+			require.Nil(err)
+			assert.True(ok)
+			assert.Equal(rekeyed, entry)
+			require.Nil(s.RemoveImage("sha"))
+			_, ok, err = s.ImageByMD5("md5")
+			require.Nil(err)
+			assert.False(ok)
+
+			tag, ok, err := s.Tag("bar")
+			require.Nil(err)
+			assert.True(ok)
+			assert.Len(tag.Images, 2)
+
+			require.Nil(s.RebuildTagIndex())
+			tag, ok, err = s.Tag("bar")
+			require.Nil(err)
+			assert.True(ok)
+			assert.Len(tag.Images, 2)
+
+			// removing the last image with a tag deletes the tag
+			require.Nil(s.RemoveImage("foo"))
+			assert.Equal(errImageNotExists, s.RemoveImage("foo"))
+			_, ok, err = s.Tag("baz")
+			require.Nil(err)
+			assert.False(ok)
+
+			// unless it has metadata
+			require.Nil(s.SetTagInfo("bar", tagInfo{Category: "artist", Description: "draws things"}))
+			tag, ok, err = s.TagInfo("bar")
+			require.Nil(err)
+			assert.True(ok)
+			assert.Equal("artist", tag.Category)
+			assert.Equal("draws things", tag.Description)
+			assert.Equal(1, tag.Count)
+			assert.Nil(tag.Images)
+			require.Nil(s.RemoveImage("qux"))
+			tag, ok, err = s.Tag("bar")
+			require.Nil(err)
+			assert.True(ok)
+			assert.Equal(0, tag.Count)
+			assert.Empty(tag.Images)
+			var names []string
+			require.Nil(s.ForEachTag(func(tag tagEntry) error {
+				names = append(names, tag.Name)
+				return nil
+			}))
+			assert.Equal([]string{"bar"}, names)
+			require.Nil(s.SetTagInfo("bar", tagInfo{}))
+			_, ok, err = s.TagInfo("bar")
+			require.Nil(err)
+			assert.False(ok)
+
+			require.Nil(s.SetAlias("kitty", "cat"))
+			tagName, ok, err := s.Alias("kitty")
+			require.Nil(err)
+			assert.True(ok)
+			assert.Equal("cat", tagName)
+			require.Nil(s.RemoveAlias("kitty"))
+			_, ok, _ = s.Alias("kitty")
+			assert.False(ok)
+
+			require.Nil(s.AddImplication("kitten", "cat"))
+			require.Nil(s.AddImplication("kitten", "young"))
+			require.Nil(s.AddImplication("kitten", "cat"))
+			implied, err := s.Implications("kitten")
+			require.Nil(err)
+			assert.ElementsMatch([]string{"cat", "young"}, implied)
+			require.Nil(s.RemoveImplication("kitten", "young"))
+			var pairs []implicationEntry
+			require.Nil(s.ForEachImplication(func(tag, implied string) error {
+				pairs = append(pairs, implicationEntry{tag, implied})
+				return nil
+			}))
+			assert.Equal([]implicationEntry{{"kitten", "cat"}}, pairs)
+			require.Nil(s.RemoveImplication("kitten", "cat"))
+			implied, err = s.Implications("kitten")
+			require.Nil(err)
+			assert.Empty(implied)
+
+			now := time.Now().Round(0)
+			require.Nil(s.AddRevision(revision{Hash: "a", NewTags: toStringSet([]string{"x"}), Date: now, Submitter: "me"}))
+			require.Nil(s.AddRevision(revision{Hash: "b", NewTags: toStringSet([]string{"y"})}))
+			require.Nil(s.AddRevision(revision{Hash: "a", OldTags: toStringSet([]string{"x"}), NewTags: toStringSet([]string{"z"})}))
+			revs, err := s.Revisions("a")
+			require.Nil(err)
+			require.Len(revs, 2)
+			assert.True(now.Equal(revs[0].Date))
+			assert.Equal("me", revs[0].Submitter)
+			assert.Equal([]string{"z"}, revs[1].Added())
+			var n int
+			require.Nil(s.ForEachRevision(func(revision) error { n++; return nil }))
+			assert.Equal(3, n)
+			require.Nil(s.RemoveRevisions("a"))
+			revs, err = s.Revisions("a")
+			require.Nil(err)
+			assert.Empty(revs)
+
+			require.Nil(s.AddTrash(trashEntry{testEntry("gone", "x"), now}))
+			e, ok, err := s.Trash("gone")
+			require.Nil(err)
+			assert.True(ok)
+			assert.Equal(testEntry("gone", "x"), e.imageEntry)
+			assert.True(now.Equal(e.Deleted))
+			var trashed int
+			require.Nil(s.ForEachTrash(func(trashEntry) error { trashed++; return nil }))
+			assert.Equal(1, trashed)
+			require.Nil(s.RemoveTrash("gone"))
+			_, ok, err = s.Trash("gone")
+			require.Nil(err)
+			assert.False(ok)
+
+			require.Nil(s.AddViews("gone", 2))
+			require.Nil(s.AddViews("gone", 3))
+			views, err := s.Views("gone")
+			require.Nil(err)
+			assert.Equal(5, views)
+			counts := make(map[string]int)
+			require.Nil(s.ForEachViews(func(hash string, n int) error { counts[hash] = n; return nil }))
+			assert.Equal(map[string]int{"gone": 5}, counts)
+			require.Nil(s.RemoveViews("gone"))
+			views, err = s.Views("gone")
+			require.Nil(err)
+			assert.Zero(views)
+
+			require.Nil(s.AddAudit(auditEntry{Action: actionDelete, Hash: "a", Approved: true}))
+			require.Nil(s.AddAudit(auditEntry{Action: actionUpload, Hash: "b"}))
+			var audit []auditEntry
+			require.Nil(s.ForEachAudit(func(e auditEntry) error {
+				audit = append(audit, e)
+				return nil
+			}))
+			require.Len(audit, 2)
+			assert.Equal(actionDelete, audit[0].Action)
+			assert.Equal("b", audit[1].Hash)
+
+			pool := poolEntry{Name: "story", Description: "a story", Pages: []poolPage{{"b", "the end"}, {"a", ""}}}
+			require.Nil(s.SetPool(pool))
+			got, ok, err := s.Pool("story")
+			require.Nil(err)
+			assert.True(ok)
+			assert.Equal(pool, got)
+			pool.Pages = pool.Pages[1:]
+			require.Nil(s.SetPool(pool))
+			var pools []poolEntry
+			require.Nil(s.ForEachPool(func(p poolEntry) error {
+				pools = append(pools, p)
+				return nil
+			}))
+			assert.Equal([]poolEntry{pool}, pools)
+			require.Nil(s.RemovePool("story"))
+			_, ok, err = s.Pool("story")
+			require.Nil(err)
+			assert.False(ok)
+
+			for _, hash := range []string{"a", "b", "c"} {
+				require.Nil(s.PushQueue(queueItem{Action: actionDelete, imageEntry: testEntry(hash)}))
+			}
+			require.Nil(s.PopQueue(1))
+			assert.Equal(errBadQueueIndex, s.PopQueue(2))
+			queue, err := s.QueueItems()
+			require.Nil(err)
+			require.Len(queue, 2)
+			assert.Equal("a", queue[0].Hash)
+			assert.Equal("c", queue[1].Hash)
+		})
+	}
+}
+
+func TestJSONStoreIndexes(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	s, dbpath := newTestStore(t)
+
+	entry := testEntry("foo", "bar")
+	entry.MD5 = "0123abcd"
+	require.Nil(s.AddImage(entry))
+	child := testEntry("child", "bar")
+	child.Parent = "foo"
+	require.Nil(s.AddImage(child))
+	check := func(s *jsonStore) {
+		// reads run concurrently under db.mu.RLock, so must not write
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				img, ok, err := s.ImageByMD5("0123abcd")
+				assert.Nil(err)
+				assert.True(ok)
+				assert.Equal("foo", img.Hash)
+				children, err := s.Children("foo")
+				assert.Nil(err)
+				assert.Len(children, 1)
+				imgs, err := s.LookupByTags([]string{"bar"}, nil)
+				assert.Nil(err)
+				assert.Len(imgs, 2)
+			}()
+		}
+		wg.Wait()
+	}
+	check(s)
+
+	// indexes are rebuilt from the journal, and from the snapshot
+	s.Close()
+	s, err := newJSONStore(dbpath)
+	require.Nil(err)
+	check(s)
+	require.Nil(s.compact())
+	s.Close()
+	s, err = newJSONStore(dbpath)
+	require.Nil(err)
+	check(s)
+	s.indexBitmaps()
+	check(s)
+	s.Close()
+}
+
+func TestRenameTag(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			assert, require := assert.New(t), require.New(t)
+			defer s.Close()
+
+			require.Nil(s.AddImage(testEntry("foo", "kitty", "bar")))
+			require.Nil(s.AddImage(testEntry("qux", "kitty", "cat")))
+			require.Nil(s.AddImage(testEntry("quux", "cat")))
+			require.Nil(s.SetTagInfo("kitty", tagInfo{Category: "character", Description: "small"}))
+			require.Nil(s.SetTagInfo("cat", tagInfo{Description: "feline"}))
+
+			// merging into an existing tag
+			require.Nil(s.MergeTag(tagMerge{From: "kitty", To: "cat"}))
+			entry, _, err := s.Image("qux")
+			require.Nil(err)
+			assert.Equal(toStringSet([]string{"cat"}), entry.Tags)
+			entry, _, err = s.Image("foo")
+			require.Nil(err)
+			assert.Equal(toStringSet([]string{"cat", "bar"}), entry.Tags)
+			_, ok, err := s.Tag("kitty")
+			require.Nil(err)
+			assert.False(ok)
+			tag, ok, err := s.Tag("cat")
+			require.Nil(err)
+			assert.True(ok)
+			assert.Equal(3, tag.Count)
+			assert.Len(tag.Images, 3)
+			assert.Equal(tagInfo{Category: "character", Description: "feline"}, tag.info())
+
+			// renaming to a new tag
+			require.Nil(s.MergeTag(tagMerge{From: "bar", To: "baz"}))
+			imgs, err := s.LookupByTags([]string{"baz", "cat"}, nil)
+			require.Nil(err)
+			require.Len(imgs, 1)
+			assert.Equal("foo", imgs[0].Hash)
+			tag, ok, err = s.TagInfo("baz")
+			require.Nil(err)
+			assert.True(ok)
+			assert.Equal(1, tag.Count)
+			_, ok, err = s.Tag("bar")
+			require.Nil(err)
+			assert.False(ok)
+
+			// merging a tag into itself leaves it intact
+			require.Nil(s.MergeTag(tagMerge{From: "cat", To: "cat"}))
+			tag, ok, err = s.Tag("cat")
+			require.Nil(err)
+			assert.True(ok)
+			assert.Equal(3, tag.Count)
+			assert.Len(tag.Images, 3)
+			assert.Equal(tagInfo{Category: "character", Description: "feline"}, tag.info())
+			imgs, err = s.LookupByTags([]string{"cat"}, nil)
+			require.Nil(err)
+			assert.Len(imgs, 3)
+		})
+	}
+}
+
+func TestMergeTagStores(t *testing.T) {
+	setup := func(require *require.Assertions, s Store) *imageDB {
+		require.Nil(s.AddImage(testEntry("foo", "kitty")))
+		require.Nil(s.AddImage(testEntry("bar", "cat")))
+		require.Nil(s.SetAlias("kitten", "kitty"))
+		require.Nil(s.AddImplication("kitty", "pet"))
+		require.Nil(s.AddImplication("pet", "cat"))
+		return newImageDB(s, nil)
+	}
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			assert, require := assert.New(t), require.New(t)
+			defer s.Close()
+			db := setup(require, s)
+
+			n, err := db.mergeTag("kitty", "cat", true)
+			require.Nil(err)
+			assert.Equal(1, n)
+			imgs, err := s.LookupByTags([]string{"cat"}, nil)
+			require.Nil(err)
+			assert.Len(imgs, 2)
+			for _, alias := range []string{"kitty", "kitten"} {
+				tag, _, err := s.Alias(alias)
+				require.Nil(err)
+				assert.Equal("cat", tag)
+			}
+			// cat -> pet would be a cycle, so is dropped
+			implied, err := s.Implications("cat")
+			require.Nil(err)
+			assert.Empty(implied)
+			implied, err = s.Implications("kitty")
+			require.Nil(err)
+			assert.Empty(implied)
+			implied, err = s.Implications("pet")
+			require.Nil(err)
+			assert.Equal([]string{"cat"}, implied)
+		})
+	}
+
+	// a failure partway through leaves the store as it was
+	assert, require := assert.New(t), require.New(t)
+	ss := testStores(t)["sqlite"].(*sqliteStore)
+	defer ss.Close()
+	db := setup(require, ss)
+	require.Nil(ss.RemoveImplication("pet", "cat"))
+	_, err := ss.db.Exec(`CREATE TRIGGER fail BEFORE INSERT ON implications BEGIN SELECT RAISE(ABORT, 'injected failure'); END`)
+	require.Nil(err)
+	_, err = db.mergeTag("kitty", "cat", true)
+	require.NotNil(err)
+	entry, _, err := ss.Image("foo")
+	require.Nil(err)
+	assert.Equal(toStringSet([]string{"kitty"}), entry.Tags)
+	tag, _, err := ss.Alias("kitten")
+	require.Nil(err)
+	assert.Equal("kitty", tag)
+	_, ok, err := ss.Alias("kitty")
+	require.Nil(err)
+	assert.False(ok)
+	implied, err := ss.Implications("kitty")
+	require.Nil(err)
+	assert.Equal([]string{"pet"}, implied)
+}
+
+func TestCopyStore(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	stores := testStores(t)
+	src := stores["json"]
+	require.Nil(src.AddImage(testEntry("foo", "bar", "baz")))
+	require.Nil(src.SetAlias("kitty", "cat"))
+	require.Nil(src.SetTagInfo("bar", tagInfo{Category: "series"}))
+	require.Nil(src.AddImplication("bar", "baz"))
+	require.Nil(src.SetPool(poolEntry{Name: "story", Pages: []poolPage{{"foo", "once"}}}))
+	require.Nil(src.AddRevision(revision{Hash: "foo", NewTags: toStringSet([]string{"bar", "baz"})}))
+	require.Nil(src.AddViews("foo", 7))
+	require.Nil(src.PushQueue(queueItem{Action: actionDelete, imageEntry: testEntry("foo", "bar", "baz")}))
+
+	for _, name := range []string{"bolt", "sqlite"} {
+		dst := stores[name]
+		require.Nil(copyStore(dst, src))
+		entry, ok, err := dst.Image("foo")
+		require.Nil(err)
+		assert.True(ok)
+		assert.Equal(testEntry("foo", "bar", "baz"), entry)
+		tag, _, _ := dst.Alias("kitty")
+		assert.Equal("cat", tag)
+		info, _, err := dst.TagInfo("bar")
+		require.Nil(err)
+		assert.Equal("series", info.Category)
+		assert.Equal(1, info.Count)
+		implied, err := dst.Implications("bar")
+		require.Nil(err)
+		assert.Equal([]string{"baz"}, implied)
+		pool, ok, err := dst.Pool("story")
+		require.Nil(err)
+		assert.True(ok)
+		assert.Equal([]poolPage{{"foo", "once"}}, pool.Pages)
+		revs, err := dst.Revisions("foo")
+		require.Nil(err)
+		assert.Len(revs, 1)
+		views, err := dst.Views("foo")
+		require.Nil(err)
+		assert.Equal(7, views)
+		queue, err := dst.QueueItems()
+		require.Nil(err)
+		assert.Len(queue, 1)
+	}
+}
+
+func TestReadJSONStore(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	dir, err := ioutil.TempDir("", "dispel")
+	require.Nil(err)
+	dbpath := filepath.Join(dir, "imagedb.json")
+
+	// a snapshot, a journal with one op, and a torn entry
+	s, err := newJSONStore(dbpath)
+	require.Nil(err)
+	require.Nil(s.AddImage(testEntry("foo", "bar")))
+	require.Nil(s.compact())
+	require.Nil(s.AddImage(testEntry("qux", "bar")))
+	_, err = s.journal.WriteString(`{"Seq":3,"Op":"add im`)
+	require.Nil(err)
+	require.Nil(s.Close())
+	snapshot, err := ioutil.ReadFile(dbpath)
+	require.Nil(err)
+	journal, err := ioutil.ReadFile(dbpath + ".journal")
+	require.Nil(err)
+
+	s, err = readJSONStore(dbpath)
+	require.Nil(err)
+	assert.Len(s.Images, 2)
+	assert.Len(s.Tags["bar"].Images, 2)
+	require.Nil(s.AddImage(testEntry("quux")))
+	require.Nil(s.Close())
+	b, err := ioutil.ReadFile(dbpath)
+	require.Nil(err)
+	assert.Equal(snapshot, b)
+	b, err = ioutil.ReadFile(dbpath + ".journal")
+	require.Nil(err)
+	assert.Equal(journal, b)
+
+	// no journal is created for a snapshot without one
+	require.Nil(os.Remove(dbpath + ".journal"))
+	s, err = readJSONStore(dbpath)
+	require.Nil(err)
+	assert.Len(s.Images, 1)
+	_, err = os.Stat(dbpath + ".journal")
+	assert.True(os.IsNotExist(err))
+}
+
+func TestMigrateStores(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	dir, err := ioutil.TempDir("", "dispel")
+	require.Nil(err)
+	legacy := []byte(`{"Hash":"foo","Ext":".png","DateAdded":"Tue Mar 04 10:30:00 EST 2025","Tags":["bar"]}`)
+	want := time.Date(2025, 3, 4, 10, 30, 0, 0, time.Local)
+
+	// bolt databases written before versioning have no meta bucket
+	bs, err := newBoltStore(filepath.Join(dir, "imagedb.bolt"))
+	require.Nil(err)
+	require.Nil(bs.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketImages).Put([]byte("foo"), legacy); err != nil {
+			return err
+		}
+		return tx.DeleteBucket(bucketMeta)
+	}))
+	require.Nil(bs.Close())
+	bs, err = newBoltStore(filepath.Join(dir, "imagedb.bolt"))
+	require.Nil(err)
+
+	ss, err := newSQLiteStore(filepath.Join(dir, "imagedb.sqlite"))
+	require.Nil(err)
+	_, err = ss.db.Exec(`INSERT INTO images (hash, data) VALUES ('foo', ?); PRAGMA user_version = 1`, legacy)
+	require.Nil(err)
+	require.Nil(ss.Close())
+	ss, err = newSQLiteStore(filepath.Join(dir, "imagedb.sqlite"))
+	require.Nil(err)
+
+	for name, s := range map[string]Store{"bolt": bs, "sqlite": ss} {
+		entry, ok, err := s.Image("foo")
+		require.Nil(err, name)
+		assert.True(ok, name)
+		assert.True(want.Equal(entry.DateAdded), name)
+		s.Close()
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var (
+	errTagNotExists = errors.New("tag does not exist")
+	errMergeSelf    = errors.New("a tag cannot be merged into itself")
+)
+
+// tagCategories are the categories a tag may belong to, in the order they are
+// displayed. Tags are general unless given another category; general is
+// stored as the empty string, so that an uncategorized tag with no images
+// and no description ceases to exist.
+var tagCategories = []string{"artist", "character", "series", "meta", "general"}
+
+// normalizeCategory returns the stored form of category, and whether it is a
+// known category.
+func normalizeCategory(category string) (string, bool) {
+	category = strings.ToLower(category)
+	for _, c := range tagCategories {
+		if c == category {
+			if c == "general" {
+				return "", true
+			}
+			return c, true
+		}
+	}
+	return "", false
+}
+
+// splitTagCategory splits a tag of the form category:name, e.g. artist:name.
+// Tags without a known category prefix are returned unchanged, with ok
+// false.
+func splitTagCategory(tag string) (name, category string, ok bool) {
+	i := strings.IndexByte(tag, ':')
+	if i <= 0 || i == len(tag)-1 {
+		return tag, "", false
+	}
+	category, ok = normalizeCategory(tag[:i])
+	if !ok {
+		return tag, "", false
+	}
+	return tag[i+1:], category, true
+}
+
+// info returns the metadata of a tag.
+func (t tagEntry) info() tagInfo {
+	return tagInfo{Category: t.Category, Description: t.Description}
+}
+
+// mergeTagInfo fills in the fields of info that are empty from other.
+func mergeTagInfo(info, other tagInfo) tagInfo {
+	if info.Category == "" {
+		info.Category = other.Category
+	}
+	if info.Description == "" {
+		info.Description = other.Description
+	}
+	return info
+}
+
+// renameTag returns a copy of entry with the tag from replaced by to.
+func (ie imageEntry) renameTag(from, to string) imageEntry {
+	tags := make(stringSet, len(ie.Tags))
+	for t := range ie.Tags {
+		if t == from {
+			t = to
+		}
+		tags[t] = struct{}{}
+	}
+	ie.Tags = tags
+	return ie
+}
+
+// DisplayCategory returns the category of a tag as shown to users.
+func (t tagEntry) DisplayCategory() string {
+	if t.Category == "" {
+		return "general"
+	}
+	return t.Category
+}
+
+// A tagGroup is the tags of an image that belong to one category.
+type tagGroup struct {
+	Category string
+	Tags     []tagEntry
+}
+
+// tagGroups groups tags by category, in the order of tagCategories, omitting
+// empty groups. Tags are sorted by name within each group.
+func (db *imageDB) tagGroups(tags stringSet) ([]tagGroup, error) {
+	byCategory := make(map[string][]tagEntry)
+	for name := range tags {
+		tag, ok, err := db.store.TagInfo(name)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			tag = tagEntry{Name: name}
+		}
+		c := tag.DisplayCategory()
+		byCategory[c] = append(byCategory[c], tag)
+	}
+	var groups []tagGroup
+	for _, c := range tagCategories {
+		if ts := byCategory[c]; len(ts) > 0 {
+			sort.Slice(ts, func(i, j int) bool { return ts[i].Name < ts[j].Name })
+			groups = append(groups, tagGroup{c, ts})
+		}
+	}
+	return groups, nil
+}
+
+// applyTagCategories sets the category of each tag in categories, resolving
+// aliases. Only general tags are changed; recategorizing a tag that already
+// has a category is left to the admin tag page.
+func (db *imageDB) applyTagCategories(categories map[string]string) error {
+	for name, category := range categories {
+		name, err := db.resolveAlias(name)
+		if err != nil {
+			return err
+		}
+		tag, _, err := db.store.TagInfo(name)
+		if err != nil {
+			return err
+		} else if tag.Category != "" || category == "" {
+			continue
+		}
+		info := tag.info()
+		info.Category = category
+		if err := db.store.SetTagInfo(name, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A tagMerge describes the whole of a mergeTag, so that a Store can apply it
+// in a single step.
+type tagMerge struct {
+	From, To string
+	// Aliases maps each alias to set to its tag.
+	Aliases map[string]string `json:",omitempty"`
+	// RemoveImplications are deleted before AddImplications are added.
+	RemoveImplications []implicationEntry `json:",omitempty"`
+	AddImplications    []implicationEntry `json:",omitempty"`
+}
+
+// mergeTag replaces the tag from with to on every image, merging the two if
+// to already exists; if to does not, this renames from. from's metadata,
+// aliases and implications move to to. If alias is set, from is left behind
+// as an alias of to, so that searches for it keep working. The changes are
+// planned up front and applied by the store at once, so a failure leaves
+// nothing half merged. It returns the number of images retagged.
+func (db *imageDB) mergeTag(from, to string, alias bool) (int, error) {
+	if !validTagName(from) || !validTagName(to) {
+		return 0, errBadTagName
+	}
+	to, err := db.resolveAlias(to)
+	if err != nil {
+		return 0, err
+	} else if from == to {
+		return 0, errMergeSelf
+	}
+	tag, ok, err := db.store.Tag(from)
+	if err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, errTagNotExists
+	}
+	n := len(tag.Images)
+
+	m := tagMerge{From: from, To: to, Aliases: make(map[string]string)}
+	aliases, err := db.aliasesOf(from)
+	if err != nil {
+		return 0, err
+	}
+	for _, a := range aliases {
+		m.Aliases[a] = to
+	}
+	if alias {
+		m.Aliases[from] = to
+	}
+	m.RemoveImplications, m.AddImplications, err = db.planImplicationMove(from, to)
+	if err != nil {
+		return 0, err
+	}
+	if err := db.store.MergeTag(m); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+var adminTagsTemplate = template.Must(template.New("adminTags").Parse(`
+<!DOCTYPE html>
+<html>
+	<head>
+		<title>Dispel - Admin Tags</title>
+		<link rel="stylesheet" href="/static/css/milligram.min.css">
+		<link rel="stylesheet" href="/static/css/images.css">
+	</head>
+	<body>
+		<header>
+			<a href="/images">Dispel</a>
+			|
+			<a href="/admin/queue">Queue</a>
+			|
+			<a href="/admin/aliases">Aliases</a>
+			|
+			<a href="/admin/implications">Implications</a>
+			|
+			<a href="/admin/audit">Audit</a>
+		</header>
+		<div class="content">
+			<form class="tag-edit" action="/admin/tags" method="post">
+				<input type="text" name="from" placeholder="Tag" />
+				<input type="text" name="to" placeholder="Rename or merge into" />
+				<label><input type="checkbox" name="alias" value="true" checked /> Leave an alias</label>
+				<input type="submit" value="Merge" />
+			</form>
+			{{ range .Tags }}
+				<form class="tag-edit" action="/admin/tags/{{ .Name }}" method="post">
+					<span class="tag tag-{{ .DisplayCategory }}"><a href="/images?t={{ .Name }}">{{ .Name }}</a></span>
+					<span class="tag-count">{{ .Count }}</span>
+					<select name="category">
+						{{ $cur := .DisplayCategory }}
+						{{ range $.Categories }}<option{{ if eq . $cur }} selected{{ end }}>{{ . }}</option>{{ end }}
+					</select>
+					<input type="text" name="description" placeholder="Description" value="{{ .Description }}" />
+					<input type="submit" value="Save" />
+				</form>
+			{{ else }}
+				<span>No tags!</span><br/><br/>
+			{{ end }}
+		</div>
+		<footer></footer>
+	</body>
+</html>
+`))
+
+// adminTagsHandler lists every tag, with a form to edit its category and
+// description.
+func (db *imageDB) adminTagsHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var tags []tagEntry
+	db.mu.RLock()
+	err := db.store.ForEachTag(func(tag tagEntry) error {
+		tag.Images = nil
+		tags = append(tags, tag)
+		return nil
+	})
+	db.mu.RUnlock()
+	if err != nil {
+		http.Error(w, "failed to load tags: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	adminTagsTemplate.Execute(w, struct {
+		Tags       []tagEntry
+		Categories []string
+	}{tags, tagCategories})
+}
+
+// adminTagHandlerPOST sets the category and description of a tag.
+func (db *imageDB) adminTagHandlerPOST(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	category, ok := normalizeCategory(req.FormValue("category"))
+	if !ok {
+		http.Error(w, "invalid category: "+req.FormValue("category"), http.StatusBadRequest)
+		return
+	}
+	info := tagInfo{
+		Category:    category,
+		Description: strings.TrimSpace(req.FormValue("description")),
+	}
+	db.mu.Lock()
+	err := db.store.SetTagInfo(ps.ByName("tag"), info)
+	db.mu.Unlock()
+	if err != nil {
+		http.Error(w, "failed to update tag: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/admin/tags", http.StatusSeeOther)
+}
+
+// adminTagsHandlerPOST renames a tag, or merges it into another, then applies
+// the resulting tag's implications to the retagged images in the background.
+func (db *imageDB) adminTagsHandlerPOST(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	from := strings.ToLower(strings.TrimSpace(req.FormValue("from")))
+	to := strings.ToLower(strings.TrimSpace(req.FormValue("to")))
+	db.mu.Lock()
+	_, err := db.mergeTag(from, to, req.FormValue("alias") == "true")
+	if err == nil {
+		to, err = db.resolveAlias(to)
+	}
+	db.mu.Unlock()
+	if err == errBadTagName || err == errMergeSelf {
+		http.Error(w, "failed to merge tags: "+err.Error(), http.StatusBadRequest)
+		return
+	} else if err == errTagNotExists {
+		http.Error(w, "failed to merge tags: "+err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "failed to merge tags: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	go func() {
+		if _, err := db.applyImplications(to); err != nil {
+			log.Printf("Failed to apply implications of %v: %v", to, err)
+		}
+	}()
+	http.Redirect(w, req, "/admin/tags", http.StatusSeeOther)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var errNotInTrash = errors.New("image is not in the trash")
+
+// moveImageFiles moves an image and its thumbnail into or out of the trash.
+// Files that are missing are skipped, so that an image whose files were lost
+// can still be deleted.
+func (db *imageDB) moveImageFiles(toTrash bool, hash, ext string) error {
+	moves := []struct {
+		from, to blobVariant
+		ext      string
+	}{
+		{variantImage, variantTrash, ext},
+		{variantThumb, variantTrashThumb, thumbExt},
+	}
+	for i, m := range moves {
+		if !toTrash {
+			moves[i].from, moves[i].to = m.to, m.from
+		}
+	}
+	for i, m := range moves {
+		ok, err := db.blobs.Exists(m.from, hash, m.ext)
+		if err == nil && ok {
+			err = moveBlob(db.blobs, m.from, m.to, hash, m.ext)
+		}
+		if err != nil {
+			// put back anything already moved
+			for _, done := range moves[:i] {
+				moveBlob(db.blobs, done.to, done.from, hash, done.ext)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// trashImage moves an image and its files to the trash. Its children are
+// orphaned and it is removed from its pools, as neither is restored with it;
+// its history is kept until it is purged.
+func (db *imageDB) trashImage(entry imageEntry) error {
+	if err := db.moveImageFiles(true, entry.Hash, entry.Ext); err != nil {
+		return err
+	}
+	if err := db.store.AddTrash(trashEntry{entry, time.Now()}); err != nil {
+		return err
+	}
+	if err := db.removeImage(entry.Hash); err != nil {
+		return err
+	}
+	if err := db.reparentChildren(entry.Hash, ""); err != nil {
+		return err
+	}
+	return db.repoolImage(entry.Hash, "")
+}
+
+// restoreImage moves an image out of the trash. If its parent has since been
+// deleted, it is restored without one.
+func (db *imageDB) restoreImage(hash string) error {
+	e, ok, err := db.store.Trash(hash)
+	if err != nil {
+		return err
+	} else if !ok {
+		return errNotInTrash
+	}
+	if _, ok, err := db.store.Image(hash); err != nil {
+		return err
+	} else if ok {
+		// uploaded again while in the trash
+		return errImageExists
+	}
+	entry := e.imageEntry
+	if entry.Parent != "" {
+		if _, ok, err := db.store.Image(entry.Parent); err != nil {
+			return err
+		} else if !ok {
+			entry.Parent = ""
+		}
+	}
+	if err := db.moveImageFiles(false, hash, entry.Ext); err != nil {
+		return err
+	}
+	if err := db.addImage(entry); err != nil {
+		return err
+	}
+	return db.store.RemoveTrash(hash)
+}
+
+// purgeImage permanently deletes an image in the trash, along with its files,
+// history and view count.
+func (db *imageDB) purgeImage(hash string) error {
+	e, ok, err := db.store.Trash(hash)
+	if err != nil {
+		return err
+	} else if !ok {
+		return errNotInTrash
+	}
+	if err := db.store.RemoveTrash(hash); err != nil {
+		return err
+	}
+	// a copy uploaded since the image was trashed keeps its history
+	if _, ok, err := db.store.Image(hash); err != nil {
+		return err
+	} else if !ok {
+		if err := db.store.RemoveRevisions(hash); err != nil {
+			return err
+		}
+		if err := db.store.RemoveViews(hash); err != nil {
+			return err
+		}
+	}
+	db.blobs.Delete(variantTrash, hash, e.Ext)
+	db.blobs.Delete(variantTrashThumb, hash, thumbExt)
+	return nil
+}
+
+// purgeTrash purges every image that has been in the trash for longer than
+// retention, returning the number purged. It takes db.mu itself.
+func (db *imageDB) purgeTrash(retention time.Duration) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	cutoff := time.Now().Add(-retention)
+	var expired []string
+	err := db.store.ForEachTrash(func(e trashEntry) error {
+		if e.Deleted.Before(cutoff) {
+			expired = append(expired, e.Hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, hash := range expired {
+		if err := db.purgeImage(hash); err != nil {
+			return i, err
+		}
+	}
+	return len(expired), nil
+}
+
+// purgeTrashEvery calls purgeTrash every interval, forever.
+func (db *imageDB) purgeTrashEvery(interval, retention time.Duration) {
+	for range time.Tick(interval) {
+		n, err := db.purgeTrash(retention)
+		if err != nil {
+			log.Printf("Purging trash failed after %v images: %v", n, err)
+		} else if n > 0 {
+			log.Printf("Purged %v images from the trash", n)
+		}
+	}
+}
+
+var adminTrashTemplate = template.Must(template.New("adminTrash").Parse(`
+<!DOCTYPE html>
+<html>
+	<head>
+		<title>Dispel - Admin Trash</title>
+		<link rel="stylesheet" href="/static/css/milligram.min.css">
+		<link rel="stylesheet" href="/static/css/images.css">
+	</head>
+	<body>
+		<header>
+			<a href="/images">Dispel</a>
+			|
+			<a href="/admin/queue">Queue</a>
+			|
+			<a href="/admin/audit">Audit</a>
+		</header>
+		<div class="imagelist">
+			{{ range .Entries }}
+				<span class="trash-item">
+					<span class="thumb">
+						<img class="preview" src="/admin/trash/{{ .Hash }}_thumb.jpg" />
+					</span>
+					<span>Deleted {{ .Deleted.Local.Format "Jan 2, 2006" }}, purged {{ (.Deleted.Add $.Retention).Local.Format "Jan 2, 2006" }}</span>
+					<form action="/admin/trash/{{ .Hash }}/restore" method="post">
+						<input type="submit" value="Restore" />
+						<input type="submit" value="Purge" formaction="/admin/trash/{{ .Hash }}/purge" />
+					</form>
+				</span>
+			{{ else }}
+				<span>Nothing in the trash!</span><br/><br/>
+			{{ end }}
+		</div>
+		<footer></footer>
+	</body>
+</html>
+`))
+
+// adminTrashHandler lists the images in the trash, most recently deleted
+// first.
+func (db *imageDB) adminTrashHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var entries []trashEntry
+	db.mu.RLock()
+	err := db.store.ForEachTrash(func(e trashEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	db.mu.RUnlock()
+	if err != nil {
+		http.Error(w, "failed to load trash: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Deleted.After(entries[j].Deleted) })
+	adminTrashTemplate.Execute(w, struct {
+		Entries   []trashEntry
+		Retention time.Duration
+	}{entries, *trashRetention})
+}
+
+func (db *imageDB) adminTrashImg(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	name := ps.ByName("path")
+	for _, v := range []blobVariant{variantTrash, variantTrashThumb} {
+		if hash, ext, ok := v.flat().parse(name); ok {
+			serveBlob(w, req, db.blobs, v, hash, ext)
+			return
+		}
+	}
+	http.NotFound(w, req)
+}
+
+// adminTrashRestoreHandlerPOST restores an image from the trash.
+func (db *imageDB) adminTrashRestoreHandlerPOST(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	db.mu.Lock()
+	err := db.restoreImage(ps.ByName("path"))
+	db.mu.Unlock()
+	if err == errNotInTrash {
+		http.Error(w, "failed to restore image: "+err.Error(), http.StatusNotFound)
+		return
+	} else if err == errImageExists {
+		http.Error(w, "failed to restore image: "+err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "failed to restore image: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/admin/trash", http.StatusSeeOther)
+}
+
+// adminTrashPurgeHandlerPOST permanently deletes an image in the trash.
+func (db *imageDB) adminTrashPurgeHandlerPOST(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	db.mu.Lock()
+	err := db.purgeImage(ps.ByName("path"))
+	db.mu.Unlock()
+	if err == errNotInTrash {
+		http.Error(w, "failed to purge image: "+err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "failed to purge image: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/admin/trash", http.StatusSeeOther)
+}
@@ -1,11 +1,12 @@
 package main
 
 import (
+	"html/template"
 	"io"
 	"mime"
 	"net/http"
+	"path"
 	"path/filepath"
-	"text/template"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -23,6 +24,8 @@ var uploadImageTemplate = template.Must(template.New("uploadImage").Parse(`
 			<a href="/images">Dispel</a>
 			|
 			<a href="/images/upload">Upload</a>
+			|
+			<a href="/pools">Pools</a>
 		</header>
 		<div class="flex">
 			<div class="upload-form">
@@ -82,7 +85,7 @@ func (db *imageDB) imageUploadHandler(w http.ResponseWriter, req *http.Request,
 
 func (db *imageDB) imageUploadHandlerPOST(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	// parse tags
-	tags, badTags := parseTags(req.FormValue("tags"))
+	tags, badTags, categories := parseTags(req.FormValue("tags"))
 	if len(tags) == 0 {
 		http.Error(w, "failed to add image: please supply at least one tag", http.StatusBadRequest)
 		return
@@ -93,7 +96,7 @@ func (db *imageDB) imageUploadHandlerPOST(w http.ResponseWriter, req *http.Reque
 
 	// image may be local or from URL
 	var file io.ReadCloser
-	var ext string
+	var ext, filename, source string
 	if url := req.FormValue("url"); url != "" {
 		resp, err := http.Get(url)
 		if err != nil {
@@ -102,6 +105,10 @@ func (db *imageDB) imageUploadHandlerPOST(w http.ResponseWriter, req *http.Reque
 		}
 		file = resp.Body
 		ext = filepath.Ext(url)
+		if base := path.Base(resp.Request.URL.Path); base != "/" && base != "." {
+			filename = base
+		}
+		source = url
 	} else {
 		formFile, header, err := req.FormFile("image")
 		if err != nil {
@@ -115,11 +122,12 @@ func (db *imageDB) imageUploadHandlerPOST(w http.ResponseWriter, req *http.Reque
 		}
 		file = formFile
 		ext = exts[0]
+		filename = header.Filename
 	}
 	defer file.Close()
 
 	// add to queue
-	err := db.QueueUpload(file, tags, ext)
+	err := db.QueueUpload(file, tags, categories, ext, filename, source, remoteHost(req))
 	if err != nil {
 		http.Error(w, "failed to read uploaded image data: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// countView records a view of an image. Views are batched in memory and
+// written to the store by flushViews, so that viewing an image does not
+// take db.mu for writing.
+func (db *imageDB) countView(hash string) {
+	db.viewsMu.Lock()
+	if db.views == nil {
+		db.views = make(map[string]int)
+	}
+	db.views[hash]++
+	db.viewsMu.Unlock()
+}
+
+// flushViews writes the views counted since the last flush to the store.
+// Views of images deleted in the meantime are dropped. It takes db.mu
+// itself.
+func (db *imageDB) flushViews() error {
+	db.viewsMu.Lock()
+	views := db.views
+	db.views = nil
+	db.viewsMu.Unlock()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for hash, n := range views {
+		if _, ok, err := db.store.Image(hash); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		if err := db.store.AddViews(hash, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushViewsEvery calls flushViews every interval, forever.
+func (db *imageDB) flushViewsEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := db.flushViews(); err != nil {
+			log.Printf("Saving view counts failed: %v", err)
+		}
+	}
+}
+
+// viewCounts returns the view count of every image that has been viewed.
+func (db *imageDB) viewCounts() (map[string]int, error) {
+	views := make(map[string]int)
+	err := db.store.ForEachViews(func(hash string, n int) error {
+		views[hash] = n
+		return nil
+	})
+	return views, err
+}
+
+// moveViews moves the view count of the image from to to, e.g. when it is
+// rekeyed.
+func (db *imageDB) moveViews(from, to string) error {
+	n, err := db.store.Views(from)
+	if err != nil || n == 0 {
+		return err
+	}
+	if err := db.store.AddViews(to, n); err != nil {
+		return err
+	}
+	return db.store.RemoveViews(from)
+}